@@ -0,0 +1,463 @@
+// fxctl administers a running fxnode through its admin API
+//
+//	fxctl [-datadir dir] [-endpoint unix:path] [-json] <command> [args]
+//
+// exit codes: 0 ok, 1 the node returned an error, 2 usage, 3 node
+// unreachable or token refused, 4 health check failed
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"fx/chain/logger"
+	"fx/chain/p2p"
+)
+
+const (
+	exitOK = iota
+	exitError
+	exitUsage
+	exitUnavailable
+	exitUnhealthy
+)
+
+// data directory files written by fxnode
+const (
+	adminSocket = "admin.sock"
+	adminToken  = "admin.token"
+)
+
+const usage = `usage: fxctl [flags] <command> [args]
+
+commands:
+  peers                      list peers
+  peer <ip|id>               show one peer
+  members                    list the membership view
+  connect [-static] <ip>     dial a peer
+  disconnect <ip|id>         drop a peer connection
+  ban [-for 1h] <ip>         refuse a peer
+  unban <ip>                 lift a ban
+  bans                       list bans
+  send <ip|id> <command> <body>
+                             send an application message
+  loglevel [level]           show or set the node log level
+  metrics                    show node metrics
+  time                       show the clock offset against the network
+  health [-min-peers n]      exit 0 when the node answers with enough online peers
+
+flags:
+`
+
+// cli one invocation, output goes to out
+type cli struct {
+	client  *p2p.AdminClient
+	asJSON  bool
+	out     io.Writer
+	command string
+	args    []string
+}
+
+// codeError error with the exit code it maps to
+type codeError struct {
+	code int
+	err  error
+}
+
+func (e *codeError) Error() string {
+	return e.err.Error()
+}
+
+func usageError(format string, a ...interface{}) error {
+	return &codeError{exitUsage, fmt.Errorf(format, a...)}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, out, errOut io.Writer) int {
+	flags := flag.NewFlagSet("fxctl", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	dataDir := flags.String("datadir", defaultDataDir(), "node data directory")
+	endpoint := flags.String("endpoint", "", "admin endpoint, default unix:<datadir>/"+adminSocket)
+	tokenFile := flags.String("token-file", "", "admin token file, default <datadir>/"+adminToken)
+	asJSON := flags.Bool("json", false, "print JSON instead of tables")
+	timeout := flags.Duration("timeout", 5*time.Second, "call timeout")
+	flags.Usage = func() {
+		fmt.Fprint(errOut, usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	if *endpoint == "" {
+		*endpoint = "unix:" + filepath.Join(*dataDir, adminSocket)
+	}
+	if *tokenFile == "" {
+		*tokenFile = filepath.Join(*dataDir, adminToken)
+	}
+	token, err := ioutil.ReadFile(*tokenFile)
+	if err != nil {
+		fmt.Fprintln(errOut, "fxctl: read token:", err)
+		return exitUnavailable
+	}
+	c := &cli{
+		client:  p2p.NewAdminClient(*endpoint, strings.TrimSpace(string(token)), *timeout),
+		asJSON:  *asJSON,
+		out:     out,
+		command: flags.Arg(0),
+		args:    flags.Args()[1:],
+	}
+	if err := c.run(); err != nil {
+		fmt.Fprintln(errOut, "fxctl:", err)
+		return exitCode(err)
+	}
+	return exitOK
+}
+
+func defaultDataDir() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".fxnode")
+	}
+	return ".fxnode"
+}
+
+// exitCode node errors are 1, transport errors and a refused token 3
+func exitCode(err error) int {
+	switch e := err.(type) {
+	case *codeError:
+		return e.code
+	case *p2p.AdminError:
+		if e.Code == p2p.AdminUnauthorized {
+			return exitUnavailable
+		}
+		return exitError
+	}
+	return exitUnavailable
+}
+
+func (c *cli) run() error {
+	switch c.command {
+	case "peers":
+		return c.peers()
+	case "peer":
+		return c.peer()
+	case "members":
+		return c.members()
+	case "connect":
+		return c.connect()
+	case "disconnect":
+		return c.simple("disconnect", 1, func(args []string) interface{} { return map[string]string{"peer": args[0]} })
+	case "ban":
+		return c.ban()
+	case "unban":
+		return c.simple("unban", 1, func(args []string) interface{} { return map[string]string{"ip": args[0]} })
+	case "bans":
+		return c.bans()
+	case "send":
+		return c.send()
+	case "loglevel":
+		return c.logLevel()
+	case "metrics":
+		return c.metrics()
+	case "time":
+		return c.networkTime()
+	case "health":
+		return c.health()
+	}
+	return usageError("unknown command %q", c.command)
+}
+
+func (c *cli) peers() error {
+	if len(c.args) != 0 {
+		return usageError("peers takes no arguments")
+	}
+	var peers []p2p.PeerInfo
+	if err := c.client.Call("peers", nil, &peers); err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(peers)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tNODE ID\tNAME\tROLE\tSTATE\tDIRECTION\tLAST SEEN")
+	for _, peer := range peers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", peer.IP, dash(peer.NodeID), dash(peer.Name), dash(peer.Role),
+			state(peer.Online), direction(peer.Inbound), lastSeen(peer.LastSeen))
+	}
+	return w.Flush()
+}
+
+func (c *cli) members() error {
+	if len(c.args) != 0 {
+		return usageError("members takes no arguments")
+	}
+	var members []p2p.Member
+	if err := c.client.Call("members", nil, &members); err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(members)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tNODE ID\tSTATE\tINCARNATION\tSINCE")
+	for _, member := range members {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", member.IP, dash(member.NodeID), member.State, member.Incarnation, lastSeen(member.Since))
+	}
+	return w.Flush()
+}
+
+func (c *cli) peer() error {
+	if len(c.args) != 1 {
+		return usageError("peer <ip|id>")
+	}
+	var peer p2p.PeerInfo
+	if err := c.client.Call("peer", map[string]string{"peer": c.args[0]}, &peer); err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(peer)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ip\t%s\n", peer.IP)
+	fmt.Fprintf(w, "node id\t%s\n", dash(peer.NodeID))
+	fmt.Fprintf(w, "name\t%s\n", dash(peer.Name))
+	fmt.Fprintf(w, "role\t%s\n", dash(peer.Role))
+	fmt.Fprintf(w, "tag\t%d\n", peer.Tag)
+	fmt.Fprintf(w, "state\t%s\n", state(peer.Online))
+	fmt.Fprintf(w, "direction\t%s\n", direction(peer.Inbound))
+	fmt.Fprintf(w, "transport\t%s\n", dash(peer.Transport))
+	fmt.Fprintf(w, "last seen\t%s\n", lastSeen(peer.LastSeen))
+	if peer.RTT > 0 || peer.ClockOffset != 0 {
+		fmt.Fprintf(w, "clock offset\t%s\n", peer.ClockOffset)
+		fmt.Fprintf(w, "rtt\t%s\n", peer.RTT)
+	}
+	if peer.Position != nil {
+		fmt.Fprintf(w, "position\t%.5f,%.5f\n", peer.Position.Latitude, peer.Position.Longitude)
+	}
+	names := make([]string, 0, len(peer.Protocols))
+	for name := range peer.Protocols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "protocol\t%s/%d\n", name, peer.Protocols[name])
+	}
+	return w.Flush()
+}
+
+func (c *cli) connect() error {
+	flags := flag.NewFlagSet("connect", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	static := flags.Bool("static", false, "keep redialing the peer")
+	if err := flags.Parse(c.args); err != nil || flags.NArg() != 1 {
+		return usageError("connect [-static] <ip>")
+	}
+	return c.call("connect", map[string]interface{}{"ip": flags.Arg(0), "static": *static})
+}
+
+func (c *cli) ban() error {
+	flags := flag.NewFlagSet("ban", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	d := flags.Duration("for", time.Hour, "ban duration")
+	if err := flags.Parse(c.args); err != nil || flags.NArg() != 1 || *d < time.Second {
+		return usageError("ban [-for 1h] <ip>")
+	}
+	return c.call("ban", map[string]interface{}{"ip": flags.Arg(0), "seconds": int(d.Seconds())})
+}
+
+func (c *cli) bans() error {
+	var bans map[string]time.Time
+	if err := c.client.Call("bans", nil, &bans); err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(bans)
+	}
+	ips := make([]string, 0, len(bans))
+	for ip := range bans {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tUNTIL")
+	for _, ip := range ips {
+		fmt.Fprintf(w, "%s\t%s\n", ip, bans[ip].Local().Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func (c *cli) send() error {
+	if len(c.args) != 3 {
+		return usageError("send <ip|id> <command> <body>")
+	}
+	command, err := strconv.ParseInt(c.args[1], 10, 16)
+	if err != nil {
+		return usageError("command %q not a number", c.args[1])
+	}
+	return c.call("send", map[string]interface{}{"peer": c.args[0], "command": command, "body": c.args[2]})
+}
+
+func (c *cli) logLevel() error {
+	if len(c.args) > 1 {
+		return usageError("loglevel [level]")
+	}
+	params := map[string]string{}
+	if len(c.args) == 1 {
+		if _, err := logger.LvlFromString(c.args[0]); err != nil {
+			return usageError("log level %q unknown", c.args[0])
+		}
+		params["level"] = c.args[0]
+	}
+	var level string
+	if err := c.client.Call("logLevel", params, &level); err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(level)
+	}
+	fmt.Fprintln(c.out, level)
+	return nil
+}
+
+func (c *cli) metrics() error {
+	var metrics p2p.Metrics
+	if err := c.client.Call("metrics", nil, &metrics); err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(metrics)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "node id\t%s\n", metrics.NodeID)
+	fmt.Fprintf(w, "role\t%s\n", metrics.Role)
+	fmt.Fprintf(w, "uptime\t%s\n", (time.Duration(metrics.Uptime) * time.Second).String())
+	fmt.Fprintf(w, "peers\t%d online / %d known\n", metrics.OnlinePeers, metrics.Peers)
+	fmt.Fprintf(w, "banned\t%d\n", metrics.Banned)
+	fmt.Fprintf(w, "tcp in\t%d frames, %d bytes\n", metrics.TCP.FramesIn, metrics.TCP.BytesIn)
+	fmt.Fprintf(w, "tcp out\t%d frames, %d bytes\n", metrics.TCP.FramesOut, metrics.TCP.BytesOut)
+	fmt.Fprintf(w, "udp in\t%d frames, %d bytes\n", metrics.UDP.FramesIn, metrics.UDP.BytesIn)
+	fmt.Fprintf(w, "udp out\t%d frames, %d bytes\n", metrics.UDP.FramesOut, metrics.UDP.BytesOut)
+	fmt.Fprintf(w, "websocket in\t%d frames, %d bytes\n", metrics.WebSocket.FramesIn, metrics.WebSocket.BytesIn)
+	fmt.Fprintf(w, "websocket out\t%d frames, %d bytes\n", metrics.WebSocket.FramesOut, metrics.WebSocket.BytesOut)
+	fmt.Fprintf(w, "unix in\t%d frames, %d bytes\n", metrics.Unix.FramesIn, metrics.Unix.BytesIn)
+	fmt.Fprintf(w, "unix out\t%d frames, %d bytes\n", metrics.Unix.FramesOut, metrics.Unix.BytesOut)
+	fmt.Fprintf(w, "replay\t%d accepted, %d stale, %d future, %d duplicate\n", metrics.Replay.Accepted,
+		metrics.Replay.Stale, metrics.Replay.Future, metrics.Replay.Duplicate)
+	return w.Flush()
+}
+
+func (c *cli) networkTime() error {
+	if len(c.args) != 0 {
+		return usageError("time takes no arguments")
+	}
+	var info p2p.NetworkTimeInfo
+	if err := c.client.Call("time", nil, &info); err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(info)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "local\t%s\n", info.Local.Local().Format(time.RFC3339Nano))
+	fmt.Fprintf(w, "network\t%s\n", info.Network.Local().Format(time.RFC3339Nano))
+	fmt.Fprintf(w, "offset\t%s from %d peers, warning above %s\n", info.Offset, info.Peers, info.Warning)
+	for _, clock := range info.Clocks {
+		fmt.Fprintf(w, "%s\toffset %s, rtt %s\n", clock.IP, clock.Offset, clock.RTT)
+	}
+	return w.Flush()
+}
+
+// health exit 4 when fewer than min peers are online
+func (c *cli) health() error {
+	flags := flag.NewFlagSet("health", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	minPeers := flags.Int("min-peers", 0, "online peers required")
+	if err := flags.Parse(c.args); err != nil || flags.NArg() != 0 {
+		return usageError("health [-min-peers n]")
+	}
+	var metrics p2p.Metrics
+	if err := c.client.Call("metrics", nil, &metrics); err != nil {
+		return err
+	}
+	healthy := metrics.OnlinePeers >= *minPeers
+	if c.asJSON {
+		c.printJSON(map[string]interface{}{"healthy": healthy, "onlinePeers": metrics.OnlinePeers, "minPeers": *minPeers})
+	} else if healthy {
+		fmt.Fprintf(c.out, "ok, %d peers online\n", metrics.OnlinePeers)
+	}
+	if !healthy {
+		return &codeError{exitUnhealthy, fmt.Errorf("%d peers online, %d required", metrics.OnlinePeers, *minPeers)}
+	}
+	return nil
+}
+
+// simple call a method taking n positional arguments
+func (c *cli) simple(method string, n int, params func(args []string) interface{}) error {
+	if len(c.args) != n {
+		return usageError("%s takes %d argument(s)", c.command, n)
+	}
+	return c.call(method, params(c.args))
+}
+
+// call a method answering true
+func (c *cli) call(method string, params interface{}) error {
+	var ok bool
+	if err := c.client.Call(method, params, &ok); err != nil {
+		return err
+	}
+	if c.asJSON {
+		return c.printJSON(ok)
+	}
+	fmt.Fprintln(c.out, "ok")
+	return nil
+}
+
+func (c *cli) printJSON(val interface{}) error {
+	encoder := json.NewEncoder(c.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(val)
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func state(online bool) string {
+	if online {
+		return "online"
+	}
+	return "offline"
+}
+
+func direction(inbound bool) string {
+	if inbound {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+func lastSeen(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
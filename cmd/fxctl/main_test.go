@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fx/chain/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func startTestAdmin(t *testing.T) (string, func()) {
+	dir, _ := ioutil.TempDir("", "fxctl")
+	token, err := p2p.LoadOrCreateAdminToken(filepath.Join(dir, adminToken))
+	assert.NoError(t, err)
+	listener, err := p2p.ListenAdmin("unix:" + filepath.Join(dir, adminSocket))
+	assert.NoError(t, err)
+	admin := p2p.NewAdminServer(p2p.NewTCPServer(8896, p2p.NewEventHandler(nil)), token)
+	go admin.Serve(listener)
+	return dir, func() {
+		admin.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func runTest(args ...string) (int, string, string) {
+	var out, errOut bytes.Buffer
+	code := run(args, &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+func TestRun(t *testing.T) {
+	dir, stop := startTestAdmin(t)
+	defer stop()
+
+	code, out, _ := runTest("-datadir", dir, "peers")
+	assert.Equal(t, exitOK, code)
+	assert.True(t, strings.HasPrefix(out, "IP"))
+
+	code, out, _ = runTest("-datadir", dir, "-json", "metrics")
+	assert.Equal(t, exitOK, code)
+	var metrics p2p.Metrics
+	assert.NoError(t, json.Unmarshal([]byte(out), &metrics))
+
+	code, out, _ = runTest("-datadir", dir, "time")
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, out, "from 0 peers")
+
+	code, out, _ = runTest("-datadir", dir, "ban", "-for", "10m", "10.0.0.9")
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, "ok\n", out)
+	code, out, _ = runTest("-datadir", dir, "bans")
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, out, "10.0.0.9")
+
+	code, out, _ = runTest("-datadir", dir, "loglevel", "info")
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, "info\n", out)
+	p2p.SetLogLevel("debug")
+
+	code, _, _ = runTest("-datadir", dir, "peer", "10.0.0.1")
+	assert.Equal(t, exitError, code)
+	// the test node runs no membership
+	code, _, _ = runTest("-datadir", dir, "members")
+	assert.Equal(t, exitError, code)
+	code, _, _ = runTest("-datadir", dir, "send", "10.0.0.1", "sixty", "hi")
+	assert.Equal(t, exitUsage, code)
+	code, _, _ = runTest("-datadir", dir, "reboot")
+	assert.Equal(t, exitUsage, code)
+
+	code, out, _ = runTest("-datadir", dir, "health")
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, "ok, 0 peers online\n", out)
+	code, _, _ = runTest("-datadir", dir, "health", "-min-peers", "1")
+	assert.Equal(t, exitUnhealthy, code)
+
+	ioutil.WriteFile(filepath.Join(dir, "wrong.token"), []byte("wrong"), 0600)
+	code, _, _ = runTest("-datadir", dir, "-token-file", filepath.Join(dir, "wrong.token"), "peers")
+	assert.Equal(t, exitUnavailable, code)
+	code, _, _ = runTest("-datadir", dir, "-endpoint", "unix:"+filepath.Join(dir, "none.sock"), "health")
+	assert.Equal(t, exitUnavailable, code)
+}
@@ -0,0 +1,203 @@
+// fxnode runs a p2p node with a data directory holding its config, key,
+// peer store, logs and pid file
+//
+//	fxnode [-config file] [-datadir dir] [-port 10000] [-role server] [-name node] [-admin unix:path] [-ws-port 10002] [-unix node.sock]
+//	fxnode -genkey [-datadir dir]
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"fx/chain/common/utils"
+	"fx/chain/p2p"
+)
+
+// Config fxnode settings, flags set on the command line win over the file
+type Config struct {
+	DataDir       string `json:"dataDir"`
+	Port          int    `json:"port"`
+	Role          string `json:"role"`
+	Name          string `json:"name"`
+	LogLevel      string `json:"logLevel"`
+	PreferNearby  bool   `json:"preferNearby"`
+	RequireSigned bool   `json:"requireSigned"`
+	Pex           bool   `json:"pex"`
+	Swim          bool   `json:"swim"`
+	Admin         string `json:"admin"`
+	// WebSocketPort serves peers such as browsers on WebSocketPath, 0 is off,
+	// browsers from other origins need to be listed in WebSocketOrigins
+	WebSocketPort    int      `json:"websocketPort"`
+	WebSocketOrigins []string `json:"websocketOrigins"`
+	// Unix socket for services on the same host, relative to the data
+	// directory, empty is off
+	Unix string `json:"unix"`
+	// ClockWarn seconds the local clock may be off the network time before
+	// a warning is logged, 0 is the default
+	ClockWarn int `json:"clockWarn"`
+}
+
+const configFile = "config.json"
+
+func defaultConfig() Config {
+	dataDir := ".fxnode"
+	if home, err := os.UserHomeDir(); err == nil {
+		dataDir = filepath.Join(home, ".fxnode")
+	}
+	return Config{
+		DataDir:  dataDir,
+		Port:     p2p.ReleasePort,
+		Role:     p2p.Server,
+		LogLevel: "info",
+		Pex:      true,
+		Swim:     true,
+	}
+}
+
+func main() {
+	flags := flag.NewFlagSet("fxnode", flag.ExitOnError)
+	configPath := flags.String("config", "", "config file, default <datadir>/"+configFile+" when present")
+	genKey := flags.Bool("genkey", false, "create the node key if missing, print the node id and exit")
+	cfg := defaultConfig()
+	flags.StringVar(&cfg.DataDir, "datadir", cfg.DataDir, "data directory")
+	flags.IntVar(&cfg.Port, "port", cfg.Port, "UDP port, TCP listens on port+1")
+	flags.StringVar(&cfg.Role, "role", cfg.Role, "server or client")
+	flags.StringVar(&cfg.Name, "name", cfg.Name, "node name announced to peers")
+	flags.StringVar(&cfg.LogLevel, "loglevel", cfg.LogLevel, "debug, info, warn or error")
+	flags.BoolVar(&cfg.PreferNearby, "prefer-nearby", cfg.PreferNearby, "dial and relay through nearby peers first")
+	flags.BoolVar(&cfg.RequireSigned, "require-signed", cfg.RequireSigned, "drop unsigned application messages")
+	flags.BoolVar(&cfg.Pex, "pex", cfg.Pex, "exchange known peers with connected nodes")
+	flags.BoolVar(&cfg.Swim, "swim", cfg.Swim, "detect failed peers with the SWIM membership protocol")
+	flags.IntVar(&cfg.ClockWarn, "clock-warn", cfg.ClockWarn, "warn when the local clock is this many seconds off the network time, 0 is the default")
+	flags.StringVar(&cfg.Admin, "admin", cfg.Admin, "admin API endpoint, unix:path or a loopback host:port, default <datadir>/"+adminSocket+", off disables it")
+	flags.IntVar(&cfg.WebSocketPort, "ws-port", cfg.WebSocketPort, "WebSocket port for browser and mobile peers, 0 disables it")
+	flags.StringVar(&cfg.Unix, "unix", cfg.Unix, "Unix socket for local services, relative to the data directory, empty disables it")
+	flags.Parse(os.Args[1:])
+
+	if err := loadConfig(flags, *configPath, &cfg); err != nil {
+		fatal(err)
+	}
+	if *genKey {
+		if err := printKey(cfg); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	node, err := newNode(cfg)
+	if err != nil {
+		fatal(err)
+	}
+	if err := node.start(); err != nil {
+		node.stop()
+		fatal(err)
+	}
+	if err := node.startWebSocket(); err != nil {
+		node.stop()
+		fatal(err)
+	}
+	if err := node.startUnix(); err != nil {
+		node.stop()
+		fatal(err)
+	}
+	if err := node.startAdmin(); err != nil {
+		node.stop()
+		fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+	node.log.Info("fxnode shutting down", "signal", sig.String())
+	if err := node.stop(); err != nil {
+		fatal(err)
+	}
+}
+
+// loadConfig read the config file into the flag-bound cfg, flags given on
+// the command line are set again on top of it
+func loadConfig(flags *flag.FlagSet, path string, cfg *Config) error {
+	if path == "" {
+		if candidate := filepath.Join(cfg.DataDir, configFile); utils.PathExists(candidate) {
+			path = candidate
+		}
+	}
+	if path != "" {
+		given := map[string]string{}
+		flags.Visit(func(f *flag.Flag) {
+			given[f.Name] = f.Value.String()
+		})
+		if err := utils.LoadJSON(path, cfg); err != nil {
+			return fmt.Errorf("load config %s err:%s", path, err.Error())
+		}
+		for name, value := range given {
+			flags.Set(name, value)
+		}
+	}
+	return cfg.validate()
+}
+
+func (cfg Config) validate() error {
+	if cfg.DataDir == "" {
+		return errors.New("data dir not empty")
+	}
+	if cfg.Port <= 0 || cfg.Port >= 65535 {
+		return fmt.Errorf("port %d out of range", cfg.Port)
+	}
+	if cfg.WebSocketPort < 0 || cfg.WebSocketPort >= 65535 {
+		return fmt.Errorf("websocket port %d out of range", cfg.WebSocketPort)
+	}
+	if cfg.Role != p2p.Server && cfg.Role != p2p.Client {
+		return fmt.Errorf("role %q must be server or client", cfg.Role)
+	}
+	if _, err := parseLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	return nil
+}
+
+// unixPath where the Unix socket listens, empty when it is off
+func (cfg Config) unixPath() string {
+	if cfg.Unix == "" || filepath.IsAbs(cfg.Unix) {
+		return cfg.Unix
+	}
+	return filepath.Join(cfg.DataDir, cfg.Unix)
+}
+
+// adminEndpoint where the admin API listens, empty when it is off
+func (cfg Config) adminEndpoint() string {
+	switch cfg.Admin {
+	case "off":
+		return ""
+	case "":
+		return "unix:" + filepath.Join(cfg.DataDir, adminSocket)
+	}
+	return cfg.Admin
+}
+
+func printKey(cfg Config) error {
+	if err := utils.CheckMkdir(cfg.DataDir); err != nil {
+		return err
+	}
+	key, err := loadOrCreateKey(filepath.Join(cfg.DataDir, keyFile))
+	if err != nil {
+		return err
+	}
+	info, _ := json.MarshalIndent(map[string]string{
+		"nodeId":  keyNodeID(key).String(),
+		"address": p2p.KeyAddress(p2p.NewKeySigner(key, nil).PublicKey()),
+	}, "", "  ")
+	fmt.Println(string(info))
+	return nil
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "fxnode:", err)
+	os.Exit(1)
+}
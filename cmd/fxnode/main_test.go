@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fx/chain/common/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func testFlags(cfg *Config) *flag.FlagSet {
+	flags := flag.NewFlagSet("fxnode", flag.ContinueOnError)
+	flags.StringVar(&cfg.DataDir, "datadir", cfg.DataDir, "")
+	flags.IntVar(&cfg.Port, "port", cfg.Port, "")
+	flags.StringVar(&cfg.Role, "role", cfg.Role, "")
+	flags.StringVar(&cfg.Name, "name", cfg.Name, "")
+	flags.StringVar(&cfg.LogLevel, "loglevel", cfg.LogLevel, "")
+	return flags
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fxnode")
+	defer os.RemoveAll(dir)
+	assert.NoError(t, utils.SaveJSON(filepath.Join(dir, configFile), Config{DataDir: dir, Port: 12000, Role: "client", Name: "file", LogLevel: "warn"}))
+
+	cfg := defaultConfig()
+	flags := testFlags(&cfg)
+	assert.NoError(t, flags.Parse([]string{"-datadir", dir, "-name", "flag"}))
+	assert.NoError(t, loadConfig(flags, "", &cfg))
+	assert.Equal(t, 12000, cfg.Port)
+	assert.Equal(t, "client", cfg.Role)
+	assert.Equal(t, "warn", cfg.LogLevel)
+	assert.Equal(t, "flag", cfg.Name)
+
+	cfg = defaultConfig()
+	flags = testFlags(&cfg)
+	assert.NoError(t, flags.Parse([]string{"-datadir", dir, "-role", "observer"}))
+	assert.Error(t, loadConfig(flags, "", &cfg))
+	cfg = defaultConfig()
+	assert.Error(t, loadConfig(testFlags(&cfg), filepath.Join(dir, "missing.json"), &cfg))
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fxnode")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, keyFile)
+
+	key, err := loadOrCreateKey(path)
+	assert.NoError(t, err)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	loaded, err := loadOrCreateKey(path)
+	assert.NoError(t, err)
+	assert.Equal(t, key.D, loaded.D)
+	assert.Equal(t, keyNodeID(key), keyNodeID(loaded))
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("not a key"), 0600))
+	_, err = loadOrCreateKey(path)
+	assert.Error(t, err)
+}
+
+func TestPidLock(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fxnode")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, pidFile)
+
+	lock, err := acquirePidLock(path)
+	assert.NoError(t, err)
+	pid, alive := pidAlive(path)
+	assert.True(t, alive)
+	assert.Equal(t, os.Getpid(), pid)
+	_, err = acquirePidLock(path)
+	assert.Error(t, err)
+	lock.release()
+	assert.False(t, utils.PathExists(path))
+
+	// a pid file left by a crashed node is taken over
+	assert.NoError(t, ioutil.WriteFile(path, []byte("999999999\n"), 0644))
+	lock, err = acquirePidLock(path)
+	assert.NoError(t, err)
+	lock.release()
+}
+
+func TestUnixPath(t *testing.T) {
+	cfg := Config{DataDir: "/var/lib/fxnode"}
+	assert.Equal(t, "", cfg.unixPath())
+	cfg.Unix = "node.sock"
+	assert.Equal(t, "/var/lib/fxnode/node.sock", cfg.unixPath())
+	cfg.Unix = "/run/fxnode.sock"
+	assert.Equal(t, "/run/fxnode.sock", cfg.unixPath())
+}
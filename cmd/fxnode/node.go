@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"fx/chain/common/utils"
+	"fx/chain/logger"
+	"fx/chain/p2p"
+)
+
+// files kept in the data directory
+const (
+	keyFile     = "node.key"
+	pidFile     = "fxnode.pid"
+	logDir      = "logs"
+	nodeLogFile = "fxnode.log"
+	p2pLogFile  = "p2p.log"
+	adminSocket = "admin.sock"
+	adminToken  = "admin.token"
+	// unixMode owner and group may connect to the Unix socket
+	unixMode = 0660
+)
+
+// servers stop within this time or the node exits anyway
+const shutdownTimeout = 10 * time.Second
+
+// node a running fxnode and what it owns in the data directory
+type node struct {
+	cfg     Config
+	log     logger.Logger
+	lock    *pidLock
+	key     *ecdsa.PrivateKey
+	handler *p2p.EventHandler
+	server  *p2p.P2PServer
+	tcp     *p2p.TcpServer
+	admin   *p2p.AdminServer
+	ws      *p2p.WebSocketServer
+	unix    *p2p.UnixServer
+}
+
+// newNode lock the data directory, set up logs and load the key
+func newNode(cfg Config) (*node, error) {
+	if err := utils.CheckMkdir(cfg.DataDir); err != nil {
+		return nil, err
+	}
+	lock, err := acquirePidLock(filepath.Join(cfg.DataDir, pidFile))
+	if err != nil {
+		return nil, err
+	}
+	n := &node{cfg: cfg, lock: lock}
+	if err := n.init(); err != nil {
+		lock.release()
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *node) init() error {
+	level, err := parseLevel(n.cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	logs := filepath.Join(n.cfg.DataDir, logDir)
+	if err := utils.CheckMkdir(logs); err != nil {
+		return err
+	}
+	logger.InitLogger(logger.Root(), level, filepath.Join(logs, nodeLogFile))
+	n.log = logger.New("module", "fxnode")
+	if err := p2p.SetLogOutput("stderr", filepath.Join(logs, p2pLogFile)); err != nil {
+		return err
+	}
+	if err := p2p.SetLogLevel(n.cfg.LogLevel); err != nil {
+		return err
+	}
+
+	if n.key, err = loadOrCreateKey(filepath.Join(n.cfg.DataDir, keyFile)); err != nil {
+		return err
+	}
+	n.handler = p2p.NewEventHandler(nil)
+	n.handler.RequireSigned(n.cfg.RequireSigned)
+	n.handler.RegisterEventHandler(p2p.NodeDiscoveryHandler, func(c *p2p.Context) {
+		n.log.Info("peer online", "ip", c.IP, "name", c.NodeName, "tag", c.Tag)
+	})
+	n.handler.RegisterEventHandler(p2p.NodeRemoveHandler, func(c *p2p.Context) {
+		n.log.Info("peer offline", "ip", c.IP)
+	})
+	return nil
+}
+
+// start the p2p servers on the configured port with the node key, the peer
+// store is kept in the data directory
+func (n *node) start() error {
+	p2p.SetRole(n.cfg.Role)
+	p2p.SetLocalNodeID(keyNodeID(n.key))
+	signer := p2p.NewKeySigner(n.key, nil)
+	p2p.SetSigner(signer)
+	p2p.SetDataDir(n.cfg.DataDir)
+
+	server, err := p2p.NewP2PServer(n.cfg.Port, n.handler)
+	if err != nil {
+		return err
+	}
+	n.server, n.tcp = server, server.TCP
+	n.tcp.SetPreferNearby(n.cfg.PreferNearby)
+	if n.cfg.Pex {
+		p2p.NewPeerExchange(n.tcp)
+	}
+	if n.cfg.Swim {
+		p2p.NewMembership(n.tcp)
+	}
+	if n.cfg.ClockWarn > 0 {
+		n.tcp.NetTime().SetWarning(time.Duration(n.cfg.ClockWarn) * time.Second)
+	}
+	if n.cfg.Name != "" {
+		p2p.SetClientName(n.cfg.Name)
+	}
+	if err := server.Listen(); err != nil {
+		return err
+	}
+	server.Start()
+	n.log.Info("fxnode started", "pid", os.Getpid(), "dataDir", n.cfg.DataDir, "port", n.cfg.Port,
+		"role", n.cfg.Role, "nodeId", p2p.LocalNodeID(), "address", p2p.KeyAddress(signer.PublicKey()))
+	return nil
+}
+
+// startWebSocket serve WebSocket peers when a port is configured
+func (n *node) startWebSocket() error {
+	if n.cfg.WebSocketPort == 0 {
+		return nil
+	}
+	listener, err := p2p.DefaultTransport.Listen(n.cfg.WebSocketPort)
+	if err != nil {
+		return fmt.Errorf("websocket listen %d err:%s", n.cfg.WebSocketPort, err.Error())
+	}
+	n.ws = p2p.NewWebSocketServer(n.tcp, n.cfg.WebSocketOrigins...)
+	go func() {
+		if err := n.ws.Serve(listener); err != nil {
+			n.log.Error("websocket server stopped", "err", err.Error())
+		}
+	}()
+	n.log.Info("websocket server started", "port", n.cfg.WebSocketPort, "path", p2p.WebSocketPath)
+	return nil
+}
+
+// startUnix serve local services when a socket is configured
+func (n *node) startUnix() error {
+	path := n.cfg.unixPath()
+	if path == "" {
+		return nil
+	}
+	listener, err := p2p.ListenUnix(path, unixMode)
+	if err != nil {
+		return fmt.Errorf("unix listen %s err:%s", path, err.Error())
+	}
+	n.unix = p2p.NewUnixServer(n.tcp)
+	go func() {
+		if err := n.unix.Serve(listener); err != nil {
+			n.log.Error("unix server stopped", "err", err.Error())
+		}
+	}()
+	n.log.Info("unix server started", "path", path)
+	return nil
+}
+
+// startAdmin serve the admin API, the token is kept in the data directory
+func (n *node) startAdmin() error {
+	endpoint := n.cfg.adminEndpoint()
+	if endpoint == "" {
+		return nil
+	}
+	token, err := p2p.LoadOrCreateAdminToken(filepath.Join(n.cfg.DataDir, adminToken))
+	if err != nil {
+		return fmt.Errorf("admin token err:%s", err.Error())
+	}
+	listener, err := p2p.ListenAdmin(endpoint)
+	if err != nil {
+		return fmt.Errorf("admin listen %s err:%s", endpoint, err.Error())
+	}
+	n.admin = p2p.NewAdminServer(n.tcp, token)
+	n.admin.Register("logLevel", n.logLevel)
+	go func() {
+		if err := n.admin.Serve(listener); err != nil {
+			n.log.Error("admin API stopped", "err", err.Error())
+		}
+	}()
+	n.log.Info("admin API started", "endpoint", endpoint)
+	return nil
+}
+
+// logLevel admin method, the node and p2p logs share the level
+func (n *node) logLevel(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Level string `json:"level"`
+	}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &p2p.AdminError{Code: p2p.AdminInvalidParams, Message: err.Error()}
+		}
+	}
+	if p.Level != "" {
+		level, err := parseLevel(p.Level)
+		if err != nil {
+			return nil, &p2p.AdminError{Code: p2p.AdminInvalidParams, Message: err.Error()}
+		}
+		if err := p2p.SetLogLevel(p.Level); err != nil {
+			return nil, err
+		}
+		logger.SetLevel(level)
+		n.log.Info("log level changed", "level", p.Level)
+	}
+	return p2p.LogLevel(), nil
+}
+
+// stop close the servers, save the peer store and release the pid file
+func (n *node) stop() error {
+	defer n.lock.release()
+	var errs []string
+	if n.admin != nil {
+		if err := n.admin.Close(); err != nil {
+			errs = append(errs, "admin: "+err.Error())
+		}
+	}
+	if n.ws != nil {
+		if err := n.ws.Close(); err != nil {
+			errs = append(errs, "websocket: "+err.Error())
+		}
+	}
+	if n.unix != nil {
+		if err := n.unix.Close(); err != nil {
+			errs = append(errs, "unix: "+err.Error())
+		}
+	}
+	if n.server != nil {
+		if err := n.server.Close(); err != nil {
+			errs = append(errs, "p2p: "+err.Error())
+		}
+		select {
+		case <-n.server.Done():
+		case <-time.After(shutdownTimeout):
+			errs = append(errs, "servers did not stop in time")
+		}
+	}
+	if len(errs) > 0 {
+		n.log.Error("fxnode stopped", "err", strings.Join(errs, "; "))
+		return errors.New(strings.Join(errs, "; "))
+	}
+	n.log.Info("fxnode stopped")
+	return nil
+}
+
+func parseLevel(level string) (logger.Lvl, error) {
+	switch level {
+	case "debug", "info", "warn", "error":
+		return logger.LvlFromString(level)
+	}
+	return logger.LvlInfo, fmt.Errorf("log level %q must be debug, info, warn or error", level)
+}
+
+// loadOrCreateKey read the PEM node key at path, a P256 key is generated
+// and saved when the file is missing
+func loadOrCreateKey(path string) (*ecdsa.PrivateKey, error) {
+	if utils.PathExists(path) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "EC PRIVATE KEY" {
+			return nil, fmt.Errorf("node key %s not a PEM EC private key", path)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse node key err:%s", err.Error())
+		}
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("node key must be P256")
+		}
+		return key, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := utils.WriteFileAtomic(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// keyNodeID node id derived from the key, stable across restarts
+func keyNodeID(key *ecdsa.PrivateKey) p2p.NodeID {
+	hash := sha256.Sum256(elliptic.Marshal(key.Curve, key.X, key.Y))
+	return p2p.BytesToNodeID(hash[:p2p.NodeIDLen])
+}
+
+// pidLock pid file created exclusively, one node per data directory
+type pidLock struct {
+	path string
+}
+
+// acquirePidLock create the pid file, a file left by a dead process is
+// replaced
+func acquirePidLock(path string) (*pidLock, error) {
+	for i := 0; i < 2; i++ {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(file, "%d\n", os.Getpid())
+			file.Close()
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return &pidLock{path: path}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		pid, alive := pidAlive(path)
+		if alive {
+			return nil, fmt.Errorf("data directory locked by running fxnode pid %d (%s)", pid, path)
+		}
+		os.Remove(path)
+	}
+	return nil, fmt.Errorf("pid file %s could not be created", path)
+}
+
+func (l *pidLock) release() {
+	os.Remove(l.path)
+}
+
+// pidAlive pid in the file and whether that process still runs
+func pidAlive(path string) (int, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return pid, false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return pid, err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,106 @@
+// xbcap replays XB capture files recorded with p2p.SetCapture
+//
+//	xbcap replay [-realtime] [-skew 30s] node.xbcap
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"fx/chain/p2p"
+)
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "replay" {
+		fmt.Fprintln(os.Stderr, "usage: xbcap replay [-realtime] [-skew 30s] capture-file")
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	realtime := flags.Bool("realtime", false, "keep the original spacing between frames")
+	skew := flags.Duration("skew", 0, "replay guard skew, raise it to accept old signed frames")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := replay(os.Stdout, os.Stderr, flags.Arg(0), *realtime, *skew); err != nil {
+		fmt.Fprintln(os.Stderr, "xbcap:", err)
+		os.Exit(1)
+	}
+}
+
+// replay print every event the capture dispatches to out, the summary and
+// skipped frames to log
+func replay(out, log io.Writer, path string, realtime bool, skew time.Duration) error {
+	commands, err := inboundCommands(log, path)
+	if err != nil {
+		return err
+	}
+	handler := p2p.NewEventHandler(nil)
+	if skew > 0 {
+		handler.Replay().SetSkew(skew)
+	}
+	events := 0
+	for command := range commands {
+		handler.RegisterEventHandler(command, func(c *p2p.Context) {
+			events++
+			fmt.Fprintf(out, "%s %s %-15s %-10s msgId=%d tag=%d %s\n", c.ReceivedAt.Format(time.RFC3339Nano), c.Transport,
+				c.IP, commandName(c.GetCommand()), c.MsgID, c.Tag, c.Body)
+		})
+	}
+	// handlers run before ReplayCapture returns
+	count, err := p2p.ReplayCapture(path, handler, realtime)
+	fmt.Fprintf(log, "%d frames replayed, %d events\n", count, events)
+	return err
+}
+
+// inboundCommands commands to register, heartbeats are dispatched as online
+// events, frames that do not parse are reported to log
+func inboundCommands(log io.Writer, path string) (map[p2p.Command]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := p2p.NewCaptureReader(file)
+	if err != nil {
+		return nil, err
+	}
+	handler := p2p.NewEventHandler(nil)
+	commands := map[p2p.Command]bool{p2p.NodeDiscoveryHandler: true}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return commands, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record.Direction != p2p.CaptureInbound {
+			continue
+		}
+		message, err := p2p.ParseFrame(handler, record.Frame)
+		if err != nil {
+			fmt.Fprintf(log, "skip frame from %s at %s: %s\n", record.IP, record.Time.Format(time.RFC3339Nano), err)
+			continue
+		}
+		commands[message.GetCommand()] = true
+		if body := message.GetBody(); message.GetCommand() == p2p.CommandSigned && len(body) >= 2 {
+			commands[p2p.Command(binary.BigEndian.Uint16(body))] = true
+		}
+	}
+}
+
+func commandName(command p2p.Command) string {
+	if name, ok := p2p.MsgInfoKV[command]; ok {
+		return name
+	}
+	if name, ok := p2p.EventInfoKV[command]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", command)
+}
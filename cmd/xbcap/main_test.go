@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fx/chain/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCapture(t *testing.T, path string, frames ...[]byte) {
+	capture, err := p2p.CreateCapture(path)
+	assert.NoError(t, err)
+	at := time.Unix(1600000000, 0)
+	for i, frame := range frames {
+		assert.NoError(t, capture.Record(p2p.CaptureRecord{Time: at.Add(time.Duration(i) * time.Second),
+			Direction: p2p.CaptureInbound, Transport: p2p.TransportTCP, IP: net.ParseIP("10.0.0.2"), Port: 10001, Frame: frame}))
+	}
+	assert.NoError(t, capture.Close())
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xbcap")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "node.xbcap")
+
+	app, _ := p2p.NewMsg(120, []byte("hello")).MarshalBinary()
+	heartbeat, _ := p2p.NewMsg(p2p.CommandHeartbeat, []byte(`{"nodeName":"a"}`)).MarshalBinary()
+	// unsigned garbage, rejected without dispatching anything
+	signed, _ := p2p.NewMsg(p2p.CommandSigned, []byte{0, 120, 1, 2, 3}).MarshalBinary()
+	writeCapture(t, path, app, heartbeat, signed, signed, signed, []byte("XB"))
+
+	var out, log bytes.Buffer
+	start := time.Now()
+	assert.NoError(t, replay(&out, &log, path, false, 0))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Contains(t, out.String(), "10.0.0.2")
+	assert.Contains(t, out.String(), "hello")
+	assert.Contains(t, out.String(), p2p.EventInfoKV[p2p.NodeDiscoveryHandler])
+	assert.Equal(t, 2, bytes.Count(out.Bytes(), []byte("\n")))
+	assert.Contains(t, log.String(), "skip frame from 10.0.0.2")
+	assert.Contains(t, log.String(), "5 frames replayed, 2 events")
+}
+
+func TestReplay_Truncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xbcap")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "node.xbcap")
+	app, _ := p2p.NewMsg(120, []byte("hello")).MarshalBinary()
+	writeCapture(t, path, app)
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, data[:len(data)-2], 0644))
+
+	var out, log bytes.Buffer
+	assert.Error(t, replay(&out, &log, path, false, 0))
+	assert.Empty(t, out.String())
+	assert.Error(t, replay(&out, &log, filepath.Join(dir, "missing.xbcap"), false, 0))
+}
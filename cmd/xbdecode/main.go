@@ -0,0 +1,195 @@
+// xbdecode decodes XB frames from hex or base64 dumps and capture files
+//
+//	xbdecode 5842000300020001000000027b7d
+//	echo WEIAAwACAAEAAAACe30= | xbdecode -format base64
+//	xbdecode -capture node.xbcap
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"fx/chain/p2p"
+)
+
+func main() {
+	format := flag.String("format", "hex", "input format of the dump, hex or base64")
+	capture := flag.String("capture", "", "decode every frame of a capture file")
+	flag.Parse()
+
+	var err error
+	if *capture != "" {
+		err = decodeCapture(os.Stdout, *capture)
+	} else {
+		var input string
+		if flag.NArg() > 0 {
+			input = strings.Join(flag.Args(), "")
+		} else {
+			bt, readErr := ioutil.ReadAll(os.Stdin)
+			if readErr != nil {
+				fmt.Fprintln(os.Stderr, "xbdecode:", readErr)
+				os.Exit(1)
+			}
+			input = string(bt)
+		}
+		var data []byte
+		if data, err = parseDump(input, *format); err == nil {
+			if !decodeFrames(os.Stdout, data) {
+				os.Exit(1)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "xbdecode:", err)
+		os.Exit(1)
+	}
+}
+
+// parseDump raw bytes of a hex or base64 dump, whitespace, colons and 0x
+// prefixes are ignored
+func parseDump(input string, format string) ([]byte, error) {
+	switch format {
+	case "hex":
+		input = strings.NewReplacer("0x", "", "0X", "", ":", "", " ", "", "\n", "", "\r", "", "\t", "").Replace(input)
+		return hex.DecodeString(input)
+	case "base64":
+		input = strings.Join(strings.Fields(input), "")
+		if data, err := base64.StdEncoding.DecodeString(input); err == nil {
+			return data, nil
+		}
+		return base64.RawStdEncoding.DecodeString(strings.TrimRight(input, "="))
+	default:
+		return nil, fmt.Errorf("format %s not exist", format)
+	}
+}
+
+// decodeFrames print every frame of data, false if any frame is malformed
+func decodeFrames(w io.Writer, data []byte) bool {
+	for index := 0; len(data) > 0; index++ {
+		fmt.Fprintf(w, "frame %d\n", index)
+		n, err := decodeFrame(w, data)
+		if err != nil {
+			fmt.Fprintf(w, "  MALFORMED: %s\n", err)
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
+
+// decodeFrame print the frame at the start of data, return its length
+func decodeFrame(w io.Writer, data []byte) (int, error) {
+	if len(data) < p2p.HeadLen {
+		return 0, fmt.Errorf("head truncated, %d of %d bytes: %x", len(data), p2p.HeadLen, data)
+	}
+	msg := &p2p.Msg{}
+	bodyLen, err := msg.UnmarshalBinary(data[:p2p.HeadLen])
+	if err != nil {
+		return 0, err
+	}
+	head := msg.Head
+	magic := string(head.Magic[:])
+	if head.Magic != p2p.MsgMagic {
+		magic += " (unknown magic)"
+	}
+	fmt.Fprintf(w, "  magic    %s\n", magic)
+	fmt.Fprintf(w, "  command  %d %s\n", head.Command, commandName(head.Command))
+	fmt.Fprintf(w, "  tag      %d %s\n", head.Tag, tagName(head.Tag))
+	fmt.Fprintf(w, "  msgId    %d\n", head.MsgId)
+	fmt.Fprintf(w, "  len      %d\n", bodyLen)
+	if head.Magic != p2p.MsgMagic {
+		return 0, fmt.Errorf("magic %q is not %q", head.Magic[:], p2p.MsgMagic[:])
+	}
+	end := uint64(p2p.HeadLen) + uint64(bodyLen)
+	if uint64(len(data)) < end {
+		printBody(w, head.Command, data[p2p.HeadLen:])
+		return 0, fmt.Errorf("body truncated, %d of %d bytes", len(data)-p2p.HeadLen, bodyLen)
+	}
+	printBody(w, head.Command, data[p2p.HeadLen:end])
+	return int(end), nil
+}
+
+func printBody(w io.Writer, command p2p.Command, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	if command == p2p.CommandSigned && len(body) >= 22 {
+		inner := p2p.Command(binary.BigEndian.Uint16(body))
+		ms := int64(binary.BigEndian.Uint64(body[6:]))
+		fmt.Fprintf(w, "  signed   command %d %s, msgId %d, time %s\n", inner, commandName(inner),
+			int16(binary.BigEndian.Uint16(body[4:])), time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano))
+	}
+	var pretty bytes.Buffer
+	if json.Valid(body) && json.Indent(&pretty, body, "           ", "  ") == nil {
+		fmt.Fprintf(w, "  body     %s\n", pretty.String())
+		return
+	}
+	fmt.Fprintf(w, "  body     %x\n", body)
+}
+
+// decodeCapture print every record of the capture at path, an error if any
+// frame is malformed
+func decodeCapture(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := p2p.NewCaptureReader(file)
+	if err != nil {
+		return err
+	}
+	malformed := 0
+	for index := 0; ; index++ {
+		record, err := reader.Next()
+		if err == io.EOF {
+			if malformed > 0 {
+				return fmt.Errorf("%d of %d frames malformed", malformed, index)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		direction := "<<<"
+		if record.Direction == p2p.CaptureOutbound {
+			direction = ">>>"
+		}
+		fmt.Fprintf(w, "record %d %s %s %s %s:%d\n", index, record.Time.UTC().Format(time.RFC3339Nano),
+			record.Transport, direction, record.IP, record.Port)
+		if _, err := decodeFrame(w, record.Frame); err != nil {
+			fmt.Fprintf(w, "  MALFORMED: %s\n", err)
+			malformed++
+		}
+	}
+}
+
+func commandName(command p2p.Command) string {
+	if name, ok := p2p.MsgInfoKV[command]; ok {
+		return name
+	}
+	if name, ok := p2p.EventInfoKV[command]; ok {
+		return name
+	}
+	if command >= 50 {
+		return "(application)"
+	}
+	return "(unknown)"
+}
+
+func tagName(tag int16) string {
+	if name, ok := p2p.NodeTagMap[tag]; ok {
+		return name
+	}
+	return "(unknown)"
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fx/chain/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDump(t *testing.T) {
+	data, err := parseDump("0x58 0x42\n00:03", "hex")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{'X', 'B', 0, 3}, data)
+	data, err = parseDump("WEIAAw==", "base64")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{'X', 'B', 0, 3}, data)
+	data, err = parseDump("WEIAAw", "base64")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{'X', 'B', 0, 3}, data)
+	_, err = parseDump("zz", "hex")
+	assert.Error(t, err)
+	_, err = parseDump("00", "octal")
+	assert.Error(t, err)
+}
+
+func TestDecodeFrames(t *testing.T) {
+	heartbeat, _ := p2p.NewMsg(p2p.CommandHeartbeat, []byte(`{"nodeName":"a"}`)).MarshalBinary()
+	app, _ := p2p.NewMsg(120, []byte{1, 2}).MarshalBinary()
+
+	var out bytes.Buffer
+	assert.True(t, decodeFrames(&out, append(append([]byte{}, heartbeat...), app...)))
+	assert.Contains(t, out.String(), "command  3 Heartbeat")
+	assert.Contains(t, out.String(), `"nodeName": "a"`)
+	assert.Contains(t, out.String(), "command  120 (application)")
+	assert.Contains(t, out.String(), "body     0102")
+
+	out.Reset()
+	assert.False(t, decodeFrames(&out, heartbeat[:len(heartbeat)-2]))
+	assert.Contains(t, out.String(), "MALFORMED: body truncated, 14 of 16 bytes")
+
+	out.Reset()
+	bad, _ := hex.DecodeString("5a5a00030002000100000000")
+	assert.False(t, decodeFrames(&out, bad))
+	assert.Contains(t, out.String(), "unknown magic")
+}
+
+func TestDecodeCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xbdecode")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "node.xbcap")
+	app, _ := p2p.NewMsg(120, []byte{1, 2}).MarshalBinary()
+	write := func(frames ...[]byte) {
+		capture, err := p2p.CreateCapture(path)
+		assert.NoError(t, err)
+		for _, frame := range frames {
+			assert.NoError(t, capture.Record(p2p.CaptureRecord{Time: time.Unix(1600000000, 0), Transport: p2p.TransportTCP,
+				IP: net.ParseIP("10.0.0.2"), Port: 10001, Frame: frame}))
+		}
+		assert.NoError(t, capture.Close())
+	}
+
+	var out bytes.Buffer
+	write(app, app)
+	assert.NoError(t, decodeCapture(&out, path))
+
+	// every record is printed, the malformed ones fail the command
+	out.Reset()
+	write(app[:5], app, []byte("XB"))
+	err = decodeCapture(&out, path)
+	assert.EqualError(t, err, "2 of 3 frames malformed")
+	assert.Contains(t, out.String(), "record 2")
+}
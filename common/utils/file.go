@@ -151,6 +151,46 @@ func SaveJSON(file string, val interface{}) error {
 	return ioutil.WriteFile(file, bytes, os.ModePerm)
 }
 
+// save json to a temp file then rename, readers never see a partial file
+func SaveJSONAtomic(file string, val interface{}) error {
+	bytes, err := json.MarshalIndent(val, "", "\t")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(file, bytes, 0644)
+}
+
+func WriteFileAtomic(file string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(file)
+	if err := CheckMkdir(dir); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
 func MakeReaderFromPath(path string, fieldName string, params map[string]string) (string, io.Reader, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -1,9 +1,9 @@
 package logger
 
 import (
-	"io/ioutil"
 	"os"
 	"path"
+	"sync/atomic"
 )
 
 var (
@@ -14,7 +14,6 @@ var (
 
 func init() {
 	root.SetHandler(DiscardHandler())
-	InitLogger(Root(), LvlTrace, nil)
 }
 
 // New returns a new logger with the given context.
@@ -77,5 +76,20 @@ func InitLogger(log Logger, logLevel Lvl, itf string) {
 	if err != nil {
 		panic(err.Error())
 	}
-	log.SetHandler(fileHandler)
+	SetLevel(logLevel)
+	log.SetHandler(FilterHandler(func(r *Record) bool {
+		return r.Lvl <= GetLevel()
+	}, fileHandler))
+}
+
+// level of the loggers set up by InitLogger
+var initLevel = int32(LvlInfo)
+
+// SetLevel change the level of the loggers set up by InitLogger
+func SetLevel(lvl Lvl) {
+	atomic.StoreInt32(&initLevel, int32(lvl))
+}
+
+func GetLevel() Lvl {
+	return Lvl(atomic.LoadInt32(&initLevel))
 }
@@ -0,0 +1,460 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fx/chain/common/utils"
+)
+
+// JSON-RPC 2.0 error codes used by the admin API
+const (
+	AdminParseError     = -32700
+	AdminInvalidRequest = -32600
+	AdminMethodNotFound = -32601
+	AdminInvalidParams  = -32602
+	AdminServerError    = -32000
+	AdminUnauthorized   = -32001
+)
+
+// AdminRequest JSON-RPC 2.0 request
+type AdminRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      interface{}     `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// AdminResponse JSON-RPC 2.0 response, Result is left raw for the client
+type AdminResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      interface{}     `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *AdminError     `json:"error,omitempty"`
+}
+
+type AdminError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *AdminError) Error() string {
+	return fmt.Sprintf("admin error %d: %s", e.Code, e.Message)
+}
+
+// AdminMethod handle the params of one call, an *AdminError keeps its code
+type AdminMethod func(params json.RawMessage) (interface{}, error)
+
+// AdminServer local JSON-RPC endpoint to query and control a running node,
+// every call carries the token as a bearer authorization
+type AdminServer struct {
+	tcp     *TcpServer
+	token   string
+	methods map[string]AdminMethod
+	server  *http.Server
+	sync.Mutex
+}
+
+// admin params, peer is an IP or a node id
+type adminPeerParams struct {
+	Peer string `json:"peer"`
+}
+
+type adminConnectParams struct {
+	IP     string `json:"ip"`
+	Static bool   `json:"static"`
+}
+
+type adminBanParams struct {
+	IP      string `json:"ip"`
+	Seconds int    `json:"seconds"`
+}
+
+type adminSendParams struct {
+	Peer    string  `json:"peer"`
+	Command Command `json:"command"`
+	Body    string  `json:"body"`
+}
+
+type adminLogLevelParams struct {
+	Level string `json:"level"`
+}
+
+// default ban time of the ban method
+const adminBanTime = time.Hour
+
+func NewAdminServer(tcp *TcpServer, token string) *AdminServer {
+	if tcp == nil {
+		panic("admin TCP server not empty")
+	}
+	if token == "" {
+		panic("admin token not empty")
+	}
+	a := &AdminServer{tcp: tcp, token: token, methods: map[string]AdminMethod{}}
+	a.Register("peers", a.peers)
+	a.Register("peer", a.peer)
+	a.Register("members", a.members)
+	a.Register("connect", a.connect)
+	a.Register("disconnect", a.disconnect)
+	a.Register("ban", a.ban)
+	a.Register("unban", a.unban)
+	a.Register("bans", a.bans)
+	a.Register("send", a.send)
+	a.Register("metrics", a.metrics)
+	a.Register("time", a.networkTime)
+	a.Register("logLevel", a.logLevel)
+	a.Register("methods", a.listMethods)
+	return a
+}
+
+// Register add or replace a method
+func (a *AdminServer) Register(name string, method AdminMethod) {
+	a.Lock()
+	a.methods[name] = method
+	a.Unlock()
+}
+
+// Serve answer calls on listener until Close
+func (a *AdminServer) Serve(listener net.Listener) error {
+	a.Lock()
+	a.server = &http.Server{Handler: a, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	server := a.server
+	a.Unlock()
+	logger.Info("Admin API listen", "addr", listener.Addr().String())
+	err := server.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (a *AdminServer) Close() error {
+	a.Lock()
+	server := a.server
+	a.Unlock()
+	if server == nil {
+		return nil
+	}
+	return server.Close()
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(AdminResponse{JSONRPC: "2.0", Error: &AdminError{AdminInvalidRequest, "POST only"}})
+		return
+	}
+	if !a.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(AdminResponse{JSONRPC: "2.0", Error: &AdminError{AdminUnauthorized, "token invalid"}})
+		return
+	}
+	var request AdminRequest
+	response := AdminResponse{JSONRPC: "2.0"}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		response.Error = &AdminError{AdminParseError, err.Error()}
+	} else {
+		response.ID = request.ID
+		response.Result, response.Error = a.call(request)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (a *AdminServer) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+func (a *AdminServer) call(request AdminRequest) (json.RawMessage, *AdminError) {
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		return nil, &AdminError{AdminInvalidRequest, "jsonrpc 2.0 request with a method expected"}
+	}
+	a.Lock()
+	method := a.methods[request.Method]
+	a.Unlock()
+	if method == nil {
+		return nil, &AdminError{AdminMethodNotFound, "method not exist: " + request.Method}
+	}
+	result, err := method(request.Params)
+	if err != nil {
+		if adminErr, ok := err.(*AdminError); ok {
+			return nil, adminErr
+		}
+		return nil, &AdminError{AdminServerError, err.Error()}
+	}
+	bt, err := json.Marshal(result)
+	if err != nil {
+		return nil, &AdminError{AdminServerError, err.Error()}
+	}
+	logger.Debug("Admin API call", "method", request.Method)
+	return bt, nil
+}
+
+// adminParams decode params into val, missing params leave it zero
+func adminParams(params json.RawMessage, val interface{}) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(params, val); err != nil {
+		return &AdminError{AdminInvalidParams, err.Error()}
+	}
+	return nil
+}
+
+func (a *AdminServer) peers(params json.RawMessage) (interface{}, error) {
+	peers := a.tcp.Peers()
+	if peers == nil {
+		peers = []PeerInfo{}
+	}
+	return peers, nil
+}
+
+func (a *AdminServer) members(params json.RawMessage) (interface{}, error) {
+	members := a.tcp.Members()
+	if members == nil {
+		return nil, errors.New("membership not enabled")
+	}
+	return members, nil
+}
+
+func (a *AdminServer) peer(params json.RawMessage) (interface{}, error) {
+	var p adminPeerParams
+	if err := adminParams(params, &p); err != nil {
+		return nil, err
+	}
+	peer, ok := a.tcp.Peer(p.Peer)
+	if !ok {
+		return nil, errors.New("peer not exist")
+	}
+	return peer, nil
+}
+
+func (a *AdminServer) connect(params json.RawMessage) (interface{}, error) {
+	var p adminConnectParams
+	if err := adminParams(params, &p); err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(p.IP)
+	if ip == nil {
+		return nil, &AdminError{AdminInvalidParams, "ip invalid"}
+	}
+	if a.tcp.isBanned(ip.String()) {
+		return nil, errors.New("peer banned")
+	}
+	if p.Static {
+		a.tcp.Dialer.AddStatic(ip.String())
+	} else {
+		go a.tcp.NewTCPConn(ip)
+	}
+	return true, nil
+}
+
+func (a *AdminServer) disconnect(params json.RawMessage) (interface{}, error) {
+	var p adminPeerParams
+	if err := adminParams(params, &p); err != nil {
+		return nil, err
+	}
+	peer, ok := a.tcp.Peer(p.Peer)
+	if !ok {
+		return nil, errors.New("peer not exist")
+	}
+	return true, a.tcp.Disconnect(peer.IP)
+}
+
+func (a *AdminServer) ban(params json.RawMessage) (interface{}, error) {
+	var p adminBanParams
+	if err := adminParams(params, &p); err != nil {
+		return nil, err
+	}
+	d := adminBanTime
+	if p.Seconds > 0 {
+		d = time.Duration(p.Seconds) * time.Second
+	}
+	if err := a.tcp.Ban(p.IP, d); err != nil {
+		return nil, &AdminError{AdminInvalidParams, err.Error()}
+	}
+	return true, nil
+}
+
+func (a *AdminServer) unban(params json.RawMessage) (interface{}, error) {
+	var p adminBanParams
+	if err := adminParams(params, &p); err != nil {
+		return nil, err
+	}
+	a.tcp.Unban(p.IP)
+	return true, nil
+}
+
+func (a *AdminServer) bans(params json.RawMessage) (interface{}, error) {
+	return a.tcp.Bans(), nil
+}
+
+func (a *AdminServer) send(params json.RawMessage) (interface{}, error) {
+	var p adminSendParams
+	if err := adminParams(params, &p); err != nil {
+		return nil, err
+	}
+	if !isAppCommand(p.Command) {
+		return nil, &AdminError{AdminInvalidParams, "command must be an application command"}
+	}
+	peer, ok := a.tcp.Peer(p.Peer)
+	if !ok || !peer.Online {
+		return nil, errors.New("peer not online")
+	}
+	msg, err := getSendMsg(p.Command, []byte(p.Body))
+	if err != nil {
+		return nil, err
+	}
+	return true, a.tcp.WriteToTCP(msg, peer.IP)
+}
+
+func (a *AdminServer) metrics(params json.RawMessage) (interface{}, error) {
+	return a.tcp.Metrics(), nil
+}
+
+func (a *AdminServer) networkTime(params json.RawMessage) (interface{}, error) {
+	return a.tcp.NetTime().Info(), nil
+}
+
+// logLevel set the p2p log level when a level is given, return the level
+func (a *AdminServer) logLevel(params json.RawMessage) (interface{}, error) {
+	var p adminLogLevelParams
+	if err := adminParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Level != "" {
+		if err := SetLogLevel(p.Level); err != nil {
+			return nil, &AdminError{AdminInvalidParams, err.Error()}
+		}
+	}
+	return LogLevel(), nil
+}
+
+func (a *AdminServer) listMethods(params json.RawMessage) (interface{}, error) {
+	a.Lock()
+	defer a.Unlock()
+	names := make([]string, 0, len(a.methods))
+	for name := range a.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ListenAdmin listen on "unix:/path/admin.sock" or a loopback host:port,
+// the socket file is only accessible by its owner
+func ListenAdmin(endpoint string) (net.Listener, error) {
+	if strings.HasPrefix(endpoint, "unix:") {
+		return ListenUnix(strings.TrimPrefix(endpoint, "unix:"), 0600)
+	}
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errors.New("admin endpoint must be a unix socket or a loopback address")
+	}
+	return net.Listen(tcp, endpoint)
+}
+
+// LoadOrCreateAdminToken read the token file at path, a random token is
+// written with owner-only permissions when it is missing
+func LoadOrCreateAdminToken(path string) (string, error) {
+	if utils.PathExists(path) {
+		bt, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		token := strings.TrimSpace(string(bt))
+		if token == "" {
+			return "", fmt.Errorf("admin token file %s empty", path)
+		}
+		return token, nil
+	}
+	bt := make([]byte, 32)
+	if _, err := rand.Read(bt); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(bt)
+	if err := utils.WriteFileAtomic(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// AdminClient call the admin API of a local node
+type AdminClient struct {
+	url    string
+	token  string
+	client *http.Client
+	id     int64
+}
+
+// NewAdminClient endpoint as given to ListenAdmin
+func NewAdminClient(endpoint, token string, timeout time.Duration) *AdminClient {
+	transport := &http.Transport{}
+	url := "http://" + endpoint + "/"
+	if strings.HasPrefix(endpoint, "unix:") {
+		path := strings.TrimPrefix(endpoint, "unix:")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		}
+		url = "http://admin/"
+	}
+	return &AdminClient{url: url, token: token, client: &http.Client{Transport: transport, Timeout: timeout}}
+}
+
+// Call method with params, the result is decoded into result unless it is
+// nil, errors returned by the node are *AdminError
+func (c *AdminClient) Call(method string, params interface{}, result interface{}) error {
+	request := AdminRequest{JSONRPC: "2.0", ID: atomic.AddInt64(&c.id, 1), Method: method}
+	if params != nil {
+		bt, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		request.Params = bt
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var response AdminResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("admin response %s err:%s", resp.Status, err.Error())
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
@@ -0,0 +1,172 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func adminCall(t *testing.T, url, token, method string, params interface{}) (*http.Response, AdminResponse) {
+	bt, _ := json.Marshal(params)
+	body, _ := json.Marshal(AdminRequest{JSONRPC: "2.0", ID: 1, Method: method, Params: bt})
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	var response AdminResponse
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	return resp, response
+}
+
+func TestAdminServer(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	s := NewTCPServer(8893, NewEventHandler(nil))
+	node, remote := newTestTcpNode(t, s, NodeID{7}, NodeClient)
+	node.name = "phone"
+	s.nodes[node.addr.IP.String()] = node
+	defer remote.Close()
+
+	admin := NewAdminServer(s, "secret")
+	listener, err := ListenAdmin("127.0.0.1:0")
+	assert.NoError(t, err)
+	go admin.Serve(listener)
+	defer admin.Close()
+	url := "http://" + listener.Addr().String()
+
+	resp, response := adminCall(t, url, "wrong", "peers", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, AdminUnauthorized, response.Error.Code)
+	_, response = adminCall(t, url, "secret", "reboot", nil)
+	assert.Equal(t, AdminMethodNotFound, response.Error.Code)
+
+	_, response = adminCall(t, url, "secret", "peers", nil)
+	var peers []PeerInfo
+	assert.NoError(t, json.Unmarshal(response.Result, &peers))
+	assert.Len(t, peers, 1)
+	assert.Equal(t, "phone", peers[0].Name)
+	assert.True(t, peers[0].Online)
+
+	_, response = adminCall(t, url, "secret", "peer", adminPeerParams{Peer: NodeID{7}.String()})
+	var peer PeerInfo
+	assert.NoError(t, json.Unmarshal(response.Result, &peer))
+	assert.Equal(t, "127.0.0.1", peer.IP)
+
+	_, response = adminCall(t, url, "secret", "send", adminSendParams{Peer: "127.0.0.1", Command: 60, Body: "hi"})
+	assert.Nil(t, response.Error)
+	msg := readTestMsg(t, remote)
+	assert.Equal(t, Command(60), msg.Head.Command)
+	assert.Equal(t, "hi", string(msg.Body))
+	_, response = adminCall(t, url, "secret", "send", adminSendParams{Peer: "127.0.0.1", Command: CommandHeartbeat})
+	assert.Equal(t, AdminInvalidParams, response.Error.Code)
+
+	_, response = adminCall(t, url, "secret", "metrics", nil)
+	var metrics Metrics
+	assert.NoError(t, json.Unmarshal(response.Result, &metrics))
+	assert.Equal(t, 1, metrics.OnlinePeers)
+	assert.True(t, metrics.TCP.FramesOut > 0)
+
+	_, response = adminCall(t, url, "secret", "logLevel", adminLogLevelParams{Level: "warn"})
+	assert.Equal(t, `"warn"`, string(response.Result))
+	_, response = adminCall(t, url, "secret", "logLevel", adminLogLevelParams{Level: "loud"})
+	assert.Equal(t, AdminInvalidParams, response.Error.Code)
+	SetLogLevel("debug")
+
+	_, response = adminCall(t, url, "secret", "ban", adminBanParams{IP: "127.0.0.1", Seconds: 60})
+	assert.Nil(t, response.Error)
+	assert.True(t, s.isBanned("127.0.0.1"))
+	assert.False(t, node.info().Online)
+	_, response = adminCall(t, url, "secret", "connect", adminConnectParams{IP: "127.0.0.1"})
+	assert.NotNil(t, response.Error)
+	_, response = adminCall(t, url, "secret", "unban", adminBanParams{IP: "127.0.0.1"})
+	assert.Nil(t, response.Error)
+	assert.Empty(t, s.Bans())
+}
+
+func TestTcpServer_Ban(t *testing.T) {
+	network := NewMemNetwork(1)
+	defer network.Close()
+	s := NewTCPServer(8894, NewEventHandler(nil))
+	s.Transport = network.Host(net.ParseIP("10.0.0.1"))
+	assert.Error(t, s.Ban("nobody", time.Minute))
+	assert.NoError(t, s.Ban("10.0.0.2", time.Minute))
+	assert.True(t, s.isBanned("10.0.0.2"))
+	network.Clock().Advance(time.Minute)
+	assert.False(t, s.isBanned("10.0.0.2"))
+	assert.Error(t, s.Disconnect("10.0.0.2"))
+}
+
+func TestListenAdmin(t *testing.T) {
+	_, err := ListenAdmin("0.0.0.0:0")
+	assert.Error(t, err)
+
+	dir, _ := ioutil.TempDir("", "admin")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "admin.sock")
+	listener, err := ListenAdmin("unix:" + path)
+	assert.NoError(t, err)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	_, err = ListenAdmin("unix:" + path)
+	assert.Error(t, err)
+	listener.Close()
+}
+
+func TestLoadOrCreateAdminToken(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "admin")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "admin.token")
+
+	token, err := LoadOrCreateAdminToken(path)
+	assert.NoError(t, err)
+	assert.Len(t, token, 64)
+	info, _ := os.Stat(path)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	again, err := LoadOrCreateAdminToken(path)
+	assert.NoError(t, err)
+	assert.Equal(t, token, again)
+
+	ioutil.WriteFile(path, []byte("\n"), 0600)
+	_, err = LoadOrCreateAdminToken(path)
+	assert.Error(t, err)
+}
+
+func TestAdminClient(t *testing.T) {
+	s := NewTCPServer(8895, NewEventHandler(nil))
+	dir, _ := ioutil.TempDir("", "admin")
+	defer os.RemoveAll(dir)
+	endpoint := "unix:" + filepath.Join(dir, "admin.sock")
+	listener, err := ListenAdmin(endpoint)
+	assert.NoError(t, err)
+	admin := NewAdminServer(s, "secret")
+	go admin.Serve(listener)
+	defer admin.Close()
+
+	client := NewAdminClient(endpoint, "secret", time.Second)
+	var peers []PeerInfo
+	assert.NoError(t, client.Call("peers", nil, &peers))
+	assert.Empty(t, peers)
+	var level string
+	assert.NoError(t, client.Call("logLevel", map[string]string{"level": "info"}, &level))
+	assert.Equal(t, "info", level)
+	SetLogLevel("debug")
+
+	err = client.Call("peer", map[string]string{"peer": "10.0.0.9"}, nil)
+	assert.Equal(t, AdminServerError, err.(*AdminError).Code)
+	err = NewAdminClient(endpoint, "wrong", time.Second).Call("peers", nil, nil)
+	assert.Equal(t, AdminUnauthorized, err.(*AdminError).Code)
+	err = NewAdminClient("unix:"+filepath.Join(dir, "none.sock"), "secret", time.Second).Call("peers", nil, nil)
+	assert.Error(t, err)
+	_, ok := err.(*AdminError)
+	assert.False(t, ok)
+}
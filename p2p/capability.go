@@ -0,0 +1,232 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Hello capabilities a node advertises when a connection starts
+type Hello struct {
+	Version   int            `json:"version"`
+	Role      string         `json:"role"`
+	NodeID    string         `json:"nodeId,omitempty"`
+	Protocols map[string]int `json:"protocols,omitempty"`
+	TCPPort   int            `json:"tcpPort"`
+	UDPPort   int            `json:"udpPort,omitempty"`
+}
+
+// Protocol version both sides support, the lower of the two versions
+func (h *Hello) Protocol(name string, local int) (version int, ok bool) {
+	if h == nil {
+		return 0, false
+	}
+	remote, ok := h.Protocols[name]
+	if !ok {
+		return 0, false
+	}
+	if remote < local {
+		return remote, true
+	}
+	return local, true
+}
+
+var localRole string
+var roleMu = sync.Mutex{}
+
+// SetRole local node role, Server or Client
+func SetRole(role string) {
+	if role != Server && role != Client {
+		panic("node role must be server or client")
+	}
+	roleMu.Lock()
+	localRole = role
+	roleMu.Unlock()
+}
+
+// LocalRole the role set by SetRole, the deprecated NodeType env var is
+// read when no role was set
+func LocalRole() string {
+	roleMu.Lock()
+	defer roleMu.Unlock()
+	if localRole != "" {
+		return localRole
+	}
+	return os.Getenv(NodeType)
+}
+
+func roleTag(role string) int16 {
+	if role == Client {
+		return NodeClient
+	}
+	return NodeServer
+}
+
+// RegisterProtocol sub-protocol made of commands, handlers of the commands are
+// only invoked for peers that advertised the protocol in their hello
+func (e *EventHandler) RegisterProtocol(name string, version int, commands ...Command) {
+	if name == "" || version <= 0 {
+		panic("protocol name and version not empty")
+	}
+	e.Lock()
+	defer e.Unlock()
+	for _, command := range commands {
+		if owner, ok := e.commandProtocol[command]; ok && owner != name {
+			panic(fmt.Sprintf("command %d registered by protocol %s", command, owner))
+		}
+		e.commandProtocol[command] = name
+	}
+	e.protocols[name] = version
+}
+
+// Protocols registered sub-protocols and their versions
+func (e *EventHandler) Protocols() map[string]int {
+	e.Lock()
+	defer e.Unlock()
+	protocols := make(map[string]int, len(e.protocols))
+	for name, version := range e.protocols {
+		protocols[name] = version
+	}
+	return protocols
+}
+
+func (e *EventHandler) protocolOf(command Command) (name string, version int, ok bool) {
+	e.Lock()
+	defer e.Unlock()
+	if name, ok = e.commandProtocol[command]; ok {
+		version = e.protocols[name]
+	}
+	return
+}
+
+func (s *TcpServer) helloMsg() []byte {
+	hello := Hello{
+		Version:   ProtocolVersion,
+		Role:      LocalRole(),
+		NodeID:    LocalNodeID().String(),
+		Protocols: s.handler.Protocols(),
+		TCPPort:   s.Port,
+		UDPPort:   s.udpPort,
+	}
+	if hello.Role == "" {
+		hello.Role = Server
+	}
+	if hello.UDPPort == 0 && udpServer != nil {
+		hello.UDPPort = udpServer.Port
+	}
+	bytes, err := json.Marshal(hello)
+	if err != nil {
+		logger.Error("marshal json err", "err", err.Error())
+		return nil
+	}
+	return bytes
+}
+
+// record the peer hello, false if the peer speaks an unsupported version
+func (node *TcpNode) setHello(message Message) bool {
+	hello := &Hello{}
+	if err := json.Unmarshal(message.GetBody(), hello); err != nil {
+		logger.Warn("TCP hello json unmarshal", "addr", node.addr.IP, "err", err.Error())
+		return false
+	}
+	if hello.Version < minProtocolVersion {
+		logger.Warn("TCP hello unsupported version", "addr", node.addr.IP, "version", hello.Version)
+		return false
+	}
+	node.Lock()
+	if node.transport == TransportWebSocket {
+		// browsers and mobile clients never serve other peers
+		hello.Role = Client
+	}
+	node.hello = hello
+	node.tag = roleTag(hello.Role)
+	if id, err := ParseNodeID(hello.NodeID); err == nil {
+		node.id = id
+	}
+	node.Unlock()
+	logger.Info("TCP hello", "addr", node.addr.IP, "version", hello.Version, "role", hello.Role, "protocols", hello.Protocols)
+	return true
+}
+
+// supports false if command belongs to a protocol the peer did not advertise
+func (node *TcpNode) supports(command Command) bool {
+	name, version, ok := node.server.handler.protocolOf(command)
+	if !ok {
+		return true
+	}
+	node.Lock()
+	hello := node.hello
+	node.Unlock()
+	_, ok = hello.Protocol(name, version)
+	return ok
+}
+
+// peerSupports supports of the connected node with id, or with ip when id
+// is empty, for frames that arrive over relays or UDP, commands of a
+// protocol are dropped from peers without a TCP hello
+func (s *TcpServer) peerSupports(ip net.IP, id NodeID, command Command) bool {
+	if _, _, ok := s.handler.protocolOf(command); !ok {
+		return true
+	}
+	var node *TcpNode
+	if !id.IsEmpty() {
+		node = s.NodeByID(id)
+	} else if ip != nil {
+		s.Lock()
+		node = s.nodes[ip.String()]
+		s.Unlock()
+	}
+	return node != nil && node.supports(command)
+}
+
+// PeerHello capabilities of a connected peer, nil if it sent no hello
+func (s *TcpServer) PeerHello(ip string) *Hello {
+	s.Lock()
+	node := s.nodes[ip]
+	s.Unlock()
+	if node == nil {
+		return nil
+	}
+	node.Lock()
+	defer node.Unlock()
+	if !node.isOnline || !node.isStart {
+		return nil
+	}
+	return node.hello
+}
+
+// PeerProtocol negotiated version of protocol name with a connected peer
+func (s *TcpServer) PeerProtocol(ip string, name string) (version int, ok bool) {
+	local, ok := s.handler.Protocols()[name]
+	if !ok {
+		return 0, false
+	}
+	return s.PeerHello(ip).Protocol(name, local)
+}
+
+// PeersSupporting connected peers that advertised protocol name
+func (s *TcpServer) PeersSupporting(name string) (ips []string) {
+	s.Lock()
+	nodes := make([]*TcpNode, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	s.Unlock()
+	local, ok := s.handler.Protocols()[name]
+	if !ok {
+		return nil
+	}
+	for _, node := range nodes {
+		node.Lock()
+		hello, online := node.hello, node.isOnline && node.isStart
+		node.Unlock()
+		if _, ok := hello.Protocol(name, local); ok && online {
+			ips = append(ips, node.addr.IP.String())
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
@@ -0,0 +1,118 @@
+package p2p
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalRole(t *testing.T) {
+	defer func() { localRole = "" }()
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Client)
+	assert.Equal(t, Client, LocalRole())
+	SetRole(Server)
+	assert.Equal(t, Server, LocalRole())
+	assert.Equal(t, int16(NodeServer), NewMsg(CommandLongitude, nil).Head.Tag)
+	assert.Panics(t, func() { SetRole("relay") })
+}
+
+func TestHello_Protocol(t *testing.T) {
+	hello := &Hello{Protocols: map[string]int{"chat": 2, "files": 1}}
+	version, ok := hello.Protocol("chat", 3)
+	assert.True(t, ok)
+	assert.Equal(t, 2, version)
+	version, _ = hello.Protocol("files", 1)
+	assert.Equal(t, 1, version)
+	_, ok = hello.Protocol("sync", 1)
+	assert.False(t, ok)
+	_, ok = (*Hello)(nil).Protocol("chat", 1)
+	assert.False(t, ok)
+
+	handler := NewEventHandler(nil)
+	handler.RegisterProtocol("chat", 2, 100, 101)
+	assert.Panics(t, func() { handler.RegisterProtocol("files", 1, 101) })
+	assert.Panics(t, func() { handler.RegisterProtocol("files", 0) })
+	assert.Equal(t, map[string]int{"chat": 2}, handler.Protocols())
+}
+
+func TestTcpServer_Hello(t *testing.T) {
+	network := NewMemNetwork(1)
+	defer network.Close()
+	clock := network.Clock()
+	received := make(chan Command, 4)
+	record := func(c *Context) { received <- c.command }
+
+	handlerA := NewEventHandler(nil)
+	handlerA.RegisterProtocol("chat", 2, 100)
+	handlerA.RegisterProtocol("files", 1, 101)
+	handlerA.RegisterEventHandler(100, record)
+	handlerA.RegisterEventHandler(101, record)
+	handlerA.RegisterEventHandler(102, record)
+	a := NewTCPServer(10001, handlerA)
+	a.Transport = network.Host(net.ParseIP("10.0.0.1"))
+	go a.Start()
+
+	handlerB := NewEventHandler(nil)
+	handlerB.RegisterProtocol("chat", 1, 100)
+	b := NewTCPServer(10001, handlerB)
+	b.Transport = network.Host(net.ParseIP("10.0.0.2"))
+	go b.Start()
+	b.Dialer.AddStatic("10.0.0.1")
+
+	assert.True(t, advanceUntil(clock, time.Second, 5, func() bool {
+		return a.PeerHello("10.0.0.2") != nil && b.PeerHello("10.0.0.1") != nil
+	}))
+	hello := a.PeerHello("10.0.0.2")
+	assert.Equal(t, ProtocolVersion, hello.Version)
+	assert.Equal(t, 10001, hello.TCPPort)
+	assert.Equal(t, map[string]int{"chat": 1}, hello.Protocols)
+	version, ok := a.PeerProtocol("10.0.0.2", "chat")
+	assert.True(t, ok)
+	assert.Equal(t, 1, version)
+	_, ok = a.PeerProtocol("10.0.0.2", "files")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"10.0.0.1"}, b.PeersSupporting("chat"))
+	assert.Empty(t, a.PeersSupporting("files"))
+
+	// files is not supported by b, the command without protocol always passes
+	for _, command := range []Command{101, 100, 102} {
+		assert.NoError(t, b.WriteToTCP(NewMsg(command, []byte("hi")), "10.0.0.1"))
+	}
+	clock.Advance(time.Millisecond)
+	assert.ElementsMatch(t, []Command{100, 102}, []Command{<-received, <-received})
+	select {
+	case command := <-received:
+		t.Fatalf("unexpected command %d", command)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTcpServer_PeerSupports(t *testing.T) {
+	handler := NewEventHandler(nil)
+	handler.RegisterProtocol("chat", 1, 100)
+	s := NewTCPServer(10001, handler)
+	node, remote := newTestTcpNode(t, s, NodeID{1}, NodeServer)
+	defer remote.Close()
+	node.hello = &Hello{Version: ProtocolVersion, Protocols: map[string]int{"chat": 1}}
+	s.nodes[node.addr.IP.String()] = node
+	bare, remote2 := newTestTcpNode(t, s, NodeID{2}, NodeServer)
+	defer remote2.Close()
+	bare.addr.IP = net.IPv4(10, 0, 0, 2)
+	s.nodes[bare.addr.IP.String()] = bare
+
+	assert.True(t, s.peerSupports(nil, NodeID{1}, 100))
+	assert.True(t, s.peerSupports(node.addr.IP, NodeID{}, 100))
+	// no hello, unknown peer
+	assert.False(t, s.peerSupports(nil, NodeID{2}, 100))
+	assert.False(t, s.peerSupports(nil, NodeID{3}, 100))
+	assert.False(t, s.peerSupports(net.IPv4(10, 0, 0, 9), NodeID{}, 100))
+	// commands of no protocol always pass
+	assert.True(t, s.peerSupports(nil, NodeID{3}, 102))
+
+	signed := newRawMsg(CommandSigned, []byte{0, 100})
+	assert.False(t, s.peerSupports(nil, NodeID{3}, innerCommand(signed)))
+}
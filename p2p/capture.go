@@ -0,0 +1,265 @@
+package p2p
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// capture file: magic "XBCAP1" then records, big endian:
+//   time(8) direction(1) transport(1) ipLen(1) ip port(2) len(4) frame
+// time is unix nanoseconds, transport 0 tcp, 1 udp, 2 websocket, 3 unix,
+// the frame is the raw wire bytes of one message
+
+var captureMagic = []byte("XBCAP1")
+
+const (
+	CaptureInbound  byte = 0
+	CaptureOutbound byte = 1
+
+	captureTCP       byte = 0
+	captureUDP       byte = 1
+	captureWebSocket byte = 2
+	captureUnix      byte = 3
+)
+
+var captureTransports = map[string]byte{
+	TransportTCP:       captureTCP,
+	TransportUDP:       captureUDP,
+	TransportWebSocket: captureWebSocket,
+	TransportUnix:      captureUnix,
+}
+
+// CaptureRecord one captured frame
+type CaptureRecord struct {
+	Time      time.Time
+	Direction byte
+	Transport string
+	IP        net.IP
+	Port      int
+	Frame     []byte
+}
+
+// Capture records inbound and outbound frames to a file, records are
+// buffered and flushed every captureFlushTime seconds and on Close
+type Capture struct {
+	file   *os.File
+	writer *bufio.Writer
+	done   chan struct{}
+	sync.Mutex
+}
+
+var activeCapture *Capture
+var captureMu = sync.Mutex{}
+
+// CreateCapture create or truncate the capture file at path
+func CreateCapture(path string) (*Capture, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	capture := &Capture{file: file, writer: bufio.NewWriter(file), done: make(chan struct{})}
+	if _, err := capture.writer.Write(captureMagic); err != nil {
+		file.Close()
+		return nil, err
+	}
+	go capture.flushLoop()
+	return capture, nil
+}
+
+func (c *Capture) flushLoop() {
+	ticker := time.NewTicker(captureFlushTime * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+		c.Lock()
+		if c.writer != nil {
+			if err := c.writer.Flush(); err != nil {
+				logger.Error("Capture flush", "err", err.Error())
+			}
+		}
+		c.Unlock()
+	}
+}
+
+// SetCapture record every frame sent or received to c, nil stops capturing
+func SetCapture(c *Capture) {
+	captureMu.Lock()
+	activeCapture = c
+	captureMu.Unlock()
+}
+
+// captureFrame record a frame if capturing is on
+func captureFrame(direction byte, transport string, ip net.IP, port int, frame []byte, at time.Time) {
+	captureMu.Lock()
+	c := activeCapture
+	captureMu.Unlock()
+	if c == nil {
+		return
+	}
+	if err := c.Record(CaptureRecord{Time: at, Direction: direction, Transport: transport, IP: ip, Port: port, Frame: frame}); err != nil {
+		logger.Error("Capture record", "err", err.Error())
+	}
+}
+
+func (c *Capture) Record(record CaptureRecord) error {
+	ip := record.IP.To4()
+	if ip == nil {
+		ip = record.IP.To16()
+	}
+	head := make([]byte, 11, 11+len(ip)+6)
+	binary.BigEndian.PutUint64(head, uint64(record.Time.UnixNano()))
+	head[8] = record.Direction
+	head[9] = captureTransports[record.Transport]
+	head[10] = byte(len(ip))
+	head = append(head, ip...)
+	head = append(head, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(head[len(head)-6:], uint16(record.Port))
+	binary.BigEndian.PutUint32(head[len(head)-4:], uint32(len(record.Frame)))
+
+	c.Lock()
+	defer c.Unlock()
+	if c.writer == nil {
+		return errors.New("capture closed")
+	}
+	if _, err := c.writer.Write(head); err != nil {
+		return err
+	}
+	_, err := c.writer.Write(record.Frame)
+	return err
+}
+
+func (c *Capture) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.writer == nil {
+		return nil
+	}
+	err := c.writer.Flush()
+	c.writer = nil
+	close(c.done)
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// CaptureReader read records of a capture file
+type CaptureReader struct {
+	reader *bufio.Reader
+}
+
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	reader := bufio.NewReader(r)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != string(captureMagic) {
+		return nil, errors.New("capture magic not exist")
+	}
+	return &CaptureReader{reader: reader}, nil
+}
+
+// Next record, io.EOF at the end of the capture
+func (r *CaptureReader) Next() (record CaptureRecord, err error) {
+	head := make([]byte, 11)
+	if _, err = io.ReadFull(r.reader, head); err != nil {
+		return record, err
+	}
+	record.Time = time.Unix(0, int64(binary.BigEndian.Uint64(head)))
+	record.Direction = head[8]
+	record.Transport = TransportTCP
+	for transport, code := range captureTransports {
+		if head[9] == code {
+			record.Transport = transport
+		}
+	}
+	rest := make([]byte, int(head[10])+6)
+	if _, err = io.ReadFull(r.reader, rest); err != nil {
+		return record, fmt.Errorf("capture record truncated err:%s", err.Error())
+	}
+	record.IP = net.IP(rest[:head[10]])
+	record.Port = int(binary.BigEndian.Uint16(rest[head[10]:]))
+	record.Frame = make([]byte, binary.BigEndian.Uint32(rest[head[10]+2:]))
+	if _, err = io.ReadFull(r.reader, record.Frame); err != nil {
+		return record, fmt.Errorf("capture record truncated err:%s", err.Error())
+	}
+	return record, nil
+}
+
+// ReplayCapture feed the inbound frames of the capture at path into handler,
+// realtime keeps the original spacing between frames, returns the number of
+// frames dispatched, handlers run in the calling goroutine and are done when
+// it returns
+func ReplayCapture(path string, handler *EventHandler, realtime bool) (int, error) {
+	handler.setInline(true)
+	defer handler.setInline(false)
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader, err := NewCaptureReader(file)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	var last time.Time
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if record.Direction != CaptureInbound {
+			continue
+		}
+		if realtime && !last.IsZero() && record.Time.After(last) {
+			time.Sleep(record.Time.Sub(last))
+		}
+		last = record.Time
+		message, err := ParseFrame(handler, record.Frame)
+		if err != nil {
+			logger.Warn("Capture replay frame", "addr", record.IP, "err", err.Error())
+			continue
+		}
+		message.Handler(handler, &Context{IP: record.IP, ReceivedAt: record.Time, Transport: record.Transport})
+		count++
+	}
+}
+
+// ParseFrame parse one complete frame with the messages known to handler
+func ParseFrame(handler *EventHandler, frame []byte) (Message, error) {
+	if len(frame) < 2 {
+		return nil, errors.New("frame too short")
+	}
+	message := handler.GetMessage(frame[:2])
+	if message == nil {
+		return nil, fmt.Errorf("frame magic not exist magic:%x", frame[:2])
+	}
+	if len(frame) < message.GetHeadLen() {
+		return nil, fmt.Errorf("frame head truncated len:%d", len(frame))
+	}
+	bodyLen, err := message.UnmarshalBinary(frame[:message.GetHeadLen()])
+	if err != nil {
+		return nil, err
+	}
+	end := uint64(message.GetHeadLen()) + uint64(bodyLen)
+	if uint64(len(frame)) < end {
+		return nil, fmt.Errorf("frame body truncated len:%d want:%d", len(frame), end)
+	}
+	if bodyLen > 0 {
+		message.SetBody(frame[message.GetHeadLen():end])
+	}
+	return message, nil
+}
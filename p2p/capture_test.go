@@ -0,0 +1,122 @@
+package p2p
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapture_WriteRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "node.xbcap")
+
+	capture, err := CreateCapture(path)
+	assert.NoError(t, err)
+	SetCapture(capture)
+	in, _ := NewMsg(100, []byte(`{"a":1}`)).MarshalBinary()
+	out, _ := NewMsg(101, []byte("pong")).MarshalBinary()
+	at := time.Unix(1600000000, 5)
+	captureFrame(CaptureInbound, TransportTCP, net.ParseIP("10.0.0.2"), 10001, in, at)
+	captureFrame(CaptureOutbound, TransportUDP, net.ParseIP("fe80::1"), 10000, out, at.Add(time.Second))
+	SetCapture(nil)
+	captureFrame(CaptureInbound, TransportTCP, net.ParseIP("10.0.0.2"), 10001, in, at)
+	assert.NoError(t, capture.Close())
+	assert.Error(t, capture.Record(CaptureRecord{}))
+
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	reader, err := NewCaptureReader(file)
+	assert.NoError(t, err)
+	record, err := reader.Next()
+	assert.NoError(t, err)
+	assert.True(t, at.Equal(record.Time))
+	assert.Equal(t, CaptureInbound, record.Direction)
+	assert.Equal(t, TransportTCP, record.Transport)
+	assert.Equal(t, "10.0.0.2", record.IP.String())
+	assert.Equal(t, 10001, record.Port)
+	assert.Equal(t, in, record.Frame)
+	record, err = reader.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, TransportUDP, record.Transport)
+	assert.Equal(t, "fe80::1", record.IP.String())
+	assert.Equal(t, out, record.Frame)
+	_, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+
+	handler := NewEventHandler(nil)
+	received := make(chan *Context, 2)
+	handler.RegisterEventHandler(100, func(c *Context) { received <- c })
+	handler.RegisterEventHandler(101, func(c *Context) { received <- c })
+	count, err := ReplayCapture(path, handler, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	c := <-received
+	assert.Equal(t, Command(100), c.GetCommand())
+	assert.Equal(t, `{"a":1}`, string(c.Body))
+	assert.True(t, at.Equal(c.ReceivedAt))
+
+	// a capture cut while writing reports the truncated record
+	data, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, data[:len(data)-3], 0644)
+	count, err = ReplayCapture(path, handler, false)
+	assert.Equal(t, 1, count)
+	assert.Error(t, err)
+	ioutil.WriteFile(path, []byte("nope"), 0644)
+	_, err = ReplayCapture(path, handler, false)
+	assert.Error(t, err)
+}
+
+func TestCapture_Transports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "node.xbcap")
+
+	capture, err := CreateCapture(path)
+	assert.NoError(t, err)
+	transports := []string{TransportWebSocket, TransportUnix, TransportUDP, TransportTCP}
+	for _, transport := range transports {
+		assert.NoError(t, capture.Record(CaptureRecord{Transport: transport, IP: net.ParseIP("10.0.0.2"), Frame: []byte("XB")}))
+	}
+	// records stay buffered until the flush timer or Close
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	assert.NoError(t, capture.Close())
+
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	reader, err := NewCaptureReader(file)
+	assert.NoError(t, err)
+	for _, transport := range transports {
+		record, err := reader.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, transport, record.Transport)
+	}
+}
+
+func TestParseFrame(t *testing.T) {
+	handler := NewEventHandler(nil)
+	frame, _ := NewMsg(CommandHeartbeat, []byte(`{"nodeName":"a"}`)).MarshalBinary()
+	message, err := ParseFrame(handler, frame)
+	assert.NoError(t, err)
+	assert.Equal(t, CommandHeartbeat, message.GetCommand())
+	assert.Equal(t, `{"nodeName":"a"}`, string(message.GetBody()))
+
+	_, err = ParseFrame(handler, frame[:HeadLen+3])
+	assert.Error(t, err)
+	_, err = ParseFrame(handler, frame[:5])
+	assert.Error(t, err)
+	_, err = ParseFrame(handler, []byte("ZZ0000000000"))
+	assert.Error(t, err)
+}
@@ -15,6 +15,47 @@ const (
 	CommandHeartbeat Command = 3
 	CommandHeartbeatResponse Command = 4
 	CommandLongitude Command = 15
+	CommandTopicInterest Command = 20
+	CommandTopicPublish Command = 21
+
+	// UDP rendezvous
+	CommandRendezvousRegister Command = 22
+	CommandRendezvousObserved Command = 23
+	CommandPunchRequest Command = 24
+	CommandPunchNotify Command = 25
+	CommandPunchProbe Command = 26
+	CommandPunchAck Command = 27
+	CommandPeerData Command = 28
+	CommandRelayUDP Command = 29
+
+	// TCP relay
+	CommandRelay Command = 30
+	CommandRelayDeliver Command = 31
+	CommandRelayRefused Command = 32
+	CommandHello Command = 33
+
+	// reliable UDP
+	CommandReliableData Command = 34
+	CommandReliableAck Command = 35
+
+	// signed envelope
+	CommandSigned Command = 36
+
+	// stream multiplexing
+	CommandStreamOpen Command = 37
+	CommandStreamData Command = 38
+	CommandStreamWindow Command = 39
+	CommandStreamClose Command = 40
+	CommandStreamReset Command = 41
+
+	// peer exchange
+	CommandPexRequest Command = 42
+	CommandPexPeers Command = 43
+
+	// membership
+	CommandSwimPing Command = 44
+	CommandSwimAck Command = 45
+	CommandSwimPingReq Command = 46
 	//CommandNodeType Command = 17
 	//CommandNodeTypeResp Command = 18
 
@@ -29,6 +70,33 @@ var MsgInfoKV = map[Command]string{
 	CommandHeartbeatResponse: "HeartbeatResponse",
 	CommandLongitude:         "Longitude",
 	CommandServer:            "Server",
+	CommandTopicInterest:     "TopicInterest",
+	CommandTopicPublish:      "TopicPublish",
+	CommandRendezvousRegister: "RendezvousRegister",
+	CommandRendezvousObserved: "RendezvousObserved",
+	CommandPunchRequest:       "PunchRequest",
+	CommandPunchNotify:        "PunchNotify",
+	CommandPunchProbe:         "PunchProbe",
+	CommandPunchAck:           "PunchAck",
+	CommandPeerData:           "PeerData",
+	CommandRelayUDP:           "RelayUDP",
+	CommandRelay:              "Relay",
+	CommandRelayDeliver:       "RelayDeliver",
+	CommandRelayRefused:       "RelayRefused",
+	CommandHello:              "Hello",
+	CommandReliableData:       "ReliableData",
+	CommandReliableAck:        "ReliableAck",
+	CommandSigned:             "Signed",
+	CommandStreamOpen:         "StreamOpen",
+	CommandStreamData:         "StreamData",
+	CommandStreamWindow:       "StreamWindow",
+	CommandStreamClose:        "StreamClose",
+	CommandStreamReset:        "StreamReset",
+	CommandPexRequest:         "PexRequest",
+	CommandPexPeers:           "PexPeers",
+	CommandSwimPing:           "SwimPing",
+	CommandSwimAck:            "SwimAck",
+	CommandSwimPingReq:        "SwimPingReq",
 }
 
 var EventInfoKV = map[Command]string{
@@ -45,7 +113,72 @@ const (
 	tcpTimer          = 2
 	udpTimer          = 2
 	reconnectWaitTime = 5
-	udpReceiveLen     = 64
+	udpReceiveLen     = 64 * 1024
+	topicMaxHops      = 8
+	topicSeenTime     = 60
+	punchTimeout      = 6
+	rendezvousExpireTime = 30
+	peerMaxScore      = 100
+	peerFailureScore  = 10
+	peerMaxFailures   = 5
+	peerExpireTime    = 7 * 24
+	peerStoreSaveTime = 30
+	peerSeedCount     = 16
+	peerStoreName     = "peers.json"
+	captureFlushTime  = 1
+	peerMaxLearned    = 256
+	peerLearnedExpire = 1
+	dialCheckTime     = 1
+	dialBackoffBase   = 1
+	dialBackoffMax    = 60
+	dialMaxAttempts   = 10
+	dialMaxPeers      = 256
+	earthRadius       = 6371.0
+	ProtocolVersion   = 1
+	minProtocolVersion = 1
+	reliableFragmentSize = 1200
+	reliableMaxFragments = 1024
+	reliableMaxInbound   = 16
+	reliableRetryTime    = 300
+	reliableMaxRetries   = 5
+	reliableTickTime     = 100
+	reliableSeenTime     = 60
+	replaySkew           = 30
+	replayMaxNonces      = 4096
+	tcpWriteQueueLen     = 1024
+	tcpWriteBatchBytes   = 64 * 1024
+	tcpWriteTimeout      = 3
+	priorityWeightHigh   = 4
+	priorityWeightNormal = 2
+	priorityWeightBulk   = 1
+	priorityBulkMaxFrame = 32 * 1024
+	streamWindow         = 256 * 1024
+	streamFrameSize      = 16 * 1024
+	streamMaxPerConn     = 256
+	wsMaxFrameLen        = 16 * 1024 * 1024
+	pexInterval          = 30
+	pexFanout            = 2
+	pexSampleSize        = 16
+	pexMinInterval       = 10
+	pexRequestTimeout    = 10
+	pexMaxAge            = 6
+	pexMinScore          = 1
+	pexTargetPeers       = 8
+	pexMaxDials          = 4
+	swimPeriodTime       = 1000
+	swimProbeTimeout     = 400
+	swimIndirectProbes   = 3
+	swimSuspectPeriods   = 5
+	swimDeadTime         = 60
+	swimRetransmit       = 3
+	swimMaxPiggyback     = 8
+	swimMaxMembers       = 1024
+	netTimeSamples       = 8
+	netTimeMaxPending    = 4
+	netTimeMaxRTT        = 2000
+	netTimeMaxAge        = 120
+	netTimeMinPeers      = 3
+	netTimeWarnOffset    = 10
 	NodeClient        = 1
 	NodeServer        = 2
 
@@ -1,24 +1,109 @@
 package p2p
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"time"
+)
+
+const (
+	TransportTCP       = "tcp"
+	TransportUDP       = "udp"
+	TransportWebSocket = "websocket"
+	TransportUnix      = "unix"
 )
 
 type Context struct {
-	NodeName string
-	IP       net.IP
-	Tag      int16
-	Body     []byte
-	command  Command
+	NodeName   string
+	IP         net.IP
+	Tag        int16
+	Body       []byte
+	command    Command
+	Origin     NodeID    // originator of a relayed message as claimed by the relay, unauthenticated unless Address is set
+	Relay      net.IP    // server node that relayed the message, nil if direct
+	PeerID     NodeID    // directly connected peer, empty if unknown
+	MsgID      int16     // message id, replies carry the same id
+	ReceivedAt time.Time // receive time on the server clock
+	Transport  string    // TransportTCP, TransportUDP, TransportWebSocket or TransportUnix, empty for local events
+	Address    string    // signer address of a signed message, empty if unsigned
+	envelope   []byte
+	ctx        context.Context
+	reply      func(message Message) error
+}
+
+// ErrorReply body sent by ReplyError
+type ErrorReply struct {
+	Error string `json:"error"`
 }
 
 func NewContext() *Context {
 	return &Context{}
 }
 
+func (c *Context) GetCommand() Command {
+	return c.command
+}
+
+// Context done when the connection the message came from is closed
+func (c *Context) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// Reply send to the peer over the connection the message came from, the
+// reply carries the message id
+func (c *Context) Reply(command Command, msgInfo interface{}) (err error) {
+	msg, err := newSendMsg(command, msgInfo)
+	if err != nil {
+		return err
+	}
+	return c.sendReply(msg)
+}
+
+// ReplyError reply an ErrorReply body
+func (c *Context) ReplyError(command Command, replyErr error) (err error) {
+	if command < 50 {
+		return errors.New("command must be above 50")
+	}
+	bt, err := json.Marshal(ErrorReply{Error: replyErr.Error()})
+	if err != nil {
+		return fmt.Errorf("msg marshal err:%s", err.Error())
+	}
+	return c.sendReply(newRawMsg(command, bt))
+}
+
+func (c *Context) sendReply(msg *Msg) error {
+	if c.reply == nil {
+		return errors.New("reply route not exist")
+	}
+	msg.Head.MsgId = c.MsgID
+	msg, err := sealMsg(msg)
+	if err != nil {
+		return err
+	}
+	return c.reply(msg)
+}
+
+// Forward send the received message unchanged to ip over TCP, signed
+// messages keep their envelope
+func (c *Context) Forward(ip string) error {
+	if !isAppCommand(c.command) {
+		return errors.New("command must be above 50")
+	}
+	if tcpServer == nil {
+		return errors.New("TCP server not start")
+	}
+	if c.envelope != nil {
+		return tcpServer.WriteToTCP(newRawMsg(CommandSigned, c.envelope), ip)
+	}
+	return tcpServer.WriteToTCP(newRawMsg(c.command, c.Body), ip)
+}
+
 func (c *Context) SendMsgTCP(command Command, ip *string, msgInfo interface{}) (err error) {
 	msg, err := getSendMsg(command, msgInfo)
 	if err != nil {
@@ -59,7 +144,32 @@ func (c *Context) SendMsgUDP(command Command, ip *string, msgInfo interface{}) (
 	return nil
 }
 
+// SendMsgUDPReliable send to one peer over UDP, large messages are
+// fragmented, returns after the peer acknowledged the whole message
+func (c *Context) SendMsgUDPReliable(command Command, ip string, msgInfo interface{}) (err error) {
+	msg, err := getSendMsg(command, msgInfo)
+	if err != nil {
+		return err
+	}
+	if udpServer == nil {
+		return errors.New("UDP server not start")
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%v:%d", ip, udpServer.Port))
+	if err != nil {
+		return fmt.Errorf("ip resolve udp addr err:%s", err.Error())
+	}
+	return udpServer.SendReliable(msg, udpAddr)
+}
+
+// getSendMsg application message, signed when a signer is set
 func getSendMsg(command Command, msgInfo interface{}) (msg *Msg, err error) {
+	if msg, err = newSendMsg(command, msgInfo); err != nil {
+		return nil, err
+	}
+	return sealMsg(msg)
+}
+
+func newSendMsg(command Command, msgInfo interface{}) (msg *Msg, err error) {
 	if command < 50 {
 		return nil, errors.New("command must be above 50")
 	}
@@ -0,0 +1,110 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContext_ReplyTCP(t *testing.T) {
+	network := NewMemNetwork(1)
+	defer network.Close()
+	clock := network.Clock()
+	requests := make(chan *Context, 1)
+	replies := make(chan *Context, 2)
+
+	handlerA := NewEventHandler(nil)
+	handlerA.RegisterEventHandler(100, func(c *Context) {
+		assert.NoError(t, c.Reply(101, "pong"))
+		assert.NoError(t, c.ReplyError(102, errors.New("not found")))
+		requests <- c
+	})
+	a := NewTCPServer(10001, handlerA)
+	a.Transport = network.Host(net.ParseIP("10.0.0.1"))
+	go a.Start()
+
+	handlerB := NewEventHandler(nil)
+	handlerB.RegisterEventHandler(101, func(c *Context) { replies <- c })
+	handlerB.RegisterEventHandler(102, func(c *Context) { replies <- c })
+	b := NewTCPServer(10001, handlerB)
+	b.Transport = network.Host(net.ParseIP("10.0.0.2"))
+	go b.Start()
+	b.Dialer.AddStatic("10.0.0.1")
+	assert.True(t, advanceUntil(clock, time.Second, 5, func() bool { return a.PeerHello("10.0.0.2") != nil }))
+
+	msg := NewMsg(100, []byte("ping"))
+	assert.NoError(t, b.WriteToTCP(msg, "10.0.0.1"))
+	clock.Advance(time.Millisecond)
+	c := <-requests
+	assert.Equal(t, Command(100), c.GetCommand())
+	assert.Equal(t, msg.Head.MsgId, c.MsgID)
+	assert.Equal(t, LocalNodeID(), c.PeerID)
+	assert.Equal(t, TransportTCP, c.Transport)
+	assert.False(t, c.ReceivedAt.After(clock.Now()))
+	assert.False(t, c.ReceivedAt.IsZero())
+	assert.NoError(t, c.Context().Err())
+
+	for i := 0; i < 2; i++ {
+		reply := <-replies
+		assert.Equal(t, msg.Head.MsgId, reply.MsgID)
+		switch reply.GetCommand() {
+		case 101:
+			assert.Equal(t, "pong", string(reply.Body))
+		case 102:
+			var body ErrorReply
+			assert.NoError(t, json.Unmarshal(reply.Body, &body))
+			assert.Equal(t, "not found", body.Error)
+		}
+	}
+
+	network.Partition([]net.IP{net.ParseIP("10.0.0.1")}, []net.IP{net.ParseIP("10.0.0.2")})
+	assert.True(t, advanceUntil(clock, time.Second, 20, func() bool { return c.Context().Err() != nil }))
+	assert.Error(t, c.Reply(101, "late"))
+}
+
+func TestContext_ReplyUDP(t *testing.T) {
+	network := NewMemNetwork(1)
+	defer network.Close()
+	handler := NewEventHandler(nil)
+	received := make(chan *Context, 2)
+	handler.RegisterEventHandler(100, func(c *Context) {
+		assert.Equal(t, TransportUDP, c.Transport)
+		assert.NoError(t, c.Reply(101, "pong"))
+	})
+	handler.RegisterEventHandler(101, func(c *Context) { received <- c })
+	var servers []*UdpServer
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		server := NewUDPServer(10000, handler)
+		server.SetTransport(network.Host(net.ParseIP(ip)))
+		go server.Start()
+		servers = append(servers, server)
+	}
+	network.Clock().Advance(time.Millisecond)
+
+	// plain UDP frames are not dispatched
+	assert.NoError(t, servers[0].WriteToUDP(NewMsg(100, []byte("ping")), &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 10000}))
+	network.Clock().Advance(time.Millisecond)
+	assert.Empty(t, received)
+
+	msg := NewMsg(100, []byte("ping"))
+	go servers[0].SendReliable(msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 10000})
+	var reply *Context
+	assert.True(t, advanceUntil(network.Clock(), reliableTickTime*time.Millisecond, 20, func() bool {
+		select {
+		case reply = <-received:
+			return true
+		default:
+			return false
+		}
+	}))
+	assert.Equal(t, "10.0.0.2", reply.IP.String())
+	assert.Equal(t, msg.Head.MsgId, reply.MsgID)
+	assert.Equal(t, "pong", string(reply.Body))
+
+	assert.Error(t, NewContext().Reply(101, "pong"))
+	assert.Error(t, reply.Reply(10, "pong"))
+}
@@ -0,0 +1,217 @@
+package p2p
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DialState redial state of one outbound or static peer
+type DialState struct {
+	IP        string    `json:"ip"`
+	Static    bool      `json:"static"`
+	Connected bool      `json:"connected"`
+	Dialing   bool      `json:"dialing"`
+	GaveUp    bool      `json:"gaveUp"`
+	Attempts  int       `json:"attempts"`
+	NextDial  time.Time `json:"nextDial"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// Dialer re-dial lost outbound and static peers with exponential backoff
+// and jitter, non static peers are given up after dialMaxAttempts failures
+type Dialer struct {
+	peers map[string]*DialState
+	now   func() time.Time
+	rand  *rand.Rand
+	sync.Mutex
+}
+
+func newDialer(now func() time.Time) *Dialer {
+	return &Dialer{peers: map[string]*DialState{}, now: now, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// backoff delay before the attempt after attempts failures, half fixed
+// and half random
+func (d *Dialer) backoff(attempts int) time.Duration {
+	delay := dialBackoffMax * time.Second
+	if attempts < 16 {
+		if exp := dialBackoffBase * time.Second << uint(attempts); exp < delay {
+			delay = exp
+		}
+	}
+	return delay/2 + time.Duration(d.rand.Int63n(int64(delay/2)+1))
+}
+
+// state of ip, nil for a new non static peer once dialMaxPeers are tracked
+// and none could be pruned
+func (d *Dialer) state(ip string, static bool) *DialState {
+	state := d.peers[ip]
+	if state == nil {
+		if !static && len(d.peers) >= dialMaxPeers && !d.prune() {
+			return nil
+		}
+		state = &DialState{IP: ip}
+		d.peers[ip] = state
+	}
+	return state
+}
+
+// prune forget non static peers that gave up or have no dial pending, true
+// if there is room for a new peer
+func (d *Dialer) prune() bool {
+	for ip, state := range d.peers {
+		if !state.Static && !state.Connected && !state.Dialing && (state.GaveUp || state.NextDial.IsZero()) {
+			delete(d.peers, ip)
+		}
+	}
+	return len(d.peers) < dialMaxPeers
+}
+
+// AddStatic always keep a connection to ip
+func (d *Dialer) AddStatic(ip string) {
+	d.Lock()
+	defer d.Unlock()
+	state := d.state(ip, true)
+	state.Static = true
+	state.GaveUp = false
+	if !state.Connected && !state.Dialing {
+		state.NextDial = d.now()
+	}
+}
+
+func (d *Dialer) RemoveStatic(ip string) {
+	d.Lock()
+	defer d.Unlock()
+	if state := d.peers[ip]; state != nil {
+		state.Static = false
+		if !state.Connected {
+			delete(d.peers, ip)
+		}
+	}
+}
+
+// connected the dial succeeded, attempts are kept until the connection is
+// proven, a peer that accepts and closes right away still backs off
+func (d *Dialer) connected(ip string) {
+	d.Lock()
+	defer d.Unlock()
+	state := d.state(ip, false)
+	if state == nil {
+		return
+	}
+	state.Connected = true
+	state.Dialing = false
+	state.GaveUp = false
+	state.NextDial = time.Time{}
+}
+
+// proven the peer answered a heartbeat, the backoff starts over
+func (d *Dialer) proven(ip string) {
+	d.Lock()
+	defer d.Unlock()
+	if state := d.peers[ip]; state != nil && state.Connected {
+		state.Attempts = 0
+		state.LastError = ""
+	}
+}
+
+// alreadyConnected a dial found the peer connected, possibly inbound
+func (d *Dialer) alreadyConnected(ip string) {
+	d.Lock()
+	defer d.Unlock()
+	if state := d.peers[ip]; state != nil {
+		state.Connected = true
+		state.Dialing = false
+	}
+}
+
+func (d *Dialer) failed(ip string, err error) {
+	d.Lock()
+	defer d.Unlock()
+	state := d.peers[ip]
+	if state == nil {
+		return
+	}
+	state.Connected = false
+	state.Dialing = false
+	state.Attempts++
+	state.LastError = err.Error()
+	if !state.Static && state.Attempts >= dialMaxAttempts {
+		logger.Warn("Dialer give up peer", "addr", ip, "attempts", state.Attempts, "err", state.LastError)
+		state.GaveUp = true
+		return
+	}
+	state.NextDial = d.now().Add(d.backoff(state.Attempts))
+}
+
+// skipped the dial did not start, it is tried again after the backoff
+// without counting an attempt
+func (d *Dialer) skipped(ip string, reason string) {
+	d.Lock()
+	defer d.Unlock()
+	state := d.peers[ip]
+	if state == nil || !state.Dialing {
+		return
+	}
+	state.Dialing = false
+	state.LastError = reason
+	state.NextDial = d.now().Add(d.backoff(state.Attempts))
+}
+
+// lost the connection to a tracked peer, counted as an attempt like a
+// failed dial
+func (d *Dialer) lost(ip string) {
+	d.Lock()
+	defer d.Unlock()
+	state := d.peers[ip]
+	if state == nil || !state.Connected {
+		return
+	}
+	state.Connected = false
+	state.Attempts++
+	state.LastError = "connection lost"
+	if !state.Static && state.Attempts >= dialMaxAttempts {
+		logger.Warn("Dialer give up peer", "addr", ip, "attempts", state.Attempts, "err", state.LastError)
+		state.GaveUp = true
+		return
+	}
+	state.NextDial = d.now().Add(d.backoff(state.Attempts))
+}
+
+// due peers whose next dial time passed, they are marked dialing
+func (d *Dialer) due() (ips []string) {
+	d.Lock()
+	defer d.Unlock()
+	now := d.now()
+	for ip, state := range d.peers {
+		if state.Connected || state.Dialing || state.GaveUp || state.NextDial.IsZero() || state.NextDial.After(now) {
+			continue
+		}
+		state.Dialing = true
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func (d *Dialer) States() (states []DialState) {
+	d.Lock()
+	defer d.Unlock()
+	for _, state := range d.peers {
+		states = append(states, *state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].IP < states[j].IP })
+	return states
+}
+
+func (s *TcpServer) redial() {
+	for s.sleep(dialCheckTime * time.Second) {
+		for _, ip := range s.Dialer.due() {
+			logger.Info("TCP redial", "addr", ip)
+			go s.NewTCPConn(net.ParseIP(ip))
+		}
+	}
+}
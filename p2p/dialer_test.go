@@ -0,0 +1,161 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialer_Backoff(t *testing.T) {
+	d := newDialer(time.Now)
+	for attempts := 0; attempts < 40; attempts++ {
+		max := dialBackoffMax * time.Second
+		if attempts < 6 {
+			max = dialBackoffBase * time.Second << uint(attempts)
+		}
+		delay := d.backoff(attempts)
+		assert.True(t, delay >= max/2, "attempts %d delay %s", attempts, delay)
+		assert.True(t, delay <= max, "attempts %d delay %s", attempts, delay)
+	}
+}
+
+func TestDialer_GiveUp(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := newDialer(func() time.Time { return now })
+	err := errors.New("connection refused")
+
+	d.failed("10.0.0.9", err)
+	assert.Empty(t, d.States())
+
+	d.connected("10.0.0.1")
+	d.AddStatic("10.0.0.2")
+	assert.Equal(t, []string{"10.0.0.2"}, d.due())
+	assert.Empty(t, d.due())
+
+	d.lost("10.0.0.1")
+	d.failed("10.0.0.2", err)
+	for i := 1; i < dialMaxAttempts; i++ {
+		now = now.Add(dialBackoffMax * time.Second)
+		assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, d.due())
+		d.failed("10.0.0.1", err)
+		d.failed("10.0.0.2", err)
+	}
+	states := d.States()
+	assert.True(t, states[0].GaveUp)
+	assert.Equal(t, dialMaxAttempts, states[0].Attempts)
+	assert.Equal(t, "connection refused", states[0].LastError)
+	assert.False(t, states[1].GaveUp)
+	assert.True(t, states[1].Static)
+
+	now = now.Add(dialBackoffMax * time.Second)
+	assert.Equal(t, []string{"10.0.0.2"}, d.due())
+	d.connected("10.0.0.2")
+	assert.Equal(t, dialMaxAttempts, d.States()[1].Attempts)
+	d.proven("10.0.0.2")
+	assert.Equal(t, 0, d.States()[1].Attempts)
+
+	d.RemoveStatic("10.0.0.2")
+	assert.False(t, d.States()[1].Static)
+}
+
+func TestDialer_Flapping(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := newDialer(func() time.Time { return now })
+	d.connected("10.0.0.1")
+	d.proven("10.0.0.1")
+
+	// accepts and closes before any heartbeat answer
+	for i := 1; i < dialMaxAttempts; i++ {
+		d.lost("10.0.0.1")
+		state := d.States()[0]
+		assert.Equal(t, i, state.Attempts)
+		assert.True(t, state.NextDial.Sub(now) >= d.backoff(i)/2)
+		assert.Empty(t, d.due())
+		now = state.NextDial
+		assert.Equal(t, []string{"10.0.0.1"}, d.due())
+		d.connected("10.0.0.1")
+	}
+	d.lost("10.0.0.1")
+	assert.True(t, d.States()[0].GaveUp)
+}
+
+func TestDialer_Redial(t *testing.T) {
+	network := NewMemNetwork(1)
+	defer network.Close()
+	clock := network.Clock()
+	b := NewTCPServer(10001, NewEventHandler(nil))
+	b.Transport = network.Host(net.ParseIP("10.0.0.2"))
+	go b.Start()
+	defer b.Close()
+	a := NewTCPServer(10001, NewEventHandler(nil))
+	a.Transport = network.Host(net.ParseIP("10.0.0.3"))
+	go a.Start()
+	defer a.Close()
+	a.Dialer.AddStatic("10.0.0.2")
+
+	state := func() DialState {
+		return a.Dialer.States()[0]
+	}
+	assert.True(t, advanceUntil(clock, time.Second, 5, func() bool { return state().Connected }))
+
+	network.Partition([]net.IP{net.ParseIP("10.0.0.3")}, []net.IP{net.ParseIP("10.0.0.2")})
+	assert.True(t, advanceUntil(clock, time.Second, 20, func() bool { return state().Attempts > 0 }))
+	assert.False(t, state().Connected)
+	assert.NotEmpty(t, state().LastError)
+
+	network.Heal()
+	assert.True(t, advanceUntil(clock, time.Second, 120, func() bool { return state().Connected }))
+}
+
+func TestDialer_Prune(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := newDialer(func() time.Time { return now })
+	d.AddStatic("10.0.0.1")
+	for i := 0; i < dialMaxPeers+10; i++ {
+		d.connected(fmt.Sprintf("10.1.%d.%d", i/256, i%256))
+	}
+	assert.Len(t, d.States(), dialMaxPeers)
+
+	// peers that gave up make room, connected and static ones stay
+	for i := 0; i < 10; i++ {
+		ip := fmt.Sprintf("10.1.0.%d", i)
+		d.lost(ip)
+		d.Lock()
+		d.peers[ip].GaveUp = true
+		d.Unlock()
+	}
+	d.connected("10.2.0.1")
+	assert.Len(t, d.States(), dialMaxPeers-9)
+	d.AddStatic("10.3.0.1")
+	assert.Len(t, d.States(), dialMaxPeers-8)
+}
+
+func TestDialer_Banned(t *testing.T) {
+	network := NewMemNetwork(1)
+	defer network.Close()
+	clock := network.Clock()
+	b := NewTCPServer(10001, NewEventHandler(nil))
+	b.Transport = network.Host(net.ParseIP("10.0.0.2"))
+	go b.Start()
+	defer b.Close()
+	a := NewTCPServer(10001, NewEventHandler(nil))
+	a.Transport = network.Host(net.ParseIP("10.0.0.3"))
+	go a.Start()
+	defer a.Close()
+	assert.NoError(t, a.Ban("10.0.0.2", time.Hour))
+	a.Dialer.AddStatic("10.0.0.2")
+
+	// a dial skipped while banned is not lost, it runs again once unbanned
+	state := func() DialState {
+		return a.Dialer.States()[0]
+	}
+	assert.True(t, advanceUntil(clock, time.Second, 5, func() bool { return state().LastError == "peer banned" }))
+	assert.False(t, state().Dialing)
+	assert.Equal(t, 0, state().Attempts)
+	a.Unban("10.0.0.2")
+	assert.True(t, advanceUntil(clock, time.Second, 10, func() bool { return state().Connected }))
+}
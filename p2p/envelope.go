@@ -0,0 +1,243 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// signed envelope body, big endian:
+//   command(2) tag(2) msgId(2) timestamp(8) nonce(8) pubLen(1) pub sigLen(1) sig payload
+// the signature covers magic, command, tag, msgId, len and payload of the
+// original message and the timestamp and nonce, so relays can't change any
+// of them, timestamp is in unix milliseconds
+
+const envelopeHeadLen = 23
+
+// Signer node key signing message digests
+type Signer interface {
+	Sign(digest []byte) (signature []byte, err error)
+	PublicKey() []byte
+}
+
+// SignFunc signs a digest with a private key, crypto.SignPri fits
+type SignFunc func(priKey *ecdsa.PrivateKey, digest []byte) ([]byte, error)
+
+// KeySigner P256 node key signer
+type KeySigner struct {
+	key  *ecdsa.PrivateKey
+	sign SignFunc
+}
+
+// NewKeySigner sign with priKey, sign may be nil to use the built in
+// low-S ASN.1 signature
+func NewKeySigner(priKey *ecdsa.PrivateKey, sign SignFunc) *KeySigner {
+	if priKey == nil {
+		panic("signer private key not empty")
+	}
+	if sign == nil {
+		sign = signPri
+	}
+	return &KeySigner{key: priKey, sign: sign}
+}
+
+func (s *KeySigner) Sign(digest []byte) ([]byte, error) {
+	return s.sign(s.key, digest)
+}
+
+func (s *KeySigner) PublicKey() []byte {
+	return elliptic.Marshal(s.key.Curve, s.key.X, s.key.Y)
+}
+
+var localSigner Signer
+var signerMu = sync.Mutex{}
+
+// SetSigner sign every application message sent by this node, nil turns
+// signing off
+func SetSigner(signer Signer) {
+	signerMu.Lock()
+	localSigner = signer
+	signerMu.Unlock()
+}
+
+func getSigner() Signer {
+	signerMu.Lock()
+	defer signerMu.Unlock()
+	return localSigner
+}
+
+// KeyAddress address of a public key, hex of its sha256
+func KeyAddress(publicKey []byte) string {
+	hash := sha256.Sum256(publicKey)
+	return hex.EncodeToString(hash[:])
+}
+
+// envelope an opened signed envelope
+type envelope struct {
+	head      Head
+	payload   []byte
+	address   string
+	timestamp time.Time
+	nonce     uint64
+}
+
+func envelopeDigest(head Head, stamp []byte, payload []byte) []byte {
+	hash := sha256.New()
+	hash.Write(head.Magic[:])
+	for _, field := range []interface{}{head.Command, head.Tag, head.MsgId, uint32(len(payload))} {
+		binary.Write(hash, binary.BigEndian, field)
+	}
+	hash.Write(stamp)
+	hash.Write(payload)
+	return hash.Sum(nil)
+}
+
+// newStamp timestamp and random nonce
+func newStamp(now time.Time) []byte {
+	stamp := make([]byte, 16)
+	binary.BigEndian.PutUint64(stamp, uint64(now.UnixNano()/int64(time.Millisecond)))
+	rand.Read(stamp[8:])
+	return stamp
+}
+
+func parseStamp(stamp []byte) (time.Time, uint64) {
+	ms := int64(binary.BigEndian.Uint64(stamp))
+	return time.Unix(0, ms*int64(time.Millisecond)), binary.BigEndian.Uint64(stamp[8:])
+}
+
+// sealMsg wrap msg into a signed envelope when a signer is set
+func sealMsg(msg *Msg) (*Msg, error) {
+	signer := getSigner()
+	if signer == nil {
+		return msg, nil
+	}
+	body, err := seal(signer, msg.Head, msg.Body, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	head := msg.Head
+	head.Command = CommandSigned
+	head.Len = uint32(len(body))
+	return &Msg{Head: head, Body: body}, nil
+}
+
+func seal(signer Signer, head Head, payload []byte, now time.Time) ([]byte, error) {
+	head.Magic = MsgMagic
+	stamp := newStamp(now)
+	signature, err := signer.Sign(envelopeDigest(head, stamp, payload))
+	if err != nil {
+		return nil, err
+	}
+	pub := signer.PublicKey()
+	if len(pub) > 255 || len(signature) > 255 {
+		return nil, errors.New("signer key or signature too long")
+	}
+	body := make([]byte, 6, envelopeHeadLen+len(pub)+1+len(signature)+len(payload))
+	binary.BigEndian.PutUint16(body, uint16(head.Command))
+	binary.BigEndian.PutUint16(body[2:], uint16(head.Tag))
+	binary.BigEndian.PutUint16(body[4:], uint16(head.MsgId))
+	body = append(body, stamp...)
+	body = append(body, byte(len(pub)))
+	body = append(body, pub...)
+	body = append(body, byte(len(signature)))
+	body = append(body, signature...)
+	return append(body, payload...), nil
+}
+
+// openEnvelope verify a signed envelope
+func openEnvelope(body []byte) (*envelope, error) {
+	if len(body) < envelopeHeadLen {
+		return nil, errors.New("envelope too short")
+	}
+	env := &envelope{}
+	env.head.Magic = MsgMagic
+	env.head.Command = Command(binary.BigEndian.Uint16(body))
+	env.head.Tag = int16(binary.BigEndian.Uint16(body[2:]))
+	env.head.MsgId = int16(binary.BigEndian.Uint16(body[4:]))
+	stamp := body[6:22]
+	env.timestamp, env.nonce = parseStamp(stamp)
+	rest := body[22:]
+	pubLen := int(rest[0])
+	if len(rest) < 1+pubLen+1 {
+		return nil, errors.New("envelope key too short")
+	}
+	pub := rest[1 : 1+pubLen]
+	rest = rest[1+pubLen:]
+	sigLen := int(rest[0])
+	if len(rest) < 1+sigLen {
+		return nil, errors.New("envelope signature too short")
+	}
+	signature := rest[1 : 1+sigLen]
+	env.payload = rest[1+sigLen:]
+	env.head.Len = uint32(len(env.payload))
+	if !verifySignature(pub, envelopeDigest(env.head, stamp, env.payload), signature) {
+		return nil, errors.New("envelope signature invalid")
+	}
+	env.address = KeyAddress(pub)
+	return env, nil
+}
+
+// open a signed context in place, false if the signature does not verify
+func (c *Context) open() (*envelope, bool) {
+	env, err := openEnvelope(c.Body)
+	if err != nil {
+		logger.Warn("Handler drop signed msg", "addr", c.IP, "err", err.Error())
+		return nil, false
+	}
+	c.envelope = c.Body
+	c.command = env.head.Command
+	c.Tag = env.head.Tag
+	c.MsgID = env.head.MsgId
+	c.Body = env.payload
+	c.Address = env.address
+	return env, true
+}
+
+// innerCommand command of message, looking into signed envelopes
+func innerCommand(message Message) Command {
+	body := message.GetBody()
+	if message.GetCommand() == CommandSigned && len(body) >= 2 {
+		return Command(binary.BigEndian.Uint16(body))
+	}
+	return message.GetCommand()
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func signPri(priKey *ecdsa.PrivateKey, digest []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, priKey, digest)
+	if err != nil {
+		return nil, err
+	}
+	// low S like crypto.SignPri
+	half := new(big.Int).Rsh(priKey.Params().N, 1)
+	if s.Cmp(half) > 0 {
+		s = new(big.Int).Sub(priKey.Params().N, s)
+	}
+	return asn1.Marshal(ecdsaSignature{r, s})
+}
+
+func verifySignature(publicKey, digest, signature []byte) bool {
+	x, y := elliptic.Unmarshal(elliptic.P256(), publicKey)
+	if x == nil {
+		return false
+	}
+	var sig ecdsaSignature
+	if rest, err := asn1.Unmarshal(signature, &sig); err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil {
+		return false
+	}
+	if sig.R.Sign() <= 0 || sig.S.Sign() <= 0 || sig.S.Cmp(new(big.Int).Rsh(elliptic.P256().Params().N, 1)) > 0 {
+		return false
+	}
+	return ecdsa.Verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, digest, sig.R, sig.S)
+}
@@ -0,0 +1,120 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSigner(t *testing.T) *KeySigner {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return NewKeySigner(key, nil)
+}
+
+func TestEnvelope_SealOpen(t *testing.T) {
+	signer := newTestSigner(t)
+	head := Head{Command: 100, Tag: NodeServer, MsgId: 7}
+	now := time.Unix(1600000000, 123e6)
+	body, err := seal(signer, head, []byte("payload"), now)
+	assert.NoError(t, err)
+
+	env, err := openEnvelope(body)
+	assert.NoError(t, err)
+	assert.Equal(t, Command(100), env.head.Command)
+	assert.Equal(t, int16(7), env.head.MsgId)
+	assert.Equal(t, "payload", string(env.payload))
+	assert.Equal(t, KeyAddress(signer.PublicKey()), env.address)
+	assert.Equal(t, 64, len(env.address))
+	assert.True(t, now.Equal(env.timestamp))
+	other, _ := seal(signer, head, []byte("payload"), now)
+	env2, _ := openEnvelope(other)
+	assert.NotEqual(t, env.nonce, env2.nonce)
+
+	// any change of the payload, the signed head fields or the stamp is detected
+	for _, i := range []int{0, 5, 9, 20, len(body) - 1} {
+		tampered := append([]byte{}, body...)
+		tampered[i] ^= 1
+		_, err = openEnvelope(tampered)
+		assert.Error(t, err, "byte %d", i)
+	}
+	_, err = openEnvelope(body[:30])
+	assert.Error(t, err)
+	_, err = openEnvelope(append(body, '!'))
+	assert.Error(t, err)
+
+	// a relay can't re-sign with its own key under the origin key
+	forged, _ := seal(newTestSigner(t), head, []byte("forged"), now)
+	copy(forged[envelopeHeadLen:], signer.PublicKey())
+	_, err = openEnvelope(forged)
+	assert.Error(t, err)
+}
+
+func TestEventHandler_Signed(t *testing.T) {
+	signer := newTestSigner(t)
+	SetSigner(signer)
+	msg, err := getSendMsg(100, "hello")
+	again, _ := getSendMsg(100, "again")
+	SetSigner(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, CommandSigned, msg.Head.Command)
+	assert.Equal(t, CommandSigned, msg.GetCommand())
+	assert.Equal(t, Command(100), innerCommand(msg))
+
+	handler := NewEventHandler(nil)
+	received := make(chan *Context, 1)
+	handler.RegisterEventHandler(100, func(c *Context) { received <- c })
+	msg.Handler(handler, &Context{IP: net.ParseIP("10.0.0.1"), Transport: TransportTCP})
+	c := <-received
+	assert.Equal(t, Command(100), c.GetCommand())
+	assert.Equal(t, "hello", string(c.Body))
+	assert.Equal(t, msg.Head.MsgId, c.MsgID)
+	assert.Equal(t, KeyAddress(signer.PublicKey()), c.Address)
+
+	tampered := *msg
+	tampered.Body = append([]byte{}, msg.Body...)
+	tampered.Body[len(tampered.Body)-1] = '!'
+	tampered.Handler(handler, &Context{IP: net.ParseIP("10.0.0.1"), Transport: TransportTCP})
+
+	handler.RequireSigned(true)
+	unsigned, _ := getSendMsg(100, "plain")
+	unsigned.Handler(handler, &Context{IP: net.ParseIP("10.0.0.1"), Transport: TransportTCP})
+	msg.Handler(handler, &Context{IP: net.ParseIP("10.0.0.1"), Transport: TransportTCP})
+	again.Handler(handler, &Context{IP: net.ParseIP("10.0.0.1"), Transport: TransportTCP})
+	assert.Equal(t, "again", string((<-received).Body))
+	assert.Empty(t, received)
+	assert.Equal(t, uint64(1), handler.Replay().Stats().Duplicate)
+}
+
+func TestPubSub_Signed(t *testing.T) {
+	mesh := newTestPubSubMesh("10.0.0.1", "10.0.0.2")
+	var addresses []string
+	mesh["10.0.0.2"].Subscribe("blocks", func(topic string, data []byte, c *Context) {
+		assert.Equal(t, "block 1", string(data))
+		addresses = append(addresses, c.Address)
+	})
+	signer := newTestSigner(t)
+	SetSigner(signer)
+	err := mesh["10.0.0.1"].Publish("blocks", []byte("block 1"))
+	SetSigner(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{KeyAddress(signer.PublicKey())}, addresses)
+
+	// a relay moving a signed publication to another topic is dropped
+	signed, _ := seal(signer, Head{Command: CommandTopicPublish}, []byte(`{"topic":"blocks","origin":"a","seq":1}`), time.Now())
+	body, _ := json.Marshal(topicMessage{Topic: "txs", Origin: "a", Seq: 1, Envelope: signed})
+	mesh["10.0.0.2"].Subscribe("txs", func(topic string, data []byte, c *Context) {
+		t.Fatal("forged publication delivered")
+	})
+	mesh["10.0.0.2"].onPublish(&Context{IP: net.ParseIP("10.0.0.1"), Body: body})
+
+	mesh["10.0.0.2"].handler.RequireSigned(true)
+	assert.NoError(t, mesh["10.0.0.1"].Publish("blocks", []byte("unsigned")))
+	assert.Equal(t, 1, len(addresses))
+}
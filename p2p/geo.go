@@ -0,0 +1,190 @@
+package p2p
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"sort"
+)
+
+// PeerDistance a connected peer with its distance from the local node in km
+type PeerDistance struct {
+	IP       string    `json:"ip"`
+	NodeID   string    `json:"nodeId,omitempty"`
+	Tag      int16     `json:"tag,omitempty"`
+	Position *Position `json:"position"`
+	Distance float64   `json:"distance"`
+}
+
+// Distance great-circle distance in km
+func (p Position) Distance(other Position) float64 {
+	lat1 := p.Latitude * math.Pi / 180
+	lat2 := other.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (other.Longitude - p.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// IsEmpty position not reported
+func (p *Position) IsEmpty() bool {
+	return p == nil || (p.Longitude == 0 && p.Latitude == 0)
+}
+
+func parsePosition(data []byte) *Position {
+	if len(data) == 0 {
+		return nil
+	}
+	ps := &Position{}
+	if err := json.Unmarshal(data, ps); err != nil || ps.IsEmpty() {
+		return nil
+	}
+	return ps
+}
+
+// local position from the broadcast data, caller holds the server lock
+func (s *TcpServer) position() *Position {
+	if !s.broadcastData.Position.IsEmpty() {
+		return s.broadcastData.Position
+	}
+	return parsePosition(s.broadcastData.PositionByte)
+}
+
+// SetPreferNearby prefer nearby server nodes for outbound connections, relays
+// and rendezvous
+func (s *TcpServer) SetPreferNearby(prefer bool) {
+	s.Lock()
+	s.preferNearby = prefer
+	s.Unlock()
+}
+
+// NearestPeers at most n connected peers with a known position, nearest first
+func (s *TcpServer) NearestPeers(n int) []PeerDistance {
+	peers := s.peerDistances()
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// PeersWithin connected peers at most radius km away, nearest first
+func (s *TcpServer) PeersWithin(radius float64) []PeerDistance {
+	peers := s.peerDistances()
+	i := sort.Search(len(peers), func(i int) bool { return peers[i].Distance > radius })
+	return peers[:i]
+}
+
+func (s *TcpServer) peerDistances() (peers []PeerDistance) {
+	s.Lock()
+	local := s.position()
+	nodes := make([]*TcpNode, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	s.Unlock()
+	if local == nil {
+		return nil
+	}
+	for _, node := range nodes {
+		node.Lock()
+		if node.isOnline && node.isStart && node.position != nil {
+			peer := PeerDistance{IP: node.addr.IP.String(), Tag: node.tag, Position: node.position}
+			if !node.id.IsEmpty() {
+				peer.NodeID = node.id.String()
+			}
+			peer.Distance = local.Distance(*node.position)
+			peers = append(peers, peer)
+		}
+		node.Unlock()
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Distance != peers[j].Distance {
+			return peers[i].Distance < peers[j].Distance
+		}
+		return peers[i].IP < peers[j].IP
+	})
+	return peers
+}
+
+// sortNearby order nodes nearest first, nodes without position keep their
+// order after the located ones
+func sortNearby(local *Position, nodes []*TcpNode) {
+	if local == nil {
+		return
+	}
+	distance := make(map[*TcpNode]float64, len(nodes))
+	for _, node := range nodes {
+		node.Lock()
+		if node.position != nil {
+			distance[node] = local.Distance(*node.position)
+		}
+		node.Unlock()
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		di, iok := distance[nodes[i]]
+		dj, jok := distance[nodes[j]]
+		if iok != jok {
+			return iok
+		}
+		return iok && di < dj
+	})
+}
+
+// sortNearbyAddrs order rendezvous servers nearest first when nearby
+// servers are preferred, the position is the one of the TCP node of the ip
+func (s *TcpServer) sortNearbyAddrs(addrs []*net.UDPAddr) {
+	s.Lock()
+	if !s.preferNearby {
+		s.Unlock()
+		return
+	}
+	local := s.position()
+	nodes := make([]*TcpNode, len(addrs))
+	for i, addr := range addrs {
+		nodes[i] = s.nodes[addr.IP.String()]
+	}
+	s.Unlock()
+	if local == nil {
+		return
+	}
+	distance := map[string]float64{}
+	for _, node := range nodes {
+		if node == nil {
+			continue
+		}
+		node.Lock()
+		if node.position != nil {
+			distance[node.addr.IP.String()] = local.Distance(*node.position)
+		}
+		node.Unlock()
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		di, iok := distance[addrs[i].IP.String()]
+		dj, jok := distance[addrs[j].IP.String()]
+		if iok != jok {
+			return iok
+		}
+		return iok && di < dj
+	})
+}
+
+// sortNearbyRecords order stored peers with server nodes nearest first
+func sortNearbyRecords(local *Position, peers []PeerRecord) {
+	if local == nil {
+		return
+	}
+	rank := func(peer PeerRecord) (bool, float64) {
+		if peer.Tag != NodeServer || peer.Position.IsEmpty() {
+			return false, 0
+		}
+		return true, local.Distance(*peer.Position)
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		iok, di := rank(peers[i])
+		jok, dj := rank(peers[j])
+		if iok != jok {
+			return iok
+		}
+		return iok && di < dj
+	})
+}
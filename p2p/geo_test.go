@@ -0,0 +1,81 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	paris  = &Position{Longitude: 2.3522, Latitude: 48.8566}
+	london = &Position{Longitude: -0.1278, Latitude: 51.5074}
+	berlin = &Position{Longitude: 13.4050, Latitude: 52.5200}
+	tokyo  = &Position{Longitude: 139.6917, Latitude: 35.6895}
+)
+
+func TestPosition_Distance(t *testing.T) {
+	assert.InDelta(t, 343.5, paris.Distance(*london), 1)
+	assert.InDelta(t, 343.5, london.Distance(*paris), 1)
+	assert.InDelta(t, 9712, paris.Distance(*tokyo), 10)
+	assert.Equal(t, 0.0, paris.Distance(*paris))
+	assert.InDelta(t, 20015, Position{}.Distance(Position{Longitude: 180}), 1)
+
+	assert.True(t, (*Position)(nil).IsEmpty())
+	assert.Nil(t, parsePosition([]byte(`{"longitude":0}`)))
+	assert.Nil(t, parsePosition([]byte(`{`)))
+	assert.Equal(t, paris, parsePosition([]byte(`{"longitude":2.3522,"latitude":48.8566}`)))
+}
+
+func TestTcpServer_NearestPeers(t *testing.T) {
+	s := NewTCPServer(10001, NewEventHandler(nil))
+	for i, position := range []*Position{tokyo, london, nil, berlin} {
+		node, remote := newTestTcpNode(t, s, NodeID{byte(i + 1)}, NodeServer)
+		defer remote.Close()
+		node.addr.IP = net.IPv4(10, 0, 0, byte(i+1))
+		node.position = position
+		s.nodes[node.addr.IP.String()] = node
+	}
+	assert.Empty(t, s.NearestPeers(10))
+
+	s.broadcastData = BroadcastData{PositionByte: []byte(`{"longitude":2.3522,"latitude":48.8566}`)}
+	peers := s.NearestPeers(2)
+	assert.Equal(t, 2, len(peers))
+	assert.Equal(t, "10.0.0.2", peers[0].IP)
+	assert.Equal(t, NodeID{2}.String(), peers[0].NodeID)
+	assert.Equal(t, "10.0.0.4", peers[1].IP)
+	assert.Equal(t, 3, len(s.NearestPeers(10)))
+
+	within := s.PeersWithin(1000)
+	assert.Equal(t, 2, len(within))
+	assert.Empty(t, s.PeersWithin(100))
+
+	relays := s.relayNodes()
+	assert.Equal(t, 4, len(relays))
+	s.SetPreferNearby(true)
+	relays = s.relayNodes()
+	assert.Equal(t, []net.IP{net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 4), net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 3)},
+		[]net.IP{relays[0].addr.IP, relays[1].addr.IP, relays[2].addr.IP, relays[3].addr.IP})
+
+	// rendezvous servers, an unknown one goes last
+	addrs := []*net.UDPAddr{{IP: net.IPv4(10, 0, 0, 9)}, {IP: net.IPv4(10, 0, 0, 1)}, {IP: net.IPv4(10, 0, 0, 4)}}
+	s.sortNearbyAddrs(addrs)
+	assert.Equal(t, "10.0.0.4", addrs[0].IP.String())
+	assert.Equal(t, "10.0.0.1", addrs[1].IP.String())
+	assert.Equal(t, "10.0.0.9", addrs[2].IP.String())
+}
+
+func TestSortNearbyRecords(t *testing.T) {
+	peers := []PeerRecord{
+		{IP: "10.0.0.1", Tag: NodeServer, Position: tokyo},
+		{IP: "10.0.0.2", Tag: NodeClient, Position: london},
+		{IP: "10.0.0.3"},
+		{IP: "10.0.0.4", Tag: NodeServer, Position: berlin},
+	}
+	sortNearbyRecords(paris, peers)
+	var ips []string
+	for _, peer := range peers {
+		ips = append(ips, peer.IP)
+	}
+	assert.Equal(t, []string{"10.0.0.4", "10.0.0.1", "10.0.0.2", "10.0.0.3"}, ips)
+}
@@ -1,5 +1,10 @@
 package p2p
 
+import (
+	"sync"
+	"time"
+)
+
 type Handler interface {
 	Handler(c *Context)
 }
@@ -11,8 +16,16 @@ func (f EventHandlerFunc) Handler(c *Context) {
 }
 
 type EventHandler struct {
-	messages   map[string]Message
-	evHandlers map[Command][]EventHandlerFunc
+	messages        map[string]Message
+	evHandlers      map[Command][]EventHandlerFunc
+	protocols       map[string]int
+	commandProtocol map[Command]string
+	priorities      map[Command]Priority
+	streamHandlers  map[Command]StreamHandler
+	requireSigned   bool
+	inline          bool // run handlers in the dispatching goroutine, set while replaying
+	replay          *ReplayGuard
+	sync.Mutex
 }
 
 func NewEventHandler(messages map[string]Message) *EventHandler {
@@ -23,18 +36,68 @@ func NewEventHandler(messages map[string]Message) *EventHandler {
 		handler.messages = messages
 	}
 	handler.evHandlers = make(map[Command][]EventHandlerFunc)
+	handler.protocols = make(map[string]int)
+	handler.commandProtocol = make(map[Command]string)
+	handler.priorities = make(map[Command]Priority)
+	handler.streamHandlers = make(map[Command]StreamHandler)
+	handler.replay = newReplayGuard(replaySkew * time.Second)
 	return handler
 }
 
 func (e *EventHandler) DoSomething(c *Context) {
+	if c.command == CommandSigned {
+		env, ok := c.open()
+		if !ok || !e.replay.check(env.address, c.IP, env.timestamp, env.nonce, e.replay.clock()) {
+			return
+		}
+	}
+	if e.signedOnly() && c.Address == "" && isAppCommand(c.command) && c.Transport != "" {
+		logger.Warn("Handler drop unsigned msg", "addr", c.IP, "command", c.command)
+		return
+	}
 	logger.Debug("Handler DoSomething", "addr", c.IP, "command", c.command, "event", EventInfoKV[c.command], "NodeName", c.NodeName)
 	if handlers, ok := e.evHandlers[c.command]; ok {
+		inline := e.isInline()
 		for _, handler := range handlers {
-			go handler.Handler(c)
+			if inline {
+				handler.Handler(c)
+			} else {
+				go handler.Handler(c)
+			}
 		}
 	}
 }
 
+// RequireSigned drop application messages from peers that are not signed
+func (e *EventHandler) RequireSigned(require bool) {
+	e.Lock()
+	e.requireSigned = require
+	e.Unlock()
+}
+
+// Replay guard of signed messages and heartbeats
+func (e *EventHandler) Replay() *ReplayGuard {
+	return e.replay
+}
+
+func (e *EventHandler) isInline() bool {
+	e.Lock()
+	defer e.Unlock()
+	return e.inline
+}
+
+func (e *EventHandler) setInline(inline bool) {
+	e.Lock()
+	e.inline = inline
+	e.Unlock()
+}
+
+func (e *EventHandler) signedOnly() bool {
+	e.Lock()
+	defer e.Unlock()
+	return e.requireSigned
+}
+
 func (e *EventHandler) RegisterEventHandler(command Command, handler ...EventHandlerFunc) {
 	e.evHandlers[command] = append(e.evHandlers[command], handler...)
 }
@@ -7,13 +7,42 @@ import (
 
 var logger *zap.SugaredLogger
 
+// logLevel shared by every logger built here, changed at runtime by SetLogLevel
+var logLevel = zap.NewAtomicLevelAt(zapcore.DebugLevel)
+
 func init() {
+	if err := buildLogger(nil); err != nil {
+		panic(err)
+	}
+}
+
+func buildLogger(outputs []string) error {
 	logConfig := zap.NewDevelopmentConfig()
-	logConfig.Level = zap.NewAtomicLevelAt(zapcore.DebugLevel)
+	logConfig.Level = logLevel
+	if len(outputs) > 0 {
+		logConfig.OutputPaths = outputs
+	}
 	log, err := logConfig.Build()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer log.Sync()
 	logger = log.Named("p2p").WithOptions().Sugar()
-}
\ No newline at end of file
+	return nil
+}
+
+// SetLogLevel debug, info, warn or error
+func SetLogLevel(level string) error {
+	return logLevel.UnmarshalText([]byte(level))
+}
+
+// LogLevel current p2p log level
+func LogLevel() string {
+	return logLevel.String()
+}
+
+// SetLogOutput write p2p logs to the paths, stderr and stdout are accepted,
+// call it before the servers start
+func SetLogOutput(paths ...string) error {
+	return buildLogger(paths)
+}
@@ -0,0 +1,557 @@
+package p2p
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SwimProtocol name of the membership sub-protocol in the hello
+const SwimProtocol = "swim"
+
+// MemberState what the group believes about a member
+type MemberState string
+
+const (
+	MemberAlive   MemberState = "alive"
+	MemberSuspect MemberState = "suspect"
+	MemberDead    MemberState = "dead"
+)
+
+// Member a node of the group, keyed by IP like the peer table, Incarnation
+// is raised by the member itself to refute a suspicion
+type Member struct {
+	IP          string      `json:"ip"`
+	NodeID      string      `json:"nodeId,omitempty"`
+	State       MemberState `json:"state"`
+	Incarnation uint64      `json:"incarnation"`
+	Since       time.Time   `json:"since"`
+}
+
+// MemberEvent a member joined or changed state, Previous is empty on join
+type MemberEvent struct {
+	Member   Member
+	Previous MemberState
+}
+
+type MemberHandler func(event MemberEvent)
+
+// Membership SWIM style failure detector, each period one member is pinged
+// directly, then through a few other members when the ack is late, members
+// that stay silent are suspected and declared dead unless they refute it
+// with a higher incarnation, updates are piggybacked on the probes
+type Membership struct {
+	tcp         *TcpServer
+	incarnation uint64
+	members     map[string]*Member
+	order       []string
+	next        int
+	seq         uint32
+	probe       *swimProbe
+	relays      map[uint32]swimRelay
+	gossip      []*swimGossip
+	handlers    []MemberHandler
+	rand        *rand.Rand
+	sync.Mutex
+}
+
+// swimProbe the probe of the current period
+type swimProbe struct {
+	target string
+	seq    uint32
+	acked  bool
+}
+
+// swimRelay a ping sent for another member, the ack goes back to it
+type swimRelay struct {
+	requester string
+	seq       uint32
+	target    string
+	sent      time.Time
+}
+
+type swimGossip struct {
+	update memberUpdate
+	sent   int
+}
+
+type memberUpdate struct {
+	IP          string      `json:"ip"`
+	NodeID      string      `json:"nodeId,omitempty"`
+	State       MemberState `json:"state"`
+	Incarnation uint64      `json:"inc"`
+}
+
+// swimMessage body of ping, ack and ping-req, Target is the probed member
+// of an indirect probe, Incarnation the sender's own
+type swimMessage struct {
+	Seq         uint32         `json:"seq"`
+	Target      string         `json:"target,omitempty"`
+	Incarnation uint64         `json:"inc"`
+	Updates     []memberUpdate `json:"updates,omitempty"`
+}
+
+// NewMembership run the membership protocol on tcp, the offline event
+// still follows the connection, a peer reachable through other members only
+// goes offline all the same, its member state is reported to OnChange
+func NewMembership(tcp *TcpServer) *Membership {
+	if tcp == nil {
+		panic("membership TcpServer not empty")
+	}
+	m := &Membership{
+		tcp:     tcp,
+		members: map[string]*Member{},
+		relays:  map[uint32]swimRelay{},
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	handler := tcp.handler
+	handler.RegisterProtocol(SwimProtocol, 1, CommandSwimPing, CommandSwimAck, CommandSwimPingReq)
+	handler.RegisterEventHandler(CommandSwimPing, m.onPing)
+	handler.RegisterEventHandler(CommandSwimAck, m.onAck)
+	handler.RegisterEventHandler(CommandSwimPingReq, m.onPingReq)
+	handler.RegisterEventHandler(NodeDiscoveryHandler, m.onPeerOnline)
+	tcp.Lock()
+	tcp.membership = m
+	tcp.Unlock()
+	tcp.goLoop(m.run)
+	return m
+}
+
+// OnChange call fn for every join and state change
+func (m *Membership) OnChange(fn MemberHandler) {
+	m.Lock()
+	m.handlers = append(m.handlers, fn)
+	m.Unlock()
+}
+
+// Members the group as this node sees it, itself included, sorted by IP
+func (m *Membership) Members() []Member {
+	m.Lock()
+	members := make([]Member, 0, len(m.members)+1)
+	for _, member := range m.members {
+		members = append(members, *member)
+	}
+	members = append(members, Member{IP: m.localIP(), NodeID: LocalNodeID().String(), State: MemberAlive, Incarnation: m.incarnation})
+	m.Unlock()
+	sort.Slice(members, func(i, j int) bool { return members[i].IP < members[j].IP })
+	return members
+}
+
+func (m *Membership) Member(ip string) (Member, bool) {
+	m.Lock()
+	defer m.Unlock()
+	if member := m.members[ip]; member != nil {
+		return *member, true
+	}
+	return Member{}, false
+}
+
+func (m *Membership) localIP() string {
+	return m.tcp.Transport.LocalIP().String()
+}
+
+func (m *Membership) run() {
+	for m.tcp.sleep(swimPeriodTime * time.Millisecond) {
+		m.Tick()
+	}
+}
+
+// Tick one protocol period: suspect the member of the last probe if it did
+// not answer, expire suspicions and probe the next member
+func (m *Membership) Tick() {
+	now := m.tcp.Transport.Now()
+	m.Lock()
+	var events []MemberEvent
+	if probe := m.probe; probe != nil && !probe.acked {
+		if member := m.members[probe.target]; member != nil && member.State == MemberAlive {
+			logger.Info("SWIM suspect member", "addr", probe.target, "incarnation", member.Incarnation)
+			events = append(events, m.apply(memberUpdate{IP: member.IP, NodeID: member.NodeID, State: MemberSuspect, Incarnation: member.Incarnation}, now)...)
+		}
+	}
+	m.probe = nil
+	for _, member := range m.members {
+		switch {
+		case member.State == MemberSuspect && now.Sub(member.Since) >= m.suspectTimeout():
+			logger.Warn("SWIM member dead", "addr", member.IP, "incarnation", member.Incarnation)
+			events = append(events, m.apply(memberUpdate{IP: member.IP, NodeID: member.NodeID, State: MemberDead, Incarnation: member.Incarnation}, now)...)
+		case member.State == MemberDead && now.Sub(member.Since) >= swimDeadTime*time.Second:
+			delete(m.members, member.IP)
+		}
+	}
+	for seq, relay := range m.relays {
+		if now.Sub(relay.sent) >= swimPeriodTime*time.Millisecond {
+			delete(m.relays, seq)
+		}
+	}
+	target := m.nextTarget()
+	var seq uint32
+	if target != "" {
+		m.seq++
+		seq = m.seq
+		m.probe = &swimProbe{target: target, seq: seq}
+	}
+	m.Unlock()
+	m.emit(events)
+	if target == "" {
+		return
+	}
+	direct := m.send(target, CommandSwimPing, swimMessage{Seq: seq})
+	if !direct {
+		// no connection to the member, only others can reach it
+		m.pingReq(target, seq)
+		return
+	}
+	go func() {
+		if !m.tcp.sleep(swimProbeTimeout * time.Millisecond) {
+			return
+		}
+		m.Lock()
+		late := m.probe != nil && m.probe.seq == seq && !m.probe.acked
+		m.Unlock()
+		if late {
+			m.pingReq(target, seq)
+		}
+	}()
+}
+
+// suspectTimeout grows with the group so updates have time to spread
+func (m *Membership) suspectTimeout() time.Duration {
+	scale := math.Max(1, math.Log10(float64(len(m.members)+1)))
+	return time.Duration(float64(swimSuspectPeriods*swimPeriodTime*time.Millisecond) * scale)
+}
+
+// nextTarget round robin over a shuffled list of the live members
+func (m *Membership) nextTarget() string {
+	for tries := 0; tries < 2; tries++ {
+		for m.next < len(m.order) {
+			ip := m.order[m.next]
+			m.next++
+			if member := m.members[ip]; member != nil && member.State != MemberDead {
+				return ip
+			}
+		}
+		m.order = m.order[:0]
+		for ip := range m.members {
+			m.order = append(m.order, ip)
+		}
+		sort.Strings(m.order)
+		m.rand.Shuffle(len(m.order), func(i, j int) { m.order[i], m.order[j] = m.order[j], m.order[i] })
+		m.next = 0
+	}
+	return ""
+}
+
+// pingReq ask up to swimIndirectProbes connected members to ping target
+func (m *Membership) pingReq(target string, seq uint32) {
+	var helpers []string
+	for _, node := range m.connected() {
+		if ip := node.addr.IP.String(); ip != target {
+			helpers = append(helpers, ip)
+		}
+	}
+	m.Lock()
+	m.rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	m.Unlock()
+	if len(helpers) > swimIndirectProbes {
+		helpers = helpers[:swimIndirectProbes]
+	}
+	for _, helper := range helpers {
+		m.send(helper, CommandSwimPingReq, swimMessage{Seq: seq, Target: target})
+	}
+}
+
+// connected online TCP peers speaking the protocol
+func (m *Membership) connected() (nodes []*TcpNode) {
+	s := m.tcp
+	s.Lock()
+	all := make([]*TcpNode, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		all = append(all, node)
+	}
+	s.Unlock()
+	for _, node := range all {
+		node.Lock()
+		online := node.isOnline && node.isStart && node.transport == TransportTCP
+		node.Unlock()
+		if online && node.supports(CommandSwimPing) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// send message to ip over its connection with piggybacked updates, false
+// without a connection
+func (m *Membership) send(ip string, command Command, message swimMessage) bool {
+	s := m.tcp
+	s.Lock()
+	node := s.nodes[ip]
+	s.Unlock()
+	if node == nil {
+		return false
+	}
+	node.Lock()
+	online := node.isOnline && node.isStart
+	node.Unlock()
+	if !online || !node.supports(command) {
+		return false
+	}
+	m.Lock()
+	message.Incarnation = m.incarnation
+	message.Updates = m.piggyback()
+	m.Unlock()
+	body, err := json.Marshal(message)
+	if err != nil {
+		logger.Error("SWIM marshal json", "err", err.Error())
+		return false
+	}
+	if err := s.WriteToTCP(newRawMsg(command, body), ip); err != nil {
+		logger.Debug("SWIM send", "addr", ip, "err", err.Error())
+		return false
+	}
+	return true
+}
+
+// piggyback the least sent updates, each is sent a few times the log of
+// the group size
+func (m *Membership) piggyback() []memberUpdate {
+	limit := swimRetransmit * int(math.Ceil(math.Log2(float64(len(m.members)+2))))
+	sort.SliceStable(m.gossip, func(i, j int) bool { return m.gossip[i].sent < m.gossip[j].sent })
+	var updates []memberUpdate
+	kept := m.gossip[:0]
+	for _, gossip := range m.gossip {
+		if len(updates) < swimMaxPiggyback {
+			updates = append(updates, gossip.update)
+			gossip.sent++
+		}
+		if gossip.sent < limit {
+			kept = append(kept, gossip)
+		}
+	}
+	m.gossip = kept
+	return updates
+}
+
+// receive the piggybacked updates and the sender being alive
+func (m *Membership) receive(c *Context) (swimMessage, bool) {
+	var message swimMessage
+	if c.Transport != TransportTCP {
+		return message, false
+	}
+	if err := json.Unmarshal(c.Body, &message); err != nil {
+		logger.Warn("SWIM json unmarshal", "addr", c.IP, "err", err.Error())
+		return message, false
+	}
+	now := m.tcp.Transport.Now()
+	sender := memberUpdate{IP: c.IP.String(), State: MemberAlive, Incarnation: message.Incarnation}
+	if !c.PeerID.IsEmpty() {
+		sender.NodeID = c.PeerID.String()
+	}
+	if len(message.Updates) > swimMaxPiggyback {
+		message.Updates = message.Updates[:swimMaxPiggyback]
+	}
+	m.Lock()
+	events := m.apply(sender, now)
+	for _, update := range message.Updates {
+		if update, ok := m.gossiped(update); ok {
+			events = append(events, m.apply(update, now)...)
+		}
+	}
+	m.Unlock()
+	m.emit(events)
+	return message, true
+}
+
+// gossiped validate an update from another member under the lock, the IP
+// must be a peer address and new members are capped at swimMaxMembers
+func (m *Membership) gossiped(update memberUpdate) (memberUpdate, bool) {
+	update.IP = sharedIP(update.IP)
+	if update.IP == "" {
+		return update, false
+	}
+	if update.NodeID != "" {
+		if id, err := ParseNodeID(update.NodeID); err != nil || id.IsEmpty() {
+			update.NodeID = ""
+		}
+	}
+	if update.IP != m.localIP() && m.members[update.IP] == nil {
+		if len(m.members) >= swimMaxMembers || m.tcp.isBanned(update.IP) {
+			return update, false
+		}
+	}
+	return update, true
+}
+
+func (m *Membership) onPeerOnline(c *Context) {
+	if c.Transport != TransportTCP {
+		return
+	}
+	s := m.tcp
+	s.Lock()
+	node := s.nodes[c.IP.String()]
+	s.Unlock()
+	if node == nil || !node.supports(CommandSwimPing) {
+		return
+	}
+	update := memberUpdate{IP: c.IP.String(), State: MemberAlive}
+	if !c.PeerID.IsEmpty() {
+		update.NodeID = c.PeerID.String()
+	}
+	m.Lock()
+	var events []MemberEvent
+	if m.members[update.IP] == nil {
+		events = m.apply(update, m.tcp.Transport.Now())
+	}
+	m.Unlock()
+	m.emit(events)
+}
+
+func (m *Membership) onPing(c *Context) {
+	message, ok := m.receive(c)
+	if !ok {
+		return
+	}
+	m.send(c.IP.String(), CommandSwimAck, swimMessage{Seq: message.Seq, Target: message.Target})
+}
+
+func (m *Membership) onPingReq(c *Context) {
+	message, ok := m.receive(c)
+	if !ok || message.Target == "" || message.Target == c.IP.String() {
+		return
+	}
+	m.Lock()
+	m.seq++
+	seq := m.seq
+	m.relays[seq] = swimRelay{requester: c.IP.String(), seq: message.Seq, target: message.Target, sent: m.tcp.Transport.Now()}
+	m.Unlock()
+	if !m.send(message.Target, CommandSwimPing, swimMessage{Seq: seq}) {
+		m.Lock()
+		delete(m.relays, seq)
+		m.Unlock()
+	}
+}
+
+func (m *Membership) onAck(c *Context) {
+	message, ok := m.receive(c)
+	if !ok {
+		return
+	}
+	from := c.IP.String()
+	m.Lock()
+	relay, relayed := m.relays[message.Seq]
+	if relayed && relay.target == from {
+		delete(m.relays, message.Seq)
+		m.Unlock()
+		m.send(relay.requester, CommandSwimAck, swimMessage{Seq: relay.seq, Target: from})
+		return
+	}
+	target := from
+	if message.Target != "" {
+		target = message.Target
+	}
+	if probe := m.probe; probe != nil && probe.seq == message.Seq && probe.target == target {
+		probe.acked = true
+	}
+	m.Unlock()
+}
+
+// apply an update under the lock, events of the changed member
+func (m *Membership) apply(update memberUpdate, now time.Time) []MemberEvent {
+	if update.IP == "" {
+		return nil
+	}
+	if update.IP == m.localIP() {
+		// refute a suspicion about this node with a higher incarnation
+		if update.State != MemberAlive && update.Incarnation >= m.incarnation {
+			m.incarnation = update.Incarnation + 1
+			logger.Info("SWIM refute suspicion", "state", update.State, "incarnation", m.incarnation)
+			m.enqueue(memberUpdate{IP: update.IP, NodeID: LocalNodeID().String(), State: MemberAlive, Incarnation: m.incarnation})
+		}
+		return nil
+	}
+	member := m.members[update.IP]
+	if member == nil {
+		if update.State == MemberDead {
+			return nil
+		}
+		member = &Member{IP: update.IP, NodeID: update.NodeID, State: update.State, Incarnation: update.Incarnation, Since: now}
+		m.members[update.IP] = member
+		m.enqueue(update)
+		return []MemberEvent{{Member: *member}}
+	}
+	if !overrides(update, member) {
+		return nil
+	}
+	previous := member.State
+	if update.NodeID != "" {
+		member.NodeID = update.NodeID
+	}
+	member.Incarnation = update.Incarnation
+	if member.State != update.State {
+		member.State = update.State
+		member.Since = now
+	}
+	update.NodeID = member.NodeID
+	m.enqueue(update)
+	if previous == member.State {
+		return nil
+	}
+	return []MemberEvent{{Member: *member, Previous: previous}}
+}
+
+// overrides SWIM precedence, a higher incarnation wins, on equal ones
+// suspect beats alive and dead beats both
+func overrides(update memberUpdate, member *Member) bool {
+	switch update.State {
+	case MemberAlive:
+		return update.Incarnation > member.Incarnation
+	case MemberSuspect:
+		if member.State == MemberDead {
+			return update.Incarnation > member.Incarnation
+		}
+		return update.Incarnation > member.Incarnation || (update.Incarnation == member.Incarnation && member.State == MemberAlive)
+	case MemberDead:
+		return member.State != MemberDead || update.Incarnation > member.Incarnation
+	}
+	return false
+}
+
+// enqueue an update for dissemination, it replaces older news of the member
+func (m *Membership) enqueue(update memberUpdate) {
+	for _, gossip := range m.gossip {
+		if gossip.update.IP == update.IP {
+			gossip.update, gossip.sent = update, 0
+			return
+		}
+	}
+	m.gossip = append(m.gossip, &swimGossip{update: update})
+}
+
+// emit events outside the lock
+func (m *Membership) emit(events []MemberEvent) {
+	if len(events) == 0 {
+		return
+	}
+	m.Lock()
+	handlers := append([]MemberHandler(nil), m.handlers...)
+	m.Unlock()
+	for _, event := range events {
+		for _, handler := range handlers {
+			handler(event)
+		}
+	}
+}
+
+// Members the membership view, nil unless NewMembership runs on s
+func (s *TcpServer) Members() []Member {
+	s.Lock()
+	m := s.membership
+	s.Unlock()
+	if m == nil {
+		return nil
+	}
+	return m.Members()
+}
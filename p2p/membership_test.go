@@ -0,0 +1,223 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startSwimNode a mem node running the membership protocol, each on its own
+// subnet so only static peers connect
+func startSwimNode(network *MemNetwork, ip string) (*TcpServer, *Membership) {
+	var m *Membership
+	tcp := startMemNode(network, ip, 10000, func(tcp *TcpServer) { m = NewMembership(tcp) })
+	return tcp, m
+}
+
+func memberState(m *Membership, ip string) MemberState {
+	member, _ := m.Member(ip)
+	return member.State
+}
+
+func TestMembership(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	network := NewMemNetwork(1)
+	defer network.Close()
+	clock := network.Clock()
+
+	// c is only connected to b, a learns of it from the gossip
+	a, ma := startSwimNode(network, "10.0.1.1")
+	b, mb := startSwimNode(network, "10.0.2.2")
+	c, _ := startSwimNode(network, "10.0.3.3")
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	a.Dialer.AddStatic("10.0.2.2")
+	c.Dialer.AddStatic("10.0.2.2")
+	var lock sync.Mutex
+	var events []MemberEvent
+	ma.OnChange(func(event MemberEvent) {
+		lock.Lock()
+		events = append(events, event)
+		lock.Unlock()
+	})
+	offline := make(chan string, 4)
+	a.handler.RegisterEventHandler(NodeRemoveHandler, func(c *Context) { offline <- c.IP.String() })
+
+	assert.True(t, advanceUntil(clock, 100*time.Millisecond, 100, func() bool {
+		return len(ma.Members()) == 3 && len(mb.Members()) == 3
+	}))
+	// indirect probes through b keep c alive on a
+	for i := 0; i < 20; i++ {
+		clock.Advance(swimPeriodTime * time.Millisecond)
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, MemberAlive, memberState(ma, "10.0.3.3"))
+	assert.Equal(t, []string{"10.0.1.1", "10.0.2.2", "10.0.3.3"}, memberIPs(ma.Members()))
+
+	// c is cut off, a and b agree it is dead
+	network.Partition([]net.IP{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.2.2")}, []net.IP{net.ParseIP("10.0.3.3")})
+	assert.True(t, advanceUntil(clock, 100*time.Millisecond, 400, func() bool {
+		return memberState(ma, "10.0.3.3") == MemberDead && memberState(mb, "10.0.3.3") == MemberDead
+	}))
+	assert.Equal(t, MemberAlive, memberState(ma, "10.0.2.2"))
+	lock.Lock()
+	var states []MemberState
+	for _, event := range events {
+		if event.Member.IP == "10.0.3.3" {
+			states = append(states, event.Member.State)
+		}
+	}
+	lock.Unlock()
+	assert.Equal(t, MemberAlive, states[0])
+	assert.Equal(t, MemberDead, states[len(states)-1])
+	// a never had a connection to c, b has the offline event
+	select {
+	case ip := <-offline:
+		t.Fatalf("unexpected offline event %s", ip)
+	default:
+	}
+}
+
+func memberIPs(members []Member) (ips []string) {
+	for _, member := range members {
+		ips = append(ips, member.IP)
+	}
+	return ips
+}
+
+func TestMembership_Apply(t *testing.T) {
+	network := NewMemNetwork(1)
+	defer network.Close()
+	tcp := NewTCPServer(10001, NewEventHandler(nil))
+	tcp.Transport = network.Host(net.ParseIP("10.0.0.1"))
+	m := &Membership{tcp: tcp, members: map[string]*Member{}, relays: map[uint32]swimRelay{}}
+	now := tcp.Transport.Now()
+
+	events := m.apply(memberUpdate{IP: "10.0.0.2", State: MemberAlive, Incarnation: 1}, now)
+	assert.Equal(t, []MemberEvent{{Member: Member{IP: "10.0.0.2", State: MemberAlive, Incarnation: 1, Since: now}}}, events)
+	// an older or equal alive does not override
+	assert.Empty(t, m.apply(memberUpdate{IP: "10.0.0.2", State: MemberAlive, Incarnation: 1}, now))
+	events = m.apply(memberUpdate{IP: "10.0.0.2", State: MemberSuspect, Incarnation: 1}, now)
+	assert.Equal(t, MemberAlive, events[0].Previous)
+	assert.Empty(t, m.apply(memberUpdate{IP: "10.0.0.2", State: MemberAlive, Incarnation: 1}, now))
+	events = m.apply(memberUpdate{IP: "10.0.0.2", State: MemberAlive, Incarnation: 2}, now)
+	assert.Equal(t, MemberSuspect, events[0].Previous)
+	events = m.apply(memberUpdate{IP: "10.0.0.2", State: MemberDead, Incarnation: 2}, now)
+	assert.Equal(t, MemberDead, events[0].Member.State)
+	assert.Empty(t, m.apply(memberUpdate{IP: "10.0.0.2", State: MemberSuspect, Incarnation: 2}, now))
+	// unknown dead members are not added
+	assert.Empty(t, m.apply(memberUpdate{IP: "10.0.0.3", State: MemberDead}, now))
+	_, ok := m.Member("10.0.0.3")
+	assert.False(t, ok)
+
+	// a suspicion about this node is refuted with a higher incarnation
+	assert.Empty(t, m.apply(memberUpdate{IP: "10.0.0.1", State: MemberSuspect, Incarnation: 3}, now))
+	assert.Equal(t, uint64(4), m.incarnation)
+	updates := m.piggyback()
+	assert.Contains(t, updates, memberUpdate{IP: "10.0.0.1", NodeID: LocalNodeID().String(), State: MemberAlive, Incarnation: 4})
+	assert.Empty(t, m.apply(memberUpdate{IP: "10.0.0.1", State: MemberSuspect, Incarnation: 3}, now))
+	assert.Equal(t, uint64(4), m.incarnation)
+}
+
+func TestMembership_Gossip(t *testing.T) {
+	network := NewMemNetwork(1)
+	defer network.Close()
+	tcp := NewTCPServer(10001, NewEventHandler(nil))
+	tcp.Transport = network.Host(net.ParseIP("10.0.0.1"))
+	m := &Membership{tcp: tcp, members: map[string]*Member{}, relays: map[uint32]swimRelay{}}
+	tcp.Ban("10.0.0.9", time.Hour)
+	body, _ := json.Marshal(swimMessage{Updates: []memberUpdate{
+		{IP: "10.0.0.3", NodeID: "not an id", State: MemberAlive},
+		{IP: "127.0.0.1", State: MemberAlive},
+		{IP: "224.0.0.1", State: MemberAlive},
+		{IP: "not an ip", State: MemberAlive},
+		{IP: "10.0.0.9", State: MemberAlive},
+		{IP: "::ffff:10.0.0.4", State: MemberAlive},
+	}})
+	_, ok := m.receive(&Context{IP: net.ParseIP("10.0.0.2"), Transport: TransportTCP, Body: body})
+	assert.True(t, ok)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}, memberIPs(m.Members()))
+	member, _ := m.Member("10.0.0.3")
+	assert.Empty(t, member.NodeID)
+
+	// unknown members are capped, known ones still change
+	for i := len(m.members); i < swimMaxMembers; i++ {
+		m.members[fmt.Sprintf("10.1.%d.%d", i/256, i%256)] = &Member{State: MemberAlive}
+	}
+	body, _ = json.Marshal(swimMessage{Updates: []memberUpdate{
+		{IP: "10.0.0.5", State: MemberAlive},
+		{IP: "10.0.0.3", State: MemberSuspect},
+	}})
+	m.receive(&Context{IP: net.ParseIP("10.0.0.2"), Transport: TransportTCP, Body: body})
+	_, ok = m.Member("10.0.0.5")
+	assert.False(t, ok)
+	assert.Equal(t, MemberSuspect, memberState(m, "10.0.0.3"))
+}
+
+func TestMembership_Offline(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	network := NewMemNetwork(1)
+	defer network.Close()
+	clock := network.Clock()
+
+	// all connected, then a bans c and drops the link
+	a, ma := startSwimNode(network, "10.0.1.1")
+	b, mb := startSwimNode(network, "10.0.2.2")
+	c, _ := startSwimNode(network, "10.0.3.3")
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	a.Dialer.AddStatic("10.0.2.2")
+	a.Dialer.AddStatic("10.0.3.3")
+	c.Dialer.AddStatic("10.0.2.2")
+	offline := make(chan string, 4)
+	a.handler.RegisterEventHandler(NodeRemoveHandler, func(c *Context) { offline <- c.IP.String() })
+	assert.True(t, advanceUntil(clock, 100*time.Millisecond, 100, func() bool {
+		return len(ma.Members()) == 3 && len(mb.Members()) == 3 && len(a.OnlineIPs()) == 2
+	}))
+
+	// c stays alive through b, a still gets the offline event of the link
+	assert.NoError(t, a.Ban("10.0.3.3", time.Hour))
+	assert.Equal(t, "10.0.3.3", waitEvent(clock, offline, 100*time.Millisecond, 400))
+	assert.Equal(t, MemberAlive, memberState(ma, "10.0.3.3"))
+}
+
+func TestMembership_CloseProbe(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	network := NewMemNetwork(1)
+	defer network.Close()
+	clock := network.Clock()
+
+	a, ma := startSwimNode(network, "10.0.1.1")
+	b, _ := startSwimNode(network, "10.0.2.2")
+	a.Dialer.AddStatic("10.0.2.2")
+	assert.True(t, advanceUntil(clock, 100*time.Millisecond, 100, func() bool {
+		return len(ma.Members()) == 2
+	}))
+
+	// a probe waiting for its timeout stops with the server
+	clock.Advance(swimPeriodTime * time.Millisecond)
+	a.Close()
+	b.Close()
+	<-a.done
+	<-b.done
+	timers := func() int {
+		clock.Lock()
+		defer clock.Unlock()
+		return len(clock.timers) + len(clock.fired)
+	}
+	for i := 0; i < 100 && timers() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 0, timers())
+}
@@ -0,0 +1,709 @@
+package p2p
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemNetwork in-memory network with configurable latency, packet loss and
+// partitions, all hosts share a virtual clock so tests are deterministic
+type MemNetwork struct {
+	clock   *VirtualClock
+	latency time.Duration
+	loss    float64
+	rand    *rand.Rand
+	hosts   map[string]*MemTransport
+	groups  map[string]int
+	done    chan struct{}
+	once    sync.Once
+	sync.Mutex
+}
+
+// MemTransport Transport of one host in a MemNetwork
+type MemTransport struct {
+	network   *MemNetwork
+	ip        net.IP
+	nextPort  int
+	listeners map[int]*memListener
+	packets   map[int]*memPacketConn
+	sync.Mutex
+}
+
+var errMemClosed = errors.New("use of closed memory connection")
+
+var errMemNetworkClosed = errors.New("memory network closed")
+
+var errMemPartitioned = errors.New("connection reset by partition")
+
+type memTimeoutError struct{}
+
+func (memTimeoutError) Error() string   { return "i/o timeout" }
+func (memTimeoutError) Timeout() bool   { return true }
+func (memTimeoutError) Temporary() bool { return true }
+
+// memEpoch start of the virtual clock, late enough that deadlines set in
+// the past to abort a read, as net/http does, are already expired
+var memEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// settleIdleRounds yields with nothing in flight before time moves on,
+// goroutines just started get to reach the network
+const settleIdleRounds = 64
+
+func NewMemNetwork(seed int64) *MemNetwork {
+	return &MemNetwork{
+		clock:  NewVirtualClock(memEpoch),
+		rand:   rand.New(rand.NewSource(seed)),
+		hosts:  map[string]*MemTransport{},
+		groups: map[string]int{},
+		done:   make(chan struct{}),
+	}
+}
+
+// Close fail dials waiting on the network, streams and packets already
+// delivered stay readable
+func (n *MemNetwork) Close() {
+	n.once.Do(func() { close(n.done) })
+}
+
+func (n *MemNetwork) isClosed() bool {
+	select {
+	case <-n.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *MemNetwork) Clock() *VirtualClock {
+	return n.clock
+}
+
+// SetLatency one way delay of every stream write and packet
+func (n *MemNetwork) SetLatency(latency time.Duration) {
+	n.Lock()
+	n.latency = latency
+	n.Unlock()
+}
+
+// SetLoss probability of dropping a packet, streams are not affected
+func (n *MemNetwork) SetLoss(loss float64) {
+	n.Lock()
+	n.loss = loss
+	n.Unlock()
+}
+
+// Partition split hosts into groups that can not reach each other,
+// hosts not listed stay reachable from the first group only
+func (n *MemNetwork) Partition(groups ...[]net.IP) {
+	n.Lock()
+	defer n.Unlock()
+	n.groups = map[string]int{}
+	for i, group := range groups {
+		for _, ip := range group {
+			n.groups[ip.String()] = i
+		}
+	}
+}
+
+// Heal remove all partitions
+func (n *MemNetwork) Heal() {
+	n.Partition()
+}
+
+// Host transport of ip, created on first use
+func (n *MemNetwork) Host(ip net.IP) *MemTransport {
+	n.Lock()
+	defer n.Unlock()
+	host := n.hosts[ip.String()]
+	if host == nil {
+		host = &MemTransport{
+			network:   n,
+			ip:        ip.To4(),
+			nextPort:  50000,
+			listeners: map[int]*memListener{},
+			packets:   map[int]*memPacketConn{},
+		}
+		n.hosts[ip.String()] = host
+	}
+	return host
+}
+
+func (n *MemNetwork) reachable(a, b net.IP) bool {
+	n.Lock()
+	defer n.Unlock()
+	return n.groups[a.String()] == n.groups[b.String()]
+}
+
+func (n *MemNetwork) deliverAt() time.Time {
+	n.Lock()
+	defer n.Unlock()
+	return n.clock.Now().Add(n.latency)
+}
+
+func (n *MemNetwork) lost() bool {
+	n.Lock()
+	defer n.Unlock()
+	return n.loss > 0 && n.rand.Float64() < n.loss
+}
+
+func (n *MemNetwork) host(ip net.IP) *MemTransport {
+	n.Lock()
+	defer n.Unlock()
+	return n.hosts[ip.String()]
+}
+
+func (t *MemTransport) Now() time.Time {
+	return t.network.clock.Now()
+}
+
+func (t *MemTransport) stop(ch <-chan time.Time) {
+	t.network.clock.stop(ch)
+}
+
+func (t *MemTransport) After(d time.Duration) <-chan time.Time {
+	return t.network.clock.After(d)
+}
+
+func (t *MemTransport) LocalIP() net.IP {
+	return t.ip
+}
+
+func (t *MemTransport) BroadcastIPs() ([]net.IP, error) {
+	return []net.IP{net.IPv4(t.ip[0], t.ip[1], t.ip[2], 255).To4()}, nil
+}
+
+func (t *MemTransport) Listen(port int) (net.Listener, error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.listeners[port] != nil {
+		return nil, errors.New("address already in use")
+	}
+	listener := &memListener{host: t, addr: &net.TCPAddr{IP: t.ip, Port: port}, conns: make(chan net.Conn, 16), done: make(chan struct{})}
+	t.listeners[port] = listener
+	t.network.clock.track(listener)
+	return listener, nil
+}
+
+// Dial an unreachable host times out on the virtual clock or fails when
+// the network is closed
+func (t *MemTransport) Dial(addr *net.TCPAddr, timeout time.Duration) (net.Conn, error) {
+	if t.network.isClosed() {
+		return nil, errMemNetworkClosed
+	}
+	host := t.network.host(addr.IP)
+	if host == nil || !t.network.reachable(t.ip, addr.IP) {
+		clock := t.network.clock
+		wait := clock.After(timeout)
+		defer clock.stop(wait)
+		select {
+		case <-wait:
+			return nil, memTimeoutError{}
+		case <-t.network.done:
+			return nil, errMemNetworkClosed
+		}
+	}
+	host.Lock()
+	listener := host.listeners[addr.Port]
+	host.Unlock()
+	if listener == nil {
+		return nil, errors.New("connection refused")
+	}
+	t.Lock()
+	t.nextPort++
+	local := &net.TCPAddr{IP: t.ip, Port: t.nextPort}
+	t.Unlock()
+	client := newMemConn(t.network, local, addr)
+	server := newMemConn(t.network, addr, local)
+	client.peer, server.peer = server, client
+	select {
+	case listener.conns <- server:
+		t.network.clock.touch()
+		return client, nil
+	case <-listener.done:
+		return nil, errors.New("connection refused")
+	}
+}
+
+func (t *MemTransport) ListenPacket(port int) (net.PacketConn, error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.packets[port] != nil {
+		return nil, errors.New("address already in use")
+	}
+	conn := &memPacketConn{host: t, addr: &net.UDPAddr{IP: t.ip, Port: port}, queue: newMemQueue(t.network.clock)}
+	t.packets[port] = conn
+	return conn, nil
+}
+
+type memListener struct {
+	host    *MemTransport
+	addr    *net.TCPAddr
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+	waiting bool
+	sync.Mutex
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	l.setWaiting(true)
+	defer l.setWaiting(false)
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errMemClosed
+	}
+}
+
+func (l *memListener) setWaiting(waiting bool) {
+	l.Lock()
+	l.waiting = waiting
+	l.Unlock()
+	l.host.network.clock.touch()
+}
+
+// pending a dialed conn waits for the accepting goroutine
+func (l *memListener) pending(now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.waiting && len(l.conns) > 0
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		l.host.Lock()
+		delete(l.host.listeners, l.addr.Port)
+		l.host.Unlock()
+		l.host.network.clock.untrack(l)
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+type memChunk struct {
+	data []byte
+	from *net.UDPAddr
+	at   time.Time
+}
+
+// memQueue ordered data waiting to become visible on the virtual clock,
+// visible data is in flight while a reader waits for it
+type memQueue struct {
+	clock        *VirtualClock
+	chunks       []memChunk
+	closed       bool
+	waiting      bool
+	readDeadline time.Time
+	notify       chan struct{}
+	sync.Mutex
+}
+
+func newMemQueue(clock *VirtualClock) *memQueue {
+	q := &memQueue{clock: clock, notify: make(chan struct{}, 1)}
+	clock.track(q)
+	return q
+}
+
+func (q *memQueue) push(chunk memChunk) {
+	q.Lock()
+	if !q.closed {
+		q.chunks = append(q.chunks, chunk)
+	}
+	q.Unlock()
+	q.clock.touch()
+	q.wake()
+}
+
+// pending visible data not yet taken by the waiting reader
+func (q *memQueue) pending(now time.Time) bool {
+	q.Lock()
+	defer q.Unlock()
+	return !q.closed && q.waiting && len(q.chunks) > 0 && !q.chunks[0].at.After(now)
+}
+
+func (q *memQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next wait for the first visible chunk, stream merges contiguous chunks
+func (q *memQueue) next(b []byte, stream bool) (n int, from *net.UDPAddr, err error) {
+	defer q.clock.touch()
+	for {
+		q.Lock()
+		now := q.clock.Now()
+		if len(q.chunks) > 0 && !q.chunks[0].at.After(now) {
+			chunk := q.chunks[0]
+			n = copy(b, chunk.data)
+			if stream && n < len(chunk.data) {
+				q.chunks[0].data = chunk.data[n:]
+			} else {
+				q.chunks = q.chunks[1:]
+			}
+			q.waiting = false
+			q.Unlock()
+			return n, chunk.from, nil
+		}
+		q.waiting = false
+		if q.closed {
+			q.Unlock()
+			return 0, nil, io.EOF
+		}
+		if !q.readDeadline.IsZero() && !now.Before(q.readDeadline) {
+			q.Unlock()
+			return 0, nil, memTimeoutError{}
+		}
+		var until time.Time
+		if len(q.chunks) > 0 {
+			until = q.chunks[0].at
+		}
+		if !q.readDeadline.IsZero() && (until.IsZero() || q.readDeadline.Before(until)) {
+			until = q.readDeadline
+		}
+		var wait <-chan time.Time
+		if !until.IsZero() {
+			wait = q.clock.After(until.Sub(now))
+		}
+		q.waiting = true
+		q.Unlock()
+		q.clock.touch()
+		select {
+		case <-q.notify:
+		case <-wait:
+		}
+		if wait != nil {
+			q.clock.stop(wait)
+		}
+	}
+}
+
+func (q *memQueue) setReadDeadline(t time.Time) {
+	q.Lock()
+	q.readDeadline = t
+	q.Unlock()
+	q.wake()
+}
+
+func (q *memQueue) close() {
+	q.Lock()
+	q.closed = true
+	q.waiting = false
+	q.Unlock()
+	q.clock.untrack(q)
+	q.wake()
+}
+
+type memConn struct {
+	network *MemNetwork
+	local   *net.TCPAddr
+	remote  *net.TCPAddr
+	peer    *memConn
+	queue   *memQueue
+	closed  bool
+	sync.Mutex
+}
+
+func newMemConn(network *MemNetwork, local, remote *net.TCPAddr) *memConn {
+	return &memConn{network: network, local: local, remote: remote, queue: newMemQueue(network.clock)}
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	n, _, err := c.queue.next(b, true)
+	return n, err
+}
+
+// Write never blocks, a write across a partition resets the connection
+// so no stream bytes are silently lost
+func (c *memConn) Write(b []byte) (int, error) {
+	c.Lock()
+	closed := c.closed
+	c.Unlock()
+	if closed {
+		return 0, errMemClosed
+	}
+	if !c.network.reachable(c.local.IP, c.remote.IP) {
+		c.Close()
+		return 0, errMemPartitioned
+	}
+	c.peer.queue.push(memChunk{data: append([]byte{}, b...), at: c.network.deliverAt()})
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	c.Lock()
+	c.closed = true
+	c.Unlock()
+	c.queue.close()
+	c.peer.queue.close()
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr                { return c.local }
+func (c *memConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.queue.setReadDeadline(t)
+	return nil
+}
+func (c *memConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+type memPacketConn struct {
+	host  *MemTransport
+	addr  *net.UDPAddr
+	queue *memQueue
+}
+
+func (c *memPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, err := c.queue.next(b, false)
+	if err != nil {
+		return n, nil, err
+	}
+	return n, from, nil
+}
+
+// WriteTo deliver to one host or every host of the /24 for broadcast
+func (c *memPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("invalid udp addr")
+	}
+	var hosts []*MemTransport
+	if ip := dst.IP.To4(); ip != nil && ip[3] == 255 {
+		c.host.network.Lock()
+		for _, host := range c.host.network.hosts {
+			if host.ip[0] == ip[0] && host.ip[1] == ip[1] && host.ip[2] == ip[2] {
+				hosts = append(hosts, host)
+			}
+		}
+		c.host.network.Unlock()
+		sort.Slice(hosts, func(i, j int) bool { return hosts[i].ip.String() < hosts[j].ip.String() })
+	} else if host := c.host.network.host(dst.IP); host != nil {
+		hosts = append(hosts, host)
+	}
+	for _, host := range hosts {
+		if !c.host.network.reachable(c.host.ip, host.ip) || c.host.network.lost() {
+			continue
+		}
+		host.Lock()
+		conn := host.packets[dst.Port]
+		host.Unlock()
+		if conn != nil {
+			conn.queue.push(memChunk{data: append([]byte{}, b...), from: c.addr, at: c.host.network.deliverAt()})
+		}
+	}
+	return len(b), nil
+}
+
+func (c *memPacketConn) Close() error {
+	c.host.Lock()
+	delete(c.host.packets, c.addr.Port)
+	c.host.Unlock()
+	c.queue.close()
+	return nil
+}
+
+func (c *memPacketConn) LocalAddr() net.Addr                { return c.addr }
+func (c *memPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *memPacketConn) SetReadDeadline(t time.Time) error {
+	c.queue.setReadDeadline(t)
+	return nil
+}
+func (c *memPacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// VirtualClock time only moves when Advance is called, before it moves the
+// clock settles the work of the current instant: fired timers are received,
+// delivered data is read and accepted conns are taken. Work is counted, not
+// timed: a fired timer is in flight until it is received or stopped, data
+// and conns while a reader waits for them. A timer fired in an earlier
+// Advance has a reader blocked outside the network and is not waited for
+type VirtualClock struct {
+	now     time.Time
+	epoch   uint64
+	timers  []*virtualTimer
+	fired   []*virtualTimer
+	work    map[memWork]bool
+	changed chan struct{}
+	sync.Mutex
+}
+
+type virtualTimer struct {
+	at      time.Time
+	ch      chan time.Time
+	epoch   uint64
+	stopped chan struct{}
+}
+
+// memWork network state the clock waits for
+type memWork interface {
+	pending(now time.Time) bool
+}
+
+func NewVirtualClock(now time.Time) *VirtualClock {
+	return &VirtualClock{now: now, work: map[memWork]bool{}, changed: make(chan struct{}, 1)}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// After the channel is unbuffered so the clock knows when a fired timer is
+// received, a timer no longer received from must be stopped
+func (c *VirtualClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	if d <= 0 {
+		ch := make(chan time.Time, 1)
+		ch <- c.now
+		return ch
+	}
+	ch := make(chan time.Time)
+	c.timers = append(c.timers, &virtualTimer{at: c.now.Add(d), ch: ch, stopped: make(chan struct{})})
+	return ch
+}
+
+// stop forget a timer whose channel is no longer received from
+func (c *VirtualClock) stop(ch <-chan time.Time) {
+	defer c.touch()
+	c.Lock()
+	defer c.Unlock()
+	for i, timer := range c.timers {
+		if timer.ch == ch {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+	for i, timer := range c.fired {
+		if timer.ch == ch {
+			close(timer.stopped)
+			c.fired = append(c.fired[:i], c.fired[i+1:]...)
+			return
+		}
+	}
+}
+
+// fire hand the time to the reader of a timer, the timer stays in flight
+// until it is received or stopped
+func (c *VirtualClock) fire(timer *virtualTimer, at time.Time) {
+	timer.epoch = c.epoch
+	c.fired = append(c.fired, timer)
+	go func() {
+		select {
+		case timer.ch <- at:
+		case <-timer.stopped:
+			return
+		}
+		c.Lock()
+		for i, fired := range c.fired {
+			if fired == timer {
+				c.fired = append(c.fired[:i], c.fired[i+1:]...)
+				break
+			}
+		}
+		c.Unlock()
+		c.touch()
+	}()
+}
+
+func (c *VirtualClock) track(work memWork) {
+	c.Lock()
+	c.work[work] = true
+	c.Unlock()
+}
+
+func (c *VirtualClock) untrack(work memWork) {
+	c.Lock()
+	delete(c.work, work)
+	c.Unlock()
+	c.touch()
+}
+
+// touch wake settle to count the work again
+func (c *VirtualClock) touch() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// inFlight timers fired and network work started in the current Advance
+func (c *VirtualClock) inFlight() int {
+	c.Lock()
+	now, epoch := c.now, c.epoch
+	count := 0
+	for _, timer := range c.fired {
+		if timer.epoch == epoch {
+			count++
+		}
+	}
+	work := make([]memWork, 0, len(c.work))
+	for w := range c.work {
+		work = append(work, w)
+	}
+	c.Unlock()
+	for _, w := range work {
+		if w.pending(now) {
+			count++
+		}
+	}
+	return count
+}
+
+// Advance move the clock forward, firing timers in order and settling the
+// work they cause before the next timer
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.Lock()
+	c.epoch++
+	end := c.now.Add(d)
+	c.Unlock()
+	for {
+		c.settle()
+		c.Lock()
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+		if len(c.timers) == 0 || c.timers[0].at.After(end) {
+			c.now = end
+			c.Unlock()
+			c.settle()
+			return
+		}
+		at := c.timers[0].at
+		if at.After(c.now) {
+			c.now = at
+		}
+		for len(c.timers) > 0 && !c.timers[0].at.After(at) {
+			c.fire(c.timers[0], at)
+			c.timers = c.timers[1:]
+		}
+		c.Unlock()
+	}
+}
+
+// settle wait until no work is in flight, every change of the network
+// wakes it to count again
+func (c *VirtualClock) settle() {
+	for idle := 0; idle < settleIdleRounds; idle++ {
+		for c.inFlight() > 0 {
+			idle = 0
+			<-c.changed
+		}
+		runtime.Gosched()
+	}
+}
@@ -0,0 +1,241 @@
+package p2p
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// start UDP and TCP servers of one host on the memory network, setup runs
+// before they start, closing the TCP server closes the UDP server
+func startMemNode(network *MemNetwork, ip string, port int, setup ...func(tcp *TcpServer)) *TcpServer {
+	handler := NewEventHandler(nil)
+	host := network.Host(net.ParseIP(ip))
+	udpServer := NewUDPServer(port, handler)
+	udpServer.SetTransport(host)
+	tcpServer := NewTCPServer(port+1, handler)
+	tcpServer.Transport = host
+	udpServer.BindTCP(tcpServer)
+	for _, fn := range setup {
+		fn(tcpServer)
+	}
+	go tcpServer.Start()
+	go udpServer.Start()
+	go func() {
+		<-tcpServer.done
+		udpServer.Close()
+	}()
+	return tcpServer
+}
+
+func waitEvent(clock *VirtualClock, events chan string, step time.Duration, steps int) string {
+	for i := 0; i < steps; i++ {
+		select {
+		case ev := <-events:
+			return ev
+		default:
+		}
+		clock.Advance(step)
+	}
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(100 * time.Millisecond):
+		return ""
+	}
+}
+
+// advance the clock by step until done returns true
+func advanceUntil(clock *VirtualClock, step time.Duration, steps int, done func() bool) bool {
+	for i := 0; i < steps; i++ {
+		clock.Advance(step)
+		if done() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMemConn_Latency(t *testing.T) {
+	network := NewMemNetwork(1)
+	defer network.Close()
+	network.SetLatency(100 * time.Millisecond)
+	server := network.Host(net.ParseIP("10.0.0.1"))
+	client := network.Host(net.ParseIP("10.0.0.2"))
+
+	listener, err := server.Listen(9000)
+	assert.NoError(t, err)
+	_, err = server.Listen(9000)
+	assert.Error(t, err)
+	conn, err := client.Dial(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9000}, time.Second)
+	assert.NoError(t, err)
+	accepted, err := listener.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2:50001", accepted.RemoteAddr().String())
+
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	accepted.SetReadDeadline(network.Clock().Now().Add(50 * time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(accepted, make([]byte, 5))
+		done <- err
+	}()
+	network.Clock().Advance(60 * time.Millisecond)
+	err = <-done
+	assert.Error(t, err)
+	assert.True(t, err.(net.Error).Timeout())
+
+	accepted.SetReadDeadline(time.Time{})
+	buf := make([]byte, 5)
+	go func() {
+		_, err := io.ReadFull(accepted, buf)
+		done <- err
+	}()
+	network.Clock().Advance(50 * time.Millisecond)
+	assert.NoError(t, <-done)
+	assert.Equal(t, "hello", string(buf))
+
+	conn.Close()
+	_, err = accepted.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	_, err = conn.Write(buf)
+	assert.Error(t, err)
+}
+
+func TestMemConn_Partition(t *testing.T) {
+	network := NewMemNetwork(1)
+	defer network.Close()
+	listener, _ := network.Host(net.ParseIP("10.0.0.1")).Listen(9000)
+	defer listener.Close()
+	conn, err := network.Host(net.ParseIP("10.0.0.2")).Dial(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9000}, time.Second)
+	assert.NoError(t, err)
+	accepted, _ := listener.Accept()
+
+	// a write across a partition resets the stream instead of losing bytes
+	network.Partition([]net.IP{net.ParseIP("10.0.0.1")}, []net.IP{net.ParseIP("10.0.0.2")})
+	n, err := conn.Write([]byte("lost"))
+	assert.Equal(t, errMemPartitioned, err)
+	assert.Equal(t, 0, n)
+	_, err = accepted.Read(make([]byte, 4))
+	assert.Equal(t, io.EOF, err)
+	network.Heal()
+	_, err = conn.Write([]byte("after"))
+	assert.Equal(t, errMemClosed, err)
+}
+
+func TestMemPacketConn_LossAndPartition(t *testing.T) {
+	network := NewMemNetwork(1)
+	defer network.Close()
+	a, _ := network.Host(net.ParseIP("10.0.0.1")).ListenPacket(9000)
+	b, _ := network.Host(net.ParseIP("10.0.0.2")).ListenPacket(9000)
+	c, _ := network.Host(net.ParseIP("10.0.1.3")).ListenPacket(9000)
+
+	// broadcast reaches the /24 only
+	_, err := a.WriteTo([]byte("discovery"), &net.UDPAddr{IP: net.ParseIP("10.0.0.255"), Port: 9000})
+	assert.NoError(t, err)
+	buf := make([]byte, 64)
+	n, from, err := b.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "discovery", string(buf[:n]))
+	assert.Equal(t, "10.0.0.1:9000", from.String())
+	c.SetReadDeadline(network.Clock().Now())
+	_, _, err = c.ReadFrom(buf)
+	assert.Error(t, err)
+
+	network.Partition([]net.IP{net.ParseIP("10.0.0.1")}, []net.IP{net.ParseIP("10.0.0.2")})
+	a.WriteTo([]byte("lost"), b.LocalAddr())
+	network.Heal()
+	a.WriteTo([]byte("after"), b.LocalAddr())
+	n, _, err = b.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "after", string(buf[:n]))
+
+	network.SetLoss(1)
+	a.WriteTo([]byte("dropped"), b.LocalAddr())
+	b.SetReadDeadline(network.Clock().Now())
+	_, _, err = b.ReadFrom(buf)
+	assert.Error(t, err)
+}
+
+func TestMemNetwork_Nodes(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	network := NewMemNetwork(1)
+	defer network.Close()
+	clock := network.Clock()
+
+	events := make(chan string, 64)
+	a := startMemNode(network, "10.0.0.1", 10000)
+	defer a.Close()
+	a.handler.RegisterEventHandler(NodeDiscoveryHandler, func(c *Context) {
+		events <- "online " + c.IP.String()
+	})
+	a.handler.RegisterEventHandler(NodeRemoveHandler, func(c *Context) {
+		events <- "offline " + c.IP.String()
+	})
+	b := startMemNode(network, "10.0.0.2", 10000)
+	defer b.Close()
+
+	assert.Equal(t, "online 10.0.0.2", waitEvent(clock, events, time.Second, 10))
+
+	network.Partition([]net.IP{net.ParseIP("10.0.0.1")}, []net.IP{net.ParseIP("10.0.0.2")})
+	for ev := waitEvent(clock, events, time.Second, 20); ev != "offline 10.0.0.2"; ev = waitEvent(clock, events, time.Second, 20) {
+		assert.Equal(t, "online 10.0.0.2", ev)
+	}
+}
+
+func TestMemTransport_DialClosed(t *testing.T) {
+	network := NewMemNetwork(1)
+	host := network.Host(net.ParseIP("10.0.0.1"))
+	network.Host(net.ParseIP("10.0.0.2"))
+	network.Partition([]net.IP{net.ParseIP("10.0.0.1")}, []net.IP{net.ParseIP("10.0.0.2")})
+
+	// an unreachable dial waits for the virtual clock or the network
+	errs := make(chan error, 1)
+	go func() {
+		_, err := host.Dial(&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 10001}, time.Hour)
+		errs <- err
+	}()
+	network.Clock().Advance(time.Second)
+	assert.Empty(t, errs)
+	network.Close()
+	assert.Equal(t, errMemNetworkClosed, <-errs)
+	_, err := host.Dial(&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 10001}, time.Hour)
+	assert.Equal(t, errMemNetworkClosed, err)
+}
+
+func TestVirtualClock_Settle(t *testing.T) {
+	network := NewMemNetwork(1)
+	defer network.Close()
+	server := network.Host(net.ParseIP("10.0.0.1"))
+	listener, _ := server.Listen(10001)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+	}()
+	conn, err := network.Host(net.ParseIP("10.0.0.2")).Dial(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 10001}, time.Second)
+	assert.NoError(t, err)
+
+	// every round trip happens within the instant, settled without sleeps
+	clock := network.Clock()
+	start := clock.Now()
+	buf := make([]byte, 1)
+	for i := 0; i < 100; i++ {
+		conn.Write([]byte{byte(i)})
+		clock.Advance(0)
+		conn.SetReadDeadline(clock.Now())
+		n, err := conn.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{byte(i)}, buf[:n])
+	}
+	assert.Equal(t, start, clock.Now())
+}
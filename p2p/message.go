@@ -6,15 +6,15 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"net"
-	"os"
 	"sync"
 )
 
 type Message interface {
 	encoding.BinaryMarshaler
 	UnmarshalBinary(data []byte) (bodyLen uint32, err error)
-	Handler(IP net.IP)
+	Handler(handler *EventHandler, c *Context)
 	SetBody(body []byte)
+	GetBody() (body []byte)
 	GetCommand() (command Command)
 	GetHeadLen() (len int)
 	NewMessage() Message
@@ -41,12 +41,25 @@ var msgId int16 = 0
 var newMsgMu = sync.Mutex{}
 
 func NewMsg(command Command, data []byte) (msg *Msg) {
+	return newRawMsg(command, compressByte(data))
+}
+
+// msgIDOf the message id in the head of message, 0 for other message types
+func msgIDOf(message Message) int16 {
+	if msg, ok := message.(*Msg); ok {
+		return msg.Head.MsgId
+	}
+	return 0
+}
+
+// newRawMsg builds a message without stripping whitespace from the body,
+// used by internal protocols whose bodies may carry arbitrary bytes
+func newRawMsg(command Command, data []byte) (msg *Msg) {
 	newMsgMu.Lock()
 	defer newMsgMu.Unlock()
 	msgId += 1
-	data = compressByte(data)
 	var tag int16 = NodeServer
-	if os.Getenv(NodeType) == Client {
+	if LocalRole() == Client {
 		tag = NodeClient
 	}
 	msg = &Msg{
@@ -68,7 +81,7 @@ func (msg *Msg) NewMessage() Message {
 
 func (msg *Msg) ResponseMessage(command Command, data []byte) Message {
 	var tag int16 = NodeServer
-	if os.Getenv(NodeType) == Client {
+	if LocalRole() == Client {
 		tag = NodeClient
 	}
 	return &Msg{
@@ -95,6 +108,10 @@ func (msg *Msg) SetBody(body []byte) {
 	msg.Body = body
 }
 
+func (msg *Msg) GetBody() (body []byte) {
+	return msg.Body
+}
+
 func (msg *Msg) MarshalBinary() (data []byte, err error) {
 	buf := bytes.NewBuffer(data)
 	for _, field := range []interface{}{msg.Head.Magic, msg.Head.Command, msg.Head.Tag, msg.Head.MsgId, msg.Head.Len, msg.Body} {
@@ -117,7 +134,8 @@ func (msg *Msg) UnmarshalBinary(headBt []byte) (bodyLen uint32, err error) {
 	return msg.Head.Len, nil
 }
 
-func (msg *Msg) Handler(IP net.IP) {
+// Handler dispatch to handler, c carries the connection details
+func (msg *Msg) Handler(handler *EventHandler, c *Context) {
 	var data struct {
 		NodeName string `json:"nodeName"`
 	}
@@ -126,17 +144,31 @@ func (msg *Msg) Handler(IP net.IP) {
 			return
 		}
 		if err := json.Unmarshal(msg.Body, &data); err != nil {
-			logger.Error("msg handler json unmarshal", "addr", IP, "err", err.Error())
+			logger.Error("msg handler json unmarshal", "addr", c.IP, "err", err.Error())
 			return
 		}
 		msg.Head.Command = NodeDiscoveryHandler
 	}
 
 	// handler
-	context := &Context{NodeName: data.NodeName, IP: IP, Tag: msg.Head.Tag, command: msg.Head.Command, Body: msg.Body}
-	tcpServer.handler.DoSomething(context)
+	c.NodeName = data.NodeName
+	c.Tag = msg.Head.Tag
+	c.command = msg.Head.Command
+	c.MsgID = msg.Head.MsgId
+	c.Body = msg.Body
+	handler.DoSomething(c)
 }
 
 func (msg *Msg) Log(IP net.IP, info string) {
 	logger.Debug(info, "addr", IP, "msg", MsgInfoKV[msg.Head.Command], "msgId", msg.Head.MsgId, "tag", NodeTagMap[msg.Head.Tag], "len", msg.Head.Len, "body", string(msg.Body))
 }
+
+// isAppCommand commands registered by applications, events are local only
+func isAppCommand(command Command) bool {
+	return command >= 50 && command != NodeDiscoveryHandler && command != NodeRemoveHandler
+}
+
+// isAppFrame application commands or a signed envelope wrapping one
+func isAppFrame(command Command) bool {
+	return isAppCommand(command) || command == CommandSigned
+}
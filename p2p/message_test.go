@@ -9,6 +9,7 @@ import (
 )
 
 func TestMsg_MarshalBinary(t *testing.T) {
+	msgId = 0
 	msg := NewMsg(CommandHeartbeat, nil)
 	data, err := msg.MarshalBinary()
 	assert.NoError(t, err)
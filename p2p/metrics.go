@@ -0,0 +1,84 @@
+package p2p
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TrafficStats frames and bytes through one transport
+type TrafficStats struct {
+	FramesIn  uint64 `json:"framesIn"`
+	FramesOut uint64 `json:"framesOut"`
+	BytesIn   uint64 `json:"bytesIn"`
+	BytesOut  uint64 `json:"bytesOut"`
+}
+
+// Metrics snapshot of the running node
+type Metrics struct {
+	NodeID      string       `json:"nodeId"`
+	Role        string       `json:"role"`
+	Uptime      float64      `json:"uptime"`
+	Peers       int          `json:"peers"`
+	OnlinePeers int          `json:"onlinePeers"`
+	Banned      int          `json:"banned"`
+	TCP         TrafficStats `json:"tcp"`
+	UDP         TrafficStats `json:"udp"`
+	WebSocket   TrafficStats `json:"websocket"`
+	Unix        TrafficStats `json:"unix"`
+	Replay      ReplayStats  `json:"replay"`
+}
+
+var tcpTraffic, udpTraffic, wsTraffic, unixTraffic TrafficStats
+
+var processStart = time.Now()
+
+// countFrame add a frame sent or received to the transport counters
+func countFrame(direction byte, transport string, n int) {
+	stats := &tcpTraffic
+	switch transport {
+	case TransportUDP:
+		stats = &udpTraffic
+	case TransportWebSocket:
+		stats = &wsTraffic
+	case TransportUnix:
+		stats = &unixTraffic
+	}
+	if direction == CaptureInbound {
+		atomic.AddUint64(&stats.FramesIn, 1)
+		atomic.AddUint64(&stats.BytesIn, uint64(n))
+	} else {
+		atomic.AddUint64(&stats.FramesOut, 1)
+		atomic.AddUint64(&stats.BytesOut, uint64(n))
+	}
+}
+
+func (t *TrafficStats) load() TrafficStats {
+	return TrafficStats{
+		FramesIn:  atomic.LoadUint64(&t.FramesIn),
+		FramesOut: atomic.LoadUint64(&t.FramesOut),
+		BytesIn:   atomic.LoadUint64(&t.BytesIn),
+		BytesOut:  atomic.LoadUint64(&t.BytesOut),
+	}
+}
+
+// Metrics peer counts, traffic since the process started and replay stats
+func (s *TcpServer) Metrics() Metrics {
+	metrics := Metrics{
+		NodeID:    LocalNodeID().String(),
+		Role:      LocalRole(),
+		Uptime:    time.Since(processStart).Seconds(),
+		Banned:    len(s.Bans()),
+		TCP:       tcpTraffic.load(),
+		UDP:       udpTraffic.load(),
+		WebSocket: wsTraffic.load(),
+		Unix:      unixTraffic.load(),
+		Replay:    s.handler.Replay().Stats(),
+	}
+	for _, peer := range s.Peers() {
+		metrics.Peers++
+		if peer.Online {
+			metrics.OnlinePeers++
+		}
+	}
+	return metrics
+}
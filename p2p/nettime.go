@@ -0,0 +1,265 @@
+package p2p
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// timeReply NTP style fields of a heartbeat response, the timestamp of the
+// heartbeat it answers and when that heartbeat arrived, in milliseconds
+type timeReply struct {
+	Originate int64 `json:"orig,omitempty"`
+	Receive   int64 `json:"recv,omitempty"`
+}
+
+// newTimeReply the reply fields for a heartbeat that arrived at received,
+// empty when the heartbeat carries no timestamp
+func newTimeReply(heartbeat Message, received time.Time) timeReply {
+	var stamp heartbeatStamp
+	if err := json.Unmarshal(heartbeat.GetBody(), &stamp); err != nil || stamp.Timestamp == 0 {
+		return timeReply{}
+	}
+	return timeReply{Originate: stamp.Timestamp, Receive: toMillis(received)}
+}
+
+// PeerClock clock offset of a peer, positive when its clock is ahead
+type PeerClock struct {
+	IP      string        `json:"ip"`
+	Offset  time.Duration `json:"offset"`
+	RTT     time.Duration `json:"rtt"`
+	Updated time.Time     `json:"updated"`
+}
+
+// NetworkTimeInfo the local clock against the network estimate
+type NetworkTimeInfo struct {
+	Local   time.Time     `json:"local"`
+	Network time.Time     `json:"network"`
+	Offset  time.Duration `json:"offset"`
+	Peers   int           `json:"peers"`
+	Warning time.Duration `json:"warning"`
+	Clocks  []PeerClock   `json:"clocks,omitempty"`
+}
+
+// NetTime estimate the clock offset and round trip time of each peer from
+// heartbeats and their responses, the network time is the local clock
+// corrected by the median offset of the peers
+type NetTime struct {
+	now     func() time.Time
+	sent    map[string][]int64
+	peers   map[string]*peerClock
+	warning time.Duration
+	warned  bool
+	sync.Mutex
+}
+
+// peerClock the last samples of a peer, the one with the shortest round
+// trip is the least disturbed by queueing
+type peerClock struct {
+	samples []clockSample
+	updated time.Time
+}
+
+type clockSample struct {
+	offset time.Duration
+	rtt    time.Duration
+}
+
+func newNetTime(now func() time.Time) *NetTime {
+	return &NetTime{
+		now:     now,
+		sent:    map[string][]int64{},
+		peers:   map[string]*peerClock{},
+		warning: netTimeWarnOffset * time.Second,
+	}
+}
+
+// SetWarning log a warning when the local clock is off the network time by
+// more than d
+func (t *NetTime) SetWarning(d time.Duration) {
+	if d <= 0 {
+		panic("network time warning not empty")
+	}
+	t.Lock()
+	t.warning = d
+	t.warned = false
+	t.Unlock()
+}
+
+// record remember the timestamp of a heartbeat to ip, only responses to
+// these are sampled
+func (t *NetTime) record(ip string, timestamp int64) {
+	t.Lock()
+	pending := append(t.sent[ip], timestamp)
+	if len(pending) > netTimeMaxPending {
+		pending = pending[len(pending)-netTimeMaxPending:]
+	}
+	t.sent[ip] = pending
+	t.Unlock()
+}
+
+// forget drop the heartbeats sent to ip, its connection is gone
+func (t *NetTime) forget(ip string) {
+	t.Lock()
+	delete(t.sent, ip)
+	t.Unlock()
+}
+
+// sample a heartbeat response of ip that arrived at received
+func (t *NetTime) sample(ip string, body []byte, received time.Time) {
+	var reply struct {
+		heartbeatStamp
+		timeReply
+	}
+	if err := json.Unmarshal(body, &reply); err != nil || reply.Originate == 0 || reply.Receive == 0 || reply.Timestamp == 0 {
+		return
+	}
+	t1, t2, t3, t4 := reply.Originate, reply.Receive, reply.Timestamp, toMillis(received)
+	t.Lock()
+	defer t.Unlock()
+	pending := t.sent[ip]
+	found := -1
+	for i, timestamp := range pending {
+		if timestamp == t1 {
+			found = i
+			break
+		}
+	}
+	if found < 0 {
+		logger.Debug("network time drop unsolicited response", "addr", ip)
+		return
+	}
+	t.sent[ip] = pending[found+1:]
+	rtt := (t4 - t1) - (t3 - t2)
+	if rtt < 0 {
+		// below the millisecond resolution
+		rtt = 0
+	}
+	if rtt > netTimeMaxRTT {
+		return
+	}
+	clock := t.peers[ip]
+	if clock == nil {
+		clock = &peerClock{}
+		t.peers[ip] = clock
+	}
+	offset := ((t2 - t1) + (t3 - t4)) / 2
+	clock.samples = append(clock.samples, clockSample{offset: time.Duration(offset) * time.Millisecond, rtt: time.Duration(rtt) * time.Millisecond})
+	if len(clock.samples) > netTimeSamples {
+		clock.samples = clock.samples[len(clock.samples)-netTimeSamples:]
+	}
+	clock.updated = received
+	t.check()
+}
+
+// check warn once when the local clock leaves the threshold and again when
+// it is back, called with the lock held
+func (t *NetTime) check() {
+	offset, peers := t.offset()
+	if peers < netTimeMinPeers {
+		return
+	}
+	abs := offset
+	if abs < 0 {
+		abs = -abs
+	}
+	if abs > t.warning && !t.warned {
+		t.warned = true
+		logger.Warn("local clock diverges from network time", "offset", offset, "peers", peers, "threshold", t.warning)
+	} else if abs <= t.warning/2 && t.warned {
+		t.warned = false
+		logger.Info("local clock back in line with network time", "offset", offset, "peers", peers)
+	}
+}
+
+// best the sample with the shortest round trip
+func (clock *peerClock) best() clockSample {
+	best := clock.samples[0]
+	for _, sample := range clock.samples[1:] {
+		if sample.rtt < best.rtt {
+			best = sample
+		}
+	}
+	return best
+}
+
+// offset median of the recent peer offsets, stale peers are dropped,
+// called with the lock held
+func (t *NetTime) offset() (time.Duration, int) {
+	now := t.now()
+	var offsets []time.Duration
+	for ip, clock := range t.peers {
+		if now.Sub(clock.updated) > netTimeMaxAge*time.Second {
+			delete(t.peers, ip)
+			continue
+		}
+		offsets = append(offsets, clock.best().offset)
+	}
+	if len(offsets) == 0 {
+		return 0, 0
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	middle := len(offsets) / 2
+	if len(offsets)%2 == 0 {
+		return (offsets[middle-1] + offsets[middle]) / 2, len(offsets)
+	}
+	return offsets[middle], len(offsets)
+}
+
+// Offset median clock offset of the network against the local clock and
+// the number of peers it is taken from
+func (t *NetTime) Offset() (time.Duration, int) {
+	t.Lock()
+	defer t.Unlock()
+	return t.offset()
+}
+
+// Now the local time corrected by the network offset, the local time
+// while fewer than netTimeMinPeers peers were sampled
+func (t *NetTime) Now() time.Time {
+	offset, peers := t.Offset()
+	if peers < netTimeMinPeers {
+		offset = 0
+	}
+	return t.now().Add(offset)
+}
+
+// Peer the clock of one peer
+func (t *NetTime) Peer(ip string) (PeerClock, bool) {
+	t.Lock()
+	defer t.Unlock()
+	clock := t.peers[ip]
+	if clock == nil || len(clock.samples) == 0 {
+		return PeerClock{}, false
+	}
+	best := clock.best()
+	return PeerClock{IP: ip, Offset: best.offset, RTT: best.rtt, Updated: clock.updated}, true
+}
+
+// Info the current estimate with the clock of every sampled peer
+func (t *NetTime) Info() NetworkTimeInfo {
+	t.Lock()
+	offset, peers := t.offset()
+	info := NetworkTimeInfo{Local: t.now(), Offset: offset, Peers: peers, Warning: t.warning}
+	for ip, clock := range t.peers {
+		best := clock.best()
+		info.Clocks = append(info.Clocks, PeerClock{IP: ip, Offset: best.offset, RTT: best.rtt, Updated: clock.updated})
+	}
+	t.Unlock()
+	info.Network = info.Local
+	if peers >= netTimeMinPeers {
+		info.Network = info.Local.Add(offset)
+	}
+	sort.Slice(info.Clocks, func(i, j int) bool { return info.Clocks[i].IP < info.Clocks[j].IP })
+	return info
+}
+
+// NetTime the network time estimate of s
+func (s *TcpServer) NetTime() *NetTime {
+	return s.netTime
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,119 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func timeResponse(orig, recv, ts int64) []byte {
+	return []byte(fmt.Sprintf(`{"nodeId":"x","ts":%d,"nonce":1,"orig":%d,"recv":%d}`, ts, orig, recv))
+}
+
+func TestNetTime_Sample(t *testing.T) {
+	clock := NewVirtualClock(memEpoch)
+	nt := newNetTime(clock.Now)
+	t1 := toMillis(clock.Now())
+
+	// the peer is a second ahead, 50ms each way and 10ms to answer
+	nt.record("10.0.0.2", t1)
+	clock.Advance(110 * time.Millisecond)
+	response := timeResponse(t1, t1+1050, t1+1060)
+	nt.sample("10.0.0.2", response, clock.Now())
+	peer, ok := nt.Peer("10.0.0.2")
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, peer.Offset)
+	assert.Equal(t, 100*time.Millisecond, peer.RTT)
+
+	// replayed and unsolicited responses are not sampled
+	nt.sample("10.0.0.2", response, clock.Now())
+	nt.sample("10.0.0.3", response, clock.Now())
+	assert.Len(t, nt.peers["10.0.0.2"].samples, 1)
+	_, ok = nt.Peer("10.0.0.3")
+	assert.False(t, ok)
+
+	// the sample of the shortest round trip wins
+	t1 = toMillis(clock.Now())
+	nt.record("10.0.0.2", t1)
+	clock.Advance(900 * time.Millisecond)
+	nt.sample("10.0.0.2", timeResponse(t1, t1+1800, t1+1800), clock.Now())
+	peer, _ = nt.Peer("10.0.0.2")
+	assert.Equal(t, time.Second, peer.Offset)
+
+	// no timestamps from an old peer
+	nt.record("10.0.0.4", t1)
+	nt.sample("10.0.0.4", []byte(`{"nodeName":"old"}`), clock.Now())
+	_, ok = nt.Peer("10.0.0.4")
+	assert.False(t, ok)
+}
+
+func TestNetTime_Offset(t *testing.T) {
+	clock := NewVirtualClock(memEpoch)
+	nt := newNetTime(clock.Now)
+	add := func(ip string, offset time.Duration) {
+		t1 := toMillis(clock.Now())
+		nt.record(ip, t1)
+		skew := int64(offset / time.Millisecond)
+		nt.sample(ip, timeResponse(t1, t1+skew, t1+skew), clock.Now())
+	}
+
+	add("10.0.0.2", 20*time.Second)
+	add("10.0.0.3", 21*time.Second)
+	offset, peers := nt.Offset()
+	assert.Equal(t, 20500*time.Millisecond, offset)
+	assert.Equal(t, 2, peers)
+	// too few peers to trust
+	assert.Equal(t, clock.Now(), nt.Now())
+	assert.False(t, nt.warned)
+
+	// one wrong clock does not move the median
+	add("10.0.0.4", -500*time.Second)
+	offset, peers = nt.Offset()
+	assert.Equal(t, 20*time.Second, offset)
+	assert.Equal(t, 3, peers)
+	assert.Equal(t, clock.Now().Add(20*time.Second), nt.Now())
+	assert.True(t, nt.warned)
+	info := nt.Info()
+	assert.Len(t, info.Clocks, 3)
+	assert.Equal(t, "10.0.0.2", info.Clocks[0].IP)
+
+	// stale peers drop out
+	clock.Advance(netTimeMaxAge*time.Second + time.Second)
+	add("10.0.0.5", 0)
+	offset, peers = nt.Offset()
+	assert.Equal(t, time.Duration(0), offset)
+	assert.Equal(t, 1, peers)
+}
+
+func TestNetTime_Heartbeat(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	network := NewMemNetwork(1)
+	defer network.Close()
+	network.SetLatency(10 * time.Millisecond)
+	clock := network.Clock()
+	a := NewTCPServer(10001, NewEventHandler(nil))
+	a.Transport = network.Host(net.ParseIP("10.0.0.1"))
+	b := NewTCPServer(10001, NewEventHandler(nil))
+	b.Transport = network.Host(net.ParseIP("10.0.0.2"))
+	go a.Start()
+	go b.Start()
+	defer a.Close()
+	defer b.Close()
+	a.Dialer.AddStatic("10.0.0.2")
+
+	// the dialing side sends the heartbeats and samples the responses
+	assert.True(t, advanceUntil(clock, 10*time.Millisecond, 1000, func() bool {
+		_, ok := a.NetTime().Peer("10.0.0.2")
+		return ok
+	}))
+	peer, _ := a.NetTime().Peer("10.0.0.2")
+	assert.Equal(t, time.Duration(0), peer.Offset)
+	assert.Equal(t, 20*time.Millisecond, peer.RTT)
+	info, _ := a.Peer("10.0.0.2")
+	assert.Equal(t, 20*time.Millisecond, info.RTT)
+}
@@ -0,0 +1,60 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+const NodeIDLen = 8
+
+// NodeID identify a node independent of its address
+type NodeID [NodeIDLen]byte
+
+var localNodeID NodeID
+var localNodeIDMu = sync.Mutex{}
+
+func init() {
+	if _, err := rand.Read(localNodeID[:]); err != nil {
+		panic(err.Error())
+	}
+}
+
+// LocalNodeID id of the running node, random unless set by SetLocalNodeID
+func LocalNodeID() NodeID {
+	localNodeIDMu.Lock()
+	defer localNodeIDMu.Unlock()
+	return localNodeID
+}
+
+func SetLocalNodeID(id NodeID) {
+	localNodeIDMu.Lock()
+	localNodeID = id
+	localNodeIDMu.Unlock()
+}
+
+func ParseNodeID(s string) (id NodeID, err error) {
+	bt, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(bt) != NodeIDLen {
+		return id, errors.New("node id length invalid")
+	}
+	copy(id[:], bt)
+	return id, nil
+}
+
+func BytesToNodeID(bt []byte) (id NodeID) {
+	copy(id[:], bt)
+	return id
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id NodeID) IsEmpty() bool {
+	return id == NodeID{}
+}
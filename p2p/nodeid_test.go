@@ -0,0 +1,23 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNodeID(t *testing.T) {
+	id := NodeID{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.Equal(t, "0102030405060708", id.String())
+
+	parsed, err := ParseNodeID(id.String())
+	assert.NoError(t, err)
+	assert.Equal(t, id, parsed)
+
+	_, err = ParseNodeID("0102")
+	assert.Error(t, err)
+	_, err = ParseNodeID("xyz")
+	assert.Error(t, err)
+	assert.True(t, NodeID{}.IsEmpty())
+	assert.False(t, LocalNodeID().IsEmpty())
+}
@@ -0,0 +1,163 @@
+package p2p
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"time"
+)
+
+// PeerInfo a peer known to the TCP server
+type PeerInfo struct {
+	IP        string         `json:"ip"`
+	NodeID    string         `json:"nodeId,omitempty"`
+	Name      string         `json:"name,omitempty"`
+	Tag       int16          `json:"tag"`
+	Role      string         `json:"role,omitempty"`
+	Online    bool           `json:"online"`
+	Inbound   bool           `json:"inbound"`
+	Transport string         `json:"transport"`
+	Remote    string         `json:"remote,omitempty"` // remote address of WebSocket peers, keyed by a given IP
+	LastSeen  time.Time      `json:"lastSeen"`
+	Position  *Position      `json:"position,omitempty"`
+	Protocols map[string]int `json:"protocols,omitempty"`
+	// ClockOffset and RTT of the heartbeats, zero before the first sample
+	ClockOffset time.Duration `json:"clockOffset,omitempty"`
+	RTT         time.Duration `json:"rtt,omitempty"`
+}
+
+// Peers every peer in the node table, online or waiting for redial
+func (s *TcpServer) Peers() (peers []PeerInfo) {
+	s.Lock()
+	nodes := make([]*TcpNode, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	s.Unlock()
+	for _, node := range nodes {
+		peer := node.info()
+		if clock, ok := s.netTime.Peer(peer.IP); ok {
+			peer.ClockOffset, peer.RTT = clock.Offset, clock.RTT
+		}
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].IP < peers[j].IP })
+	return peers
+}
+
+// sharedIP the canonical form of an address another node shared, empty
+// unless it can be the IPv4 address of a peer
+func sharedIP(ip string) string {
+	addr := net.ParseIP(ip).To4()
+	if addr == nil || addr.IsLoopback() || addr.IsUnspecified() || addr.IsMulticast() || addr.Equal(net.IPv4bcast) {
+		return ""
+	}
+	return addr.String()
+}
+
+// Peer by IP or node id
+func (s *TcpServer) Peer(key string) (PeerInfo, bool) {
+	for _, peer := range s.Peers() {
+		if peer.IP == key || (peer.NodeID != "" && peer.NodeID == key) {
+			return peer, true
+		}
+	}
+	return PeerInfo{}, false
+}
+
+func (node *TcpNode) info() PeerInfo {
+	node.Lock()
+	defer node.Unlock()
+	peer := PeerInfo{
+		IP:        node.addr.IP.String(),
+		Name:      node.name,
+		Tag:       node.tag,
+		Online:    node.isOnline && node.isStart,
+		Inbound:   node.isServer,
+		Transport: node.transport,
+		Remote:    node.remote,
+		LastSeen:  node.lastTime,
+		Position:  node.position,
+	}
+	if !node.id.IsEmpty() {
+		peer.NodeID = node.id.String()
+	}
+	if node.hello != nil {
+		peer.Role = node.hello.Role
+		peer.Protocols = node.hello.Protocols
+	}
+	return peer
+}
+
+// Disconnect drop the connection to ip and stop redialing it, the peer
+// may connect again unless it is banned
+func (s *TcpServer) Disconnect(ip string) error {
+	s.Dialer.RemoveStatic(ip)
+	s.Lock()
+	node := s.nodes[ip]
+	s.Unlock()
+	if node == nil {
+		return errors.New("node not exist")
+	}
+	node.Lock()
+	online := node.isOnline
+	node.Unlock()
+	if !online {
+		return errors.New("node not online")
+	}
+	s.RemoveNode(node)
+	return nil
+}
+
+// Ban refuse connections from and to ip for d, the peer is disconnected
+// and penalized in the peer store
+func (s *TcpServer) Ban(ip string, d time.Duration) error {
+	if net.ParseIP(ip) == nil {
+		return errors.New("ban ip invalid")
+	}
+	s.Lock()
+	s.bans[ip] = s.Transport.Now().Add(d)
+	s.Unlock()
+	logger.Warn("TCP ban peer", "addr", ip, "duration", d)
+	if s.peerStore != nil {
+		s.peerStore.Penalize(ip)
+	}
+	s.Disconnect(ip)
+	return nil
+}
+
+func (s *TcpServer) Unban(ip string) {
+	s.Lock()
+	delete(s.bans, ip)
+	s.Unlock()
+}
+
+// Bans banned IPs and when their ban ends
+func (s *TcpServer) Bans() map[string]time.Time {
+	s.Lock()
+	defer s.Unlock()
+	s.pruneBans()
+	bans := make(map[string]time.Time, len(s.bans))
+	for ip, until := range s.bans {
+		bans[ip] = until
+	}
+	return bans
+}
+
+func (s *TcpServer) isBanned(ip string) bool {
+	s.Lock()
+	defer s.Unlock()
+	s.pruneBans()
+	_, ok := s.bans[ip]
+	return ok
+}
+
+// pruneBans drop ended bans, caller holds the server lock
+func (s *TcpServer) pruneBans() {
+	now := s.Transport.Now()
+	for ip, until := range s.bans {
+		if !until.After(now) {
+			delete(s.bans, ip)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package p2p
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"fx/chain/common/utils"
+)
+
+// PeerRecord what the node learned about a peer
+type PeerRecord struct {
+	IP       string    `json:"ip"`
+	NodeID   string    `json:"nodeId,omitempty"`
+	NodeName string    `json:"nodeName,omitempty"`
+	Tag      int16     `json:"tag,omitempty"`
+	LastSeen time.Time `json:"lastSeen"`
+	Score    int       `json:"score"`
+	Failures int       `json:"failures"`
+	Position *Position `json:"position,omitempty"`
+	// Learned local time another node shared the peer, LastSeen stays zero
+	// until the node reaches it itself
+	Learned time.Time `json:"learned,omitempty"`
+}
+
+// learnedOnly shared by another node and never seen
+func (peer *PeerRecord) learnedOnly() bool {
+	return peer.LastSeen.IsZero() && !peer.Learned.IsZero()
+}
+
+// PeerStore on-disk peer database, saved atomically
+type PeerStore struct {
+	path  string
+	peers map[string]*PeerRecord
+	dirty bool
+	now   func() time.Time
+	sync.Mutex
+}
+
+type peerStoreFile struct {
+	Peers []*PeerRecord `json:"peers"`
+}
+
+// OpenPeerStore load the peer database at path, a missing file is empty
+func OpenPeerStore(path string) (*PeerStore, error) {
+	store := &PeerStore{path: path, peers: map[string]*PeerRecord{}, now: time.Now}
+	if !utils.PathExists(path) {
+		return store, nil
+	}
+	var file peerStoreFile
+	if err := utils.LoadJSON(path, &file); err != nil {
+		return nil, err
+	}
+	for _, peer := range file.Peers {
+		if peer.IP != "" {
+			store.peers[peer.IP] = peer
+		}
+	}
+	return store, nil
+}
+
+// Seen record a healthy contact with peer
+func (ps *PeerStore) Seen(ip string, id NodeID, name string, tag int16) {
+	ps.Lock()
+	defer ps.Unlock()
+	peer := ps.peer(ip)
+	if !id.IsEmpty() {
+		peer.NodeID = id.String()
+	}
+	if name != "" {
+		peer.NodeName = name
+	}
+	if tag != 0 {
+		peer.Tag = tag
+	}
+	peer.LastSeen = ps.now()
+	peer.Learned = time.Time{}
+	peer.Failures = 0
+	if peer.Score < peerMaxScore {
+		peer.Score++
+	}
+	ps.dirty = true
+}
+
+// Learn record a peer another node shared at now, it gains no score and is
+// no dial candidate until it is seen, a known peer keeps its own record,
+// at most peerMaxLearned such peers are kept for peerLearnedExpire
+func (ps *PeerStore) Learn(ip string, id NodeID, now time.Time) {
+	ps.Lock()
+	defer ps.Unlock()
+	if ps.peers[ip] != nil {
+		return
+	}
+	ps.pruneLearned(now)
+	if ps.learned() >= peerMaxLearned {
+		ps.dropOldestLearned()
+	}
+	peer := ps.peer(ip)
+	if !id.IsEmpty() {
+		peer.NodeID = id.String()
+	}
+	peer.Learned = now
+	ps.dirty = true
+}
+
+// learned count of learned only peers
+func (ps *PeerStore) learned() (n int) {
+	for _, peer := range ps.peers {
+		if peer.learnedOnly() {
+			n++
+		}
+	}
+	return n
+}
+
+// pruneLearned forget learned only peers older than peerLearnedExpire
+func (ps *PeerStore) pruneLearned(now time.Time) {
+	for ip, peer := range ps.peers {
+		if peer.learnedOnly() && now.Sub(peer.Learned) > peerLearnedExpire*time.Hour {
+			delete(ps.peers, ip)
+			ps.dirty = true
+		}
+	}
+}
+
+func (ps *PeerStore) dropOldestLearned() {
+	var oldest *PeerRecord
+	for _, peer := range ps.peers {
+		if peer.learnedOnly() && (oldest == nil || peer.Learned.Before(oldest.Learned)) {
+			oldest = peer
+		}
+	}
+	if oldest != nil {
+		delete(ps.peers, oldest.IP)
+		ps.dirty = true
+	}
+}
+
+// Failed record a failed dial or dropped connection
+func (ps *PeerStore) Failed(ip string) {
+	ps.Lock()
+	defer ps.Unlock()
+	peer := ps.peer(ip)
+	peer.Failures++
+	peer.Score -= peerFailureScore
+	if peer.Score < -peerMaxScore {
+		peer.Score = -peerMaxScore
+	}
+	ps.dirty = true
+}
+
+// SetPosition record the position a peer reported
+func (ps *PeerStore) SetPosition(ip string, position *Position) {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.peer(ip).Position = position
+	ps.dirty = true
+}
+
+// Penalize lower the score of a misbehaving peer
+func (ps *PeerStore) Penalize(ip string) {
+	ps.Lock()
+	defer ps.Unlock()
+	peer := ps.peer(ip)
+	peer.Score -= peerFailureScore
+	if peer.Score < -peerMaxScore {
+		peer.Score = -peerMaxScore
+	}
+	ps.dirty = true
+}
+
+func (ps *PeerStore) Remove(ip string) {
+	ps.Lock()
+	defer ps.Unlock()
+	delete(ps.peers, ip)
+	ps.dirty = true
+}
+
+func (ps *PeerStore) Get(ip string) (PeerRecord, bool) {
+	ps.Lock()
+	defer ps.Unlock()
+	if peer := ps.peers[ip]; peer != nil {
+		return *peer, true
+	}
+	return PeerRecord{}, false
+}
+
+func (ps *PeerStore) Peers() (peers []PeerRecord) {
+	ps.Lock()
+	defer ps.Unlock()
+	for _, peer := range ps.peers {
+		peers = append(peers, *peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].IP < peers[j].IP })
+	return peers
+}
+
+// Best at most n dial candidates, recently healthy peers first, peers failing
+// too often, not seen for long or only learned from others are skipped
+func (ps *PeerStore) Best(n int) (peers []PeerRecord) {
+	ps.Lock()
+	now := ps.now()
+	for _, peer := range ps.peers {
+		if peer.learnedOnly() || peer.Failures >= peerMaxFailures || now.Sub(peer.LastSeen) > peerExpireTime*time.Hour {
+			continue
+		}
+		peers = append(peers, *peer)
+	}
+	ps.Unlock()
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Failures != peers[j].Failures {
+			return peers[i].Failures < peers[j].Failures
+		}
+		if !peers[i].LastSeen.Equal(peers[j].LastSeen) {
+			return peers[i].LastSeen.After(peers[j].LastSeen)
+		}
+		return peers[i].Score > peers[j].Score
+	})
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// Save write the database if it changed since the last save
+func (ps *PeerStore) Save() error {
+	ps.Lock()
+	if !ps.dirty {
+		ps.Unlock()
+		return nil
+	}
+	ps.pruneLearned(ps.now())
+	file := peerStoreFile{}
+	for _, peer := range ps.peers {
+		record := *peer
+		file.Peers = append(file.Peers, &record)
+	}
+	ps.dirty = false
+	ps.Unlock()
+	sort.Slice(file.Peers, func(i, j int) bool { return file.Peers[i].IP < file.Peers[j].IP })
+	if err := utils.SaveJSONAtomic(ps.path, file); err != nil {
+		ps.Lock()
+		ps.dirty = true
+		ps.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (ps *PeerStore) peer(ip string) *PeerRecord {
+	peer := ps.peers[ip]
+	if peer == nil {
+		peer = &PeerRecord{IP: ip}
+		ps.peers[ip] = peer
+	}
+	return peer
+}
@@ -0,0 +1,137 @@
+package p2p
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fx/chain/common/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerStore_SaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peerstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nodes", "peers.json")
+
+	store, err := OpenPeerStore(path)
+	assert.NoError(t, err)
+	assert.Empty(t, store.Peers())
+	assert.NoError(t, store.Save())
+	assert.False(t, utils.PathExists(path))
+
+	store.Seen("10.0.0.1", NodeID{1}, "alice", NodeServer)
+	store.Failed("10.0.0.2")
+	store.SetPosition("10.0.0.1", &Position{Longitude: 2.35, Latitude: 48.85})
+	assert.NoError(t, store.Save())
+
+	loaded, err := OpenPeerStore(path)
+	assert.NoError(t, err)
+	assert.Equal(t, store.Peers()[0].NodeID, loaded.Peers()[0].NodeID)
+	peer, ok := loaded.Get("10.0.0.1")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", peer.NodeName)
+	assert.Equal(t, int16(NodeServer), peer.Tag)
+	assert.Equal(t, 1, peer.Score)
+	assert.Equal(t, 48.85, peer.Position.Latitude)
+	peer, ok = loaded.Get("10.0.0.2")
+	assert.True(t, ok)
+	assert.Equal(t, 1, peer.Failures)
+
+	ioutil.WriteFile(path, []byte("{"), 0644)
+	_, err = OpenPeerStore(path)
+	assert.Error(t, err)
+}
+
+func TestPeerStore_Best(t *testing.T) {
+	now := time.Now()
+	store, _ := OpenPeerStore(filepath.Join(os.TempDir(), "not-exist", "peers.json"))
+	store.now = func() time.Time { return now }
+
+	store.Seen("10.0.0.1", NodeID{}, "", 0)
+	now = now.Add(time.Minute)
+	store.Seen("10.0.0.2", NodeID{}, "", 0)
+	store.Seen("10.0.0.3", NodeID{}, "", 0)
+	store.Failed("10.0.0.3")
+	for i := 0; i < peerMaxFailures; i++ {
+		store.Failed("10.0.0.4")
+	}
+	best := store.Best(10)
+	assert.Equal(t, 3, len(best))
+	assert.Equal(t, "10.0.0.2", best[0].IP)
+	assert.Equal(t, "10.0.0.1", best[1].IP)
+	assert.Equal(t, "10.0.0.3", best[2].IP)
+	assert.Equal(t, 1, len(store.Best(1)))
+
+	now = now.Add(peerExpireTime*time.Hour + time.Second)
+	store.Seen("10.0.0.1", NodeID{}, "", 0)
+	best = store.Best(10)
+	assert.Equal(t, 1, len(best))
+	store.Remove("10.0.0.1")
+	assert.Empty(t, store.Best(10))
+}
+
+func TestPeerStore_Learn(t *testing.T) {
+	now := time.Now()
+	store, _ := OpenPeerStore(filepath.Join(os.TempDir(), "not-exist", "peers.json"))
+	store.now = func() time.Time { return now }
+
+	// learned peers are no dial candidates until seen
+	store.Learn("10.0.0.1", NodeID{1}, now)
+	assert.Empty(t, store.Best(10))
+	store.Seen("10.0.0.1", NodeID{}, "", 0)
+	record, _ := store.Get("10.0.0.1")
+	assert.True(t, record.Learned.IsZero())
+	assert.Len(t, store.Best(10), 1)
+
+	// capped, the oldest learned peer goes first, seen peers stay
+	for i := 0; i < peerMaxLearned; i++ {
+		store.Learn(fmt.Sprintf("10.1.%d.%d", i/256, i%256), NodeID{}, now.Add(time.Duration(i)*time.Second))
+	}
+	store.Learn("10.2.0.1", NodeID{}, now.Add(time.Hour))
+	assert.Len(t, store.Peers(), peerMaxLearned+1)
+	_, ok := store.Get("10.1.0.0")
+	assert.False(t, ok)
+	_, ok = store.Get("10.0.0.1")
+	assert.True(t, ok)
+
+	// and expire
+	now = now.Add(3 * peerLearnedExpire * time.Hour)
+	store.path = filepath.Join(os.TempDir(), fmt.Sprintf("peers-learn-%d.json", os.Getpid()))
+	defer os.Remove(store.path)
+	assert.NoError(t, store.Save())
+	assert.Len(t, store.Peers(), 1)
+}
+
+func TestPeerStore_Dropped(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	network := NewMemNetwork(1)
+	defer network.Close()
+	clock := network.Clock()
+	a := NewTCPServer(10001, NewEventHandler(nil))
+	a.Transport = network.Host(net.ParseIP("10.0.0.1"))
+	store := &PeerStore{peers: map[string]*PeerRecord{}, now: a.Transport.Now}
+	a.SetPeerStore(store)
+	b := NewTCPServer(10001, NewEventHandler(nil))
+	b.Transport = network.Host(net.ParseIP("10.0.0.2"))
+	go a.Start()
+	go b.Start()
+	defer a.Close()
+
+	a.Dialer.AddStatic("10.0.0.2")
+	assert.True(t, advanceUntil(clock, time.Second, 10, func() bool { return len(a.OnlineIPs()) == 1 }))
+	record, _ := store.Get("10.0.0.2")
+	assert.Equal(t, 0, record.Failures)
+
+	// the peer accepted, then went away, counted before any redial
+	b.Close()
+	clock.Advance(0)
+	record, _ = store.Get("10.0.0.2")
+	assert.Equal(t, 1, record.Failures)
+}
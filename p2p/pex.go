@@ -0,0 +1,286 @@
+package p2p
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// PexProtocol name of the peer exchange sub-protocol in the hello
+const PexProtocol = "pex"
+
+// PeerExchange connected nodes periodically ask each other for a sample of
+// the server peers they know to be good, so the mesh heals without UDP
+// broadcast discovery, answers are rate limited per peer and only accepted
+// when requested
+type PeerExchange struct {
+	tcp     *TcpServer
+	asked   map[string]time.Time
+	pending map[string]time.Time
+	served  map[string]time.Time
+	rand    *rand.Rand
+	sync.Mutex
+}
+
+// PexPeer a peer shared with other nodes
+type PexPeer struct {
+	IP       string    `json:"ip"`
+	NodeID   string    `json:"nodeId,omitempty"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+type pexPeers struct {
+	Peers []PexPeer `json:"peers"`
+}
+
+// NewPeerExchange enable peer exchange on tcp, rounds run until the
+// server is closed
+func NewPeerExchange(tcp *TcpServer) *PeerExchange {
+	if tcp == nil {
+		panic("PEX TcpServer not empty")
+	}
+	p := &PeerExchange{
+		tcp:     tcp,
+		asked:   map[string]time.Time{},
+		pending: map[string]time.Time{},
+		served:  map[string]time.Time{},
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	handler := tcp.handler
+	handler.RegisterProtocol(PexProtocol, 1, CommandPexRequest, CommandPexPeers)
+	handler.RegisterEventHandler(CommandPexRequest, p.onRequest)
+	handler.RegisterEventHandler(CommandPexPeers, p.onPeers)
+	handler.RegisterEventHandler(NodeDiscoveryHandler, p.onPeerOnline)
+	tcp.goLoop(p.run)
+	return p
+}
+
+func (p *PeerExchange) run() {
+	for p.tcp.sleep(pexInterval * time.Second) {
+		p.Round()
+	}
+}
+
+// Round ask a few random peers for their sample
+func (p *PeerExchange) Round() {
+	now := p.tcp.Transport.Now()
+	p.Lock()
+	p.prune(now)
+	p.Unlock()
+	nodes := p.candidates()
+	p.rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	for i, node := range nodes {
+		if i == pexFanout {
+			break
+		}
+		p.request(node.addr.IP.String(), pexMinInterval*time.Second)
+	}
+}
+
+// onPeerOnline ask a new peer right away, a node that just joined has
+// nothing else to go on, the event repeats with every heartbeat
+func (p *PeerExchange) onPeerOnline(c *Context) {
+	p.request(c.IP.String(), pexInterval*time.Second)
+}
+
+// request the sample of ip unless it was asked within gap
+func (p *PeerExchange) request(ip string, gap time.Duration) {
+	p.tcp.Lock()
+	node := p.tcp.nodes[ip]
+	p.tcp.Unlock()
+	if node == nil || node.transport != TransportTCP || !node.supports(CommandPexRequest) {
+		return
+	}
+	now := p.tcp.Transport.Now()
+	p.Lock()
+	if last, ok := p.asked[ip]; ok && now.Sub(last) < gap {
+		p.Unlock()
+		return
+	}
+	p.asked[ip] = now
+	p.pending[ip] = now
+	p.Unlock()
+	if err := p.tcp.WriteToTCP(newRawMsg(CommandPexRequest, nil), ip); err != nil {
+		logger.Debug("PEX request", "addr", ip, "err", err.Error())
+	}
+}
+
+// candidates online TCP peers speaking pex
+func (p *PeerExchange) candidates() (nodes []*TcpNode) {
+	p.tcp.Lock()
+	all := make([]*TcpNode, 0, len(p.tcp.nodes))
+	for _, node := range p.tcp.nodes {
+		all = append(all, node)
+	}
+	p.tcp.Unlock()
+	for _, node := range all {
+		node.Lock()
+		online := node.isOnline && node.isStart && node.transport == TransportTCP
+		node.Unlock()
+		if online && node.supports(CommandPexRequest) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func (p *PeerExchange) onRequest(c *Context) {
+	if c.Transport != TransportTCP {
+		return
+	}
+	ip := c.IP.String()
+	now := p.tcp.Transport.Now()
+	p.Lock()
+	if last, ok := p.served[ip]; ok && now.Sub(last) < pexMinInterval*time.Second {
+		p.Unlock()
+		logger.Debug("PEX request too often", "addr", ip)
+		return
+	}
+	p.served[ip] = now
+	p.Unlock()
+	body, err := json.Marshal(pexPeers{Peers: p.Sample(ip)})
+	if err != nil {
+		logger.Error("PEX marshal json", "err", err.Error())
+		return
+	}
+	if err := p.tcp.WriteToTCP(newRawMsg(CommandPexPeers, body), ip); err != nil {
+		logger.Debug("PEX reply", "addr", ip, "err", err.Error())
+	}
+}
+
+// Sample at most pexSampleSize good server peers for the peer at exclude,
+// online servers and stored peers with a positive score seen lately
+func (p *PeerExchange) Sample(exclude string) []PexPeer {
+	s := p.tcp
+	now := s.Transport.Now()
+	byIP := map[string]PexPeer{}
+	for _, peer := range s.Peers() {
+		if !peer.Online || peer.Transport != TransportTCP || peer.Role == Client {
+			continue
+		}
+		byIP[peer.IP] = PexPeer{IP: peer.IP, NodeID: peer.NodeID, LastSeen: now}
+	}
+	if s.peerStore != nil {
+		for _, record := range s.peerStore.Peers() {
+			if _, ok := byIP[record.IP]; ok || record.Tag == NodeClient {
+				continue
+			}
+			if record.learnedOnly() || record.Score < pexMinScore || record.Failures > 0 || now.Sub(record.LastSeen) > pexMaxAge*time.Hour {
+				continue
+			}
+			byIP[record.IP] = PexPeer{IP: record.IP, NodeID: record.NodeID, LastSeen: record.LastSeen}
+		}
+	}
+	delete(byIP, exclude)
+	peers := make([]PexPeer, 0, len(byIP))
+	for ip, peer := range byIP {
+		if !s.isBanned(ip) {
+			peers = append(peers, peer)
+		}
+	}
+	p.Lock()
+	p.rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	p.Unlock()
+	if len(peers) > pexSampleSize {
+		peers = peers[:pexSampleSize]
+	}
+	return peers
+}
+
+func (p *PeerExchange) onPeers(c *Context) {
+	ip := c.IP.String()
+	now := p.tcp.Transport.Now()
+	p.Lock()
+	last, ok := p.pending[ip]
+	delete(p.pending, ip)
+	p.Unlock()
+	if !ok || now.Sub(last) > pexRequestTimeout*time.Second {
+		logger.Debug("PEX drop unsolicited peers", "addr", ip)
+		return
+	}
+	var reply pexPeers
+	if err := json.Unmarshal(c.Body, &reply); err != nil {
+		logger.Warn("PEX peers json unmarshal", "addr", ip, "err", err.Error())
+		return
+	}
+	if len(reply.Peers) > pexSampleSize {
+		reply.Peers = reply.Peers[:pexSampleSize]
+	}
+	var learned []net.IP
+	for _, peer := range reply.Peers {
+		if addr := p.learn(peer, now); addr != nil {
+			learned = append(learned, addr)
+		}
+	}
+	logger.Debug("PEX peers", "addr", ip, "shared", len(reply.Peers), "learned", len(learned))
+	p.dial(learned)
+}
+
+// learn a shared peer at the local time now, the claimed last seen time is
+// not trusted, the address when it is new and worth dialing
+func (p *PeerExchange) learn(peer PexPeer, now time.Time) net.IP {
+	s := p.tcp
+	ip := sharedIP(peer.IP)
+	if ip == "" || ip == s.Transport.LocalIP().String() {
+		return nil
+	}
+	addr := net.ParseIP(ip).To4()
+	id, err := ParseNodeID(peer.NodeID)
+	if err == nil && !id.IsEmpty() && id == LocalNodeID() {
+		return nil
+	}
+	if s.isBanned(ip) {
+		return nil
+	}
+	s.Lock()
+	node := s.nodes[ip]
+	s.Unlock()
+	if node != nil {
+		node.Lock()
+		online := node.isOnline
+		node.Unlock()
+		if online {
+			return nil
+		}
+	}
+	if s.peerStore != nil {
+		if record, ok := s.peerStore.Get(ip); ok && (record.Score < 0 || record.Failures >= peerMaxFailures) {
+			return nil
+		}
+		s.peerStore.Learn(ip, id, now)
+	}
+	return addr
+}
+
+// dial learned peers while the node has few connections
+func (p *PeerExchange) dial(learned []net.IP) {
+	missing := pexTargetPeers - len(p.tcp.OnlineIPs())
+	if missing > pexMaxDials {
+		missing = pexMaxDials
+	}
+	for i := 0; i < missing && i < len(learned); i++ {
+		logger.Info("PEX dial learned peer", "addr", learned[i])
+		go p.tcp.NewTCPConn(learned[i])
+	}
+}
+
+// prune forget requests and answers older than their limits
+func (p *PeerExchange) prune(now time.Time) {
+	for ip, last := range p.asked {
+		if now.Sub(last) > pexInterval*time.Second {
+			delete(p.asked, ip)
+		}
+	}
+	for ip, last := range p.pending {
+		if now.Sub(last) > pexRequestTimeout*time.Second {
+			delete(p.pending, ip)
+		}
+	}
+	for ip, last := range p.served {
+		if now.Sub(last) > pexMinInterval*time.Second {
+			delete(p.served, ip)
+		}
+	}
+}
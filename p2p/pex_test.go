@@ -0,0 +1,98 @@
+package p2p
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerExchange(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	// the nodes share the process wide id, none would be learned
+	defer SetLocalNodeID(LocalNodeID())
+	SetLocalNodeID(NodeID{})
+	network := NewMemNetwork(1)
+	defer network.Close()
+	clock := network.Clock()
+
+	// a and c only know b, on separate subnets UDP discovery never finds
+	// them
+	enable := func(tcp *TcpServer) { NewPeerExchange(tcp) }
+	a := startMemNode(network, "10.0.1.1", 10000, enable)
+	b := startMemNode(network, "10.0.2.2", 10000, enable)
+	c := startMemNode(network, "10.0.3.3", 10000, enable)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	a.Dialer.AddStatic("10.0.2.2")
+	c.Dialer.AddStatic("10.0.2.2")
+	assert.True(t, advanceUntil(clock, time.Second, 10, func() bool { return len(b.OnlineIPs()) == 2 }))
+
+	assert.True(t, advanceUntil(clock, time.Second, 2*pexInterval, func() bool {
+		_, ok := a.Peer("10.0.3.3")
+		return ok && len(a.OnlineIPs()) == 2 && len(c.OnlineIPs()) == 2
+	}))
+}
+
+func TestPeerExchange_Filter(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	network := NewMemNetwork(1)
+	defer network.Close()
+	tcp := NewTCPServer(10001, NewEventHandler(nil))
+	tcp.Transport = network.Host(net.ParseIP("10.0.0.1"))
+	store := &PeerStore{peers: map[string]*PeerRecord{}, now: tcp.Transport.Now}
+	tcp.SetPeerStore(store)
+	pex := &PeerExchange{tcp: tcp, asked: map[string]time.Time{}, pending: map[string]time.Time{},
+		served: map[string]time.Time{}, rand: rand.New(rand.NewSource(1))}
+	now := tcp.Transport.Now()
+
+	store.Seen("10.0.0.5", NodeID{5}, "good", NodeServer)
+	store.Seen("10.0.0.6", NodeID{6}, "client", NodeClient)
+	store.Seen("10.0.0.7", NodeID{7}, "failing", NodeServer)
+	store.Failed("10.0.0.7")
+	store.Learn("10.0.0.8", NodeID{8}, now)
+	sample := pex.Sample("10.0.0.9")
+	assert.Equal(t, []PexPeer{{IP: "10.0.0.5", NodeID: NodeID{5}.String(), LastSeen: now}}, sample)
+	assert.Empty(t, pex.Sample("10.0.0.5"))
+
+	body, _ := json.Marshal(pexPeers{Peers: []PexPeer{
+		{IP: "10.0.0.20", LastSeen: now.Add(time.Hour)},
+		{IP: "127.0.0.1"},
+		{IP: "not an ip"},
+		{IP: "10.0.0.7"},
+	}})
+	reply := &Context{IP: net.ParseIP("10.0.0.9"), Transport: TransportTCP, Body: body}
+
+	// not requested
+	pex.onPeers(reply)
+	_, ok := store.Get("10.0.0.20")
+	assert.False(t, ok)
+
+	pex.pending["10.0.0.9"] = now
+	pex.onPeers(reply)
+	record, ok := store.Get("10.0.0.20")
+	assert.True(t, ok)
+	assert.Equal(t, 0, record.Score)
+	assert.True(t, record.LastSeen.IsZero())
+	assert.Equal(t, now, record.Learned)
+	_, ok = store.Get("127.0.0.1")
+	assert.False(t, ok)
+	record, _ = store.Get("10.0.0.7")
+	assert.Equal(t, 1, record.Failures)
+
+	// the second request within the interval is not answered
+	request := &Context{IP: net.ParseIP("10.0.0.9"), Transport: TransportTCP}
+	pex.onRequest(request)
+	first := pex.served["10.0.0.9"]
+	clock := network.Clock()
+	clock.Advance(time.Second)
+	pex.onRequest(request)
+	assert.Equal(t, first, pex.served["10.0.0.9"])
+}
@@ -0,0 +1,106 @@
+package p2p
+
+import "fmt"
+
+// Priority class of an outbound TCP frame
+type Priority int
+
+const (
+	// PriorityControl hello and heartbeats, always written first
+	PriorityControl Priority = iota
+	// PriorityHigh internal protocols such as relay and pubsub
+	PriorityHigh
+	// PriorityNormal application messages
+	PriorityNormal
+	// PriorityBulk large transfers, they get the smallest share, frames are
+	// never split so they are capped at priorityBulkMaxFrame, larger
+	// payloads go over a stream which chunks them
+	PriorityBulk
+	priorityCount
+)
+
+// priorityWeight frames each class may write in turn once control frames
+// are out
+var priorityWeight = [priorityCount]int{
+	PriorityHigh:   priorityWeightHigh,
+	PriorityNormal: priorityWeightNormal,
+	PriorityBulk:   priorityWeightBulk,
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityControl:
+		return "control"
+	case PriorityHigh:
+		return "high"
+	case PriorityNormal:
+		return "normal"
+	case PriorityBulk:
+		return "bulk"
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+func (p Priority) valid() bool {
+	return p >= PriorityControl && p < priorityCount
+}
+
+// SetPriority send command in class priority, application commands are
+// normal unless set
+func (e *EventHandler) SetPriority(command Command, priority Priority) {
+	if !priority.valid() {
+		panic("priority class invalid")
+	}
+	e.Lock()
+	e.priorities[command] = priority
+	e.Unlock()
+}
+
+// priorityOf class of command, signed frames use their inner command
+func (e *EventHandler) priorityOf(command Command) Priority {
+	switch command {
+	case CommandHello, CommandHeartbeat, CommandHeartbeatResponse:
+		return PriorityControl
+	}
+	e.Lock()
+	priority, ok := e.priorities[command]
+	e.Unlock()
+	if ok {
+		return priority
+	}
+	if command < NodeDiscoveryHandler {
+		return PriorityHigh
+	}
+	return PriorityNormal
+}
+
+// pick the next queued frame, control frames first, the other classes take
+// turns of priorityWeight frames
+func (w *nodeWriter) pick() (outFrame, bool) {
+	if frame, ok := poll(w.queues[PriorityControl]); ok {
+		return frame, true
+	}
+	for tries := 0; tries < 2*int(priorityCount); tries++ {
+		if w.credit > 0 {
+			if frame, ok := poll(w.queues[w.turn]); ok {
+				w.credit--
+				return frame, true
+			}
+		}
+		w.turn++
+		if w.turn == priorityCount {
+			w.turn = PriorityHigh
+		}
+		w.credit = priorityWeight[w.turn]
+	}
+	return outFrame{}, false
+}
+
+func poll(queue chan outFrame) (outFrame, bool) {
+	select {
+	case frame := <-queue:
+		return frame, true
+	default:
+		return outFrame{}, false
+	}
+}
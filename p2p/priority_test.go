@@ -0,0 +1,57 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventHandler_PriorityOf(t *testing.T) {
+	handler := NewEventHandler(nil)
+	assert.Equal(t, PriorityControl, handler.priorityOf(CommandHeartbeat))
+	assert.Equal(t, PriorityControl, handler.priorityOf(CommandHello))
+	assert.Equal(t, PriorityHigh, handler.priorityOf(CommandTopicPublish))
+	assert.Equal(t, PriorityNormal, handler.priorityOf(60))
+	handler.SetPriority(60, PriorityBulk)
+	assert.Equal(t, PriorityBulk, handler.priorityOf(60))
+	assert.Equal(t, "bulk", PriorityBulk.String())
+	assert.Panics(t, func() { handler.SetPriority(61, Priority(9)) })
+}
+
+func TestNodeWriter_Priority(t *testing.T) {
+	s := NewTCPServer(8900, NewEventHandler(nil))
+	node, remote := newTestTcpNode(t, s, NodeID{1}, NodeClient)
+	defer remote.Close()
+	writer := newNodeWriter(node, node.conn)
+	queue := func(priority Priority, name string, n int) {
+		for i := 0; i < n; i++ {
+			assert.NoError(t, writer.enqueue(outFrame{data: mustMarshal(newRawMsg(60, []byte(name))), message: NewMsg(60, nil), priority: priority}))
+		}
+	}
+	queue(PriorityBulk, "B", 3)
+	queue(PriorityNormal, "N", 6)
+	queue(PriorityHigh, "H", 10)
+	queue(PriorityControl, "C", 2)
+	go writer.run()
+
+	order := ""
+	for i := 0; i < 21; i++ {
+		order += string(readTestMsg(t, remote).Body)
+	}
+	assert.Equal(t, "CCHHHHNNBHHHHNNBHHNNB", order)
+	writer.close()
+}
+
+func TestTcpNode_WriteToPriority(t *testing.T) {
+	s := NewTCPServer(8901, NewEventHandler(nil))
+	node, remote := newTestTcpNode(t, s, NodeID{1}, NodeClient)
+	defer remote.Close()
+	assert.Error(t, node.WriteToPriority(NewMsg(60, nil), Priority(-1)))
+	assert.NoError(t, node.WriteToPriority(newRawMsg(60, []byte("bulk")), PriorityBulk))
+	assert.Equal(t, "bulk", string(readTestMsg(t, remote).Body))
+
+	// large bulk payloads are refused, a stream frame fits
+	assert.Equal(t, ErrBulkFrameTooLarge, node.WriteToPriority(newRawMsg(60, make([]byte, priorityBulkMaxFrame)), PriorityBulk))
+	assert.NoError(t, node.WriteToPriority(newRawMsg(60, make([]byte, priorityBulkMaxFrame)), PriorityNormal))
+	assert.True(t, HeadLen+streamFrameSize+16 <= priorityBulkMaxFrame)
+}
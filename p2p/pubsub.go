@@ -0,0 +1,324 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type TopicHandlerFunc func(topic string, data []byte, c *Context)
+
+// PubSub topic based publish/subscribe over the TCP mesh,
+// publications are only forwarded to peers interested in the topic, times
+// are taken from the clock of the TcpServer sharing the handler
+type PubSub struct {
+	origin    string
+	seq       uint64
+	interest  uint64
+	topics    map[string][]TopicHandlerFunc
+	peers     map[string]map[string]bool
+	interests map[string]topicInterest
+	announced map[string]bool
+	seen      map[string]time.Time
+	send      func(ip string, message Message) error
+	online    func() []string
+	now       func() time.Time
+	handler   *EventHandler
+	sync.Mutex
+}
+
+// topicInterest the full topic set of a node, handlers run concurrently so
+// Seq orders the announcements of one Origin, older ones are ignored
+type topicInterest struct {
+	Topics []string `json:"topics"`
+	Origin string   `json:"origin,omitempty"`
+	Seq    uint64   `json:"seq,omitempty"`
+}
+
+type topicMessage struct {
+	Topic  string `json:"topic"`
+	Origin string `json:"origin"`
+	Seq    uint64 `json:"seq"`
+	Hops   int    `json:"hops"`
+	Data   []byte `json:"data,omitempty"`
+	// signed envelope of the message without hops, replaces data
+	Envelope []byte `json:"envelope,omitempty"`
+}
+
+func NewPubSub(handler *EventHandler) *PubSub {
+	if handler == nil {
+		panic("PubSub EventHandler not empty")
+	}
+	ps := &PubSub{
+		origin:    randomOrigin(),
+		topics:    map[string][]TopicHandlerFunc{},
+		peers:     map[string]map[string]bool{},
+		interests: map[string]topicInterest{},
+		announced: map[string]bool{},
+		seen:      map[string]time.Time{},
+		send:      writeToTCP,
+		online:    onlineIPs,
+		now:       handler.replay.clock,
+		handler:   handler,
+	}
+	handler.RegisterEventHandler(CommandTopicInterest, ps.onInterest)
+	handler.RegisterEventHandler(CommandTopicPublish, ps.onPublish)
+	handler.RegisterEventHandler(NodeDiscoveryHandler, ps.onPeerOnline)
+	handler.RegisterEventHandler(NodeRemoveHandler, ps.onPeerOffline)
+	return ps
+}
+
+// Subscribe register a handler for topic and announce interest to peers
+func (ps *PubSub) Subscribe(topic string, handler TopicHandlerFunc) {
+	if topic == "" || handler == nil {
+		return
+	}
+	ps.Lock()
+	_, exist := ps.topics[topic]
+	ps.topics[topic] = append(ps.topics[topic], handler)
+	ps.Unlock()
+	if !exist {
+		ps.announceAll()
+	}
+}
+
+// Unsubscribe remove all handlers of topic and announce to peers
+func (ps *PubSub) Unsubscribe(topic string) {
+	ps.Lock()
+	_, exist := ps.topics[topic]
+	delete(ps.topics, topic)
+	ps.Unlock()
+	if exist {
+		ps.announceAll()
+	}
+}
+
+// Publish send data to every peer subscribed to topic
+func (ps *PubSub) Publish(topic string, data []byte) error {
+	if topic == "" {
+		return errors.New("topic not empty")
+	}
+	ps.Lock()
+	ps.seq++
+	msg := topicMessage{Topic: topic, Origin: ps.origin, Seq: ps.seq, Data: data}
+	ps.seen[msg.id()] = ps.now()
+	ps.Unlock()
+	if signer := getSigner(); signer != nil {
+		inner, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("topic msg marshal err:%s", err.Error())
+		}
+		if msg.Envelope, err = seal(signer, Head{Command: CommandTopicPublish}, inner, ps.now()); err != nil {
+			return fmt.Errorf("topic msg sign err:%s", err.Error())
+		}
+		msg.Data = nil
+	}
+	return ps.forward(msg, "")
+}
+
+// Topics local subscribed topics
+func (ps *PubSub) Topics() []string {
+	ps.Lock()
+	defer ps.Unlock()
+	return ps.localTopics()
+}
+
+// PeerTopics topics a peer announced interest in
+func (ps *PubSub) PeerTopics(ip string) (topics []string) {
+	ps.Lock()
+	defer ps.Unlock()
+	for topic := range ps.peers[ip] {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func (ps *PubSub) localTopics() (topics []string) {
+	for topic := range ps.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func (ps *PubSub) forward(msg topicMessage, from string) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("topic msg marshal err:%s", err.Error())
+	}
+	ps.Lock()
+	var ips []string
+	for ip, topics := range ps.peers {
+		if ip != from && topics[msg.Topic] {
+			ips = append(ips, ip)
+		}
+	}
+	ps.Unlock()
+	for _, ip := range ips {
+		if err := ps.send(ip, newRawMsg(CommandTopicPublish, body)); err != nil {
+			logger.Warn("PubSub forward", "addr", ip, "topic", msg.Topic, "err", err.Error())
+		}
+	}
+	return nil
+}
+
+func (ps *PubSub) announceAll() {
+	for _, ip := range ps.online() {
+		ps.announce(ip)
+	}
+}
+
+func (ps *PubSub) announce(ip string) {
+	ps.Lock()
+	ps.interest++
+	body, err := json.Marshal(topicInterest{Topics: ps.localTopics(), Origin: ps.origin, Seq: ps.interest})
+	ps.announced[ip] = true
+	ps.Unlock()
+	if err != nil {
+		logger.Error("PubSub interest marshal", "err", err.Error())
+		return
+	}
+	if err := ps.send(ip, newRawMsg(CommandTopicInterest, body)); err != nil {
+		logger.Warn("PubSub announce", "addr", ip, "err", err.Error())
+	}
+}
+
+func (ps *PubSub) onInterest(c *Context) {
+	var interest topicInterest
+	if err := json.Unmarshal(c.Body, &interest); err != nil {
+		logger.Error("PubSub interest unmarshal", "addr", c.IP, "err", err.Error())
+		return
+	}
+	topics := map[string]bool{}
+	for _, topic := range interest.Topics {
+		topics[topic] = true
+	}
+	ip := c.IP.String()
+	ps.Lock()
+	defer ps.Unlock()
+	if last, ok := ps.interests[ip]; ok && interest.Seq > 0 && last.Origin == interest.Origin && interest.Seq <= last.Seq {
+		logger.Debug("PubSub drop stale interest", "addr", c.IP, "seq", interest.Seq, "last", last.Seq)
+		return
+	}
+	ps.interests[ip] = topicInterest{Origin: interest.Origin, Seq: interest.Seq}
+	ps.peers[ip] = topics
+}
+
+func (ps *PubSub) onPublish(c *Context) {
+	var msg topicMessage
+	if err := json.Unmarshal(c.Body, &msg); err != nil {
+		logger.Error("PubSub publish unmarshal", "addr", c.IP, "err", err.Error())
+		return
+	}
+	var signed *signedTopicMessage
+	if len(msg.Envelope) > 0 {
+		var ok bool
+		if signed, ok = openTopicEnvelope(msg); !ok {
+			logger.Warn("PubSub drop forged publish", "addr", c.IP, "topic", msg.Topic)
+			return
+		}
+		msg.Data = signed.Data
+		opened := *c
+		opened.Address = signed.address
+		c = &opened
+	} else if ps.handler.signedOnly() {
+		logger.Warn("PubSub drop unsigned publish", "addr", c.IP, "topic", msg.Topic)
+		return
+	}
+	now := ps.now()
+	ps.Lock()
+	for id, t := range ps.seen {
+		if now.Sub(t) > topicSeenTime*time.Second {
+			delete(ps.seen, id)
+		}
+	}
+	if _, ok := ps.seen[msg.id()]; ok {
+		ps.Unlock()
+		return
+	}
+	ps.seen[msg.id()] = now
+	handlers := append([]TopicHandlerFunc{}, ps.topics[msg.Topic]...)
+	ps.Unlock()
+	// copies arriving over other paths were suppressed above, a stamp seen
+	// again is a replay
+	if signed != nil && !ps.handler.replay.check(signed.address, c.IP, signed.timestamp, signed.nonce, ps.handler.replay.clock()) {
+		return
+	}
+
+	for _, handler := range handlers {
+		handler(msg.Topic, msg.Data, c)
+	}
+	if msg.Hops++; msg.Hops < topicMaxHops {
+		ps.forward(msg, c.IP.String())
+	}
+}
+
+func (ps *PubSub) onPeerOnline(c *Context) {
+	ps.Lock()
+	announced := ps.announced[c.IP.String()]
+	ps.Unlock()
+	if !announced {
+		ps.announce(c.IP.String())
+	}
+}
+
+func (ps *PubSub) onPeerOffline(c *Context) {
+	ps.Lock()
+	delete(ps.peers, c.IP.String())
+	delete(ps.interests, c.IP.String())
+	delete(ps.announced, c.IP.String())
+	ps.Unlock()
+}
+
+func (msg topicMessage) id() string {
+	return fmt.Sprintf("%s/%d", msg.Origin, msg.Seq)
+}
+
+func randomOrigin() string {
+	bt := make([]byte, 8)
+	if _, err := rand.Read(bt); err != nil {
+		panic(err.Error())
+	}
+	return hex.EncodeToString(bt)
+}
+
+func writeToTCP(ip string, message Message) error {
+	if tcpServer == nil {
+		return errors.New("TCP server not start")
+	}
+	return tcpServer.WriteToTCP(message, ip)
+}
+
+func onlineIPs() []string {
+	if tcpServer == nil {
+		return nil
+	}
+	return tcpServer.OnlineIPs()
+}
+
+type signedTopicMessage struct {
+	topicMessage
+	address   string
+	timestamp time.Time
+	nonce     uint64
+}
+
+// openTopicEnvelope verify the envelope of msg, the signed topic, origin and
+// seq must match the routed ones
+func openTopicEnvelope(msg topicMessage) (*signedTopicMessage, bool) {
+	env, err := openEnvelope(msg.Envelope)
+	if err != nil || env.head.Command != CommandTopicPublish {
+		return nil, false
+	}
+	signed := &signedTopicMessage{address: env.address, timestamp: env.timestamp, nonce: env.nonce}
+	if err := json.Unmarshal(env.payload, &signed.topicMessage); err != nil {
+		return nil, false
+	}
+	return signed, signed.Topic == msg.Topic && signed.Origin == msg.Origin && signed.Seq == msg.Seq
+}
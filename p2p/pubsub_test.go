@@ -0,0 +1,121 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// wire pubsub instances together, delivering messages synchronously
+func newTestPubSubMesh(ips ...string) map[string]*PubSub {
+	mesh := map[string]*PubSub{}
+	for _, ip := range ips {
+		mesh[ip] = NewPubSub(NewEventHandler(nil))
+	}
+	for _, local := range ips {
+		local := local
+		mesh[local].online = func() (peers []string) {
+			for _, ip := range ips {
+				if ip != local {
+					peers = append(peers, ip)
+				}
+			}
+			return peers
+		}
+		mesh[local].send = func(ip string, message Message) error {
+			msg := message.(*Msg)
+			c := &Context{IP: net.ParseIP(local), Body: msg.Body, command: msg.Head.Command}
+			switch msg.Head.Command {
+			case CommandTopicInterest:
+				mesh[ip].onInterest(c)
+			case CommandTopicPublish:
+				mesh[ip].onPublish(c)
+			}
+			return nil
+		}
+	}
+	return mesh
+}
+
+func TestPubSub_Subscribe(t *testing.T) {
+	mesh := newTestPubSubMesh("10.0.0.1", "10.0.0.2", "10.0.0.3")
+
+	var received []string
+	mesh["10.0.0.2"].Subscribe("blocks", func(topic string, data []byte, c *Context) {
+		assert.Equal(t, "blocks", topic)
+		assert.Equal(t, "10.0.0.1", c.IP.String())
+		received = append(received, string(data))
+	})
+	assert.Equal(t, []string{"blocks"}, mesh["10.0.0.2"].Topics())
+	assert.Equal(t, []string{"blocks"}, mesh["10.0.0.1"].PeerTopics("10.0.0.2"))
+	assert.Empty(t, mesh["10.0.0.1"].PeerTopics("10.0.0.3"))
+
+	assert.NoError(t, mesh["10.0.0.1"].Publish("blocks", []byte("hello world")))
+	assert.NoError(t, mesh["10.0.0.1"].Publish("txs", []byte("ignored")))
+	assert.Equal(t, []string{"hello world"}, received)
+
+	mesh["10.0.0.2"].Unsubscribe("blocks")
+	assert.Empty(t, mesh["10.0.0.1"].PeerTopics("10.0.0.2"))
+	assert.NoError(t, mesh["10.0.0.1"].Publish("blocks", []byte("again")))
+	assert.Equal(t, 1, len(received))
+}
+
+func TestPubSub_Duplicate(t *testing.T) {
+	mesh := newTestPubSubMesh("10.0.0.1", "10.0.0.2", "10.0.0.3")
+
+	count := map[string]int{}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		ip := ip
+		mesh[ip].Subscribe("chat", func(topic string, data []byte, c *Context) {
+			count[ip]++
+		})
+	}
+	assert.NoError(t, mesh["10.0.0.1"].Publish("chat", []byte("hi")))
+	assert.Equal(t, 0, count["10.0.0.1"])
+	assert.Equal(t, 1, count["10.0.0.2"])
+	assert.Equal(t, 1, count["10.0.0.3"])
+}
+
+func TestPubSub_InterestOrder(t *testing.T) {
+	mesh := newTestPubSubMesh("10.0.0.1", "10.0.0.2")
+	a, b := mesh["10.0.0.1"], mesh["10.0.0.2"]
+	var sent []*Msg
+	b.send = func(ip string, message Message) error {
+		sent = append(sent, message.(*Msg))
+		return nil
+	}
+	b.Subscribe("chat", func(topic string, data []byte, c *Context) {})
+	b.Unsubscribe("chat")
+	assert.Len(t, sent, 2)
+
+	// the handlers of the two announcements ran in the wrong order
+	from := net.ParseIP("10.0.0.2")
+	a.onInterest(&Context{IP: from, Body: sent[1].Body})
+	a.onInterest(&Context{IP: from, Body: sent[0].Body})
+	assert.Empty(t, a.PeerTopics("10.0.0.2"))
+
+	// a restarted peer starts over with a new origin
+	restarted := NewPubSub(NewEventHandler(nil))
+	restarted.online = func() []string { return []string{"10.0.0.1"} }
+	restarted.send = b.send
+	restarted.Subscribe("blocks", func(topic string, data []byte, c *Context) {})
+	a.onInterest(&Context{IP: from, Body: sent[2].Body})
+	assert.Equal(t, []string{"blocks"}, a.PeerTopics("10.0.0.2"))
+
+	// seen messages age on the clock of the server sharing the handler
+	network := NewMemNetwork(1)
+	defer network.Close()
+	NewTCPServer(10001, a.handler).Transport = network.Host(from)
+	assert.Equal(t, network.Clock().Now(), a.now())
+}
+
+func TestPubSub_PeerOffline(t *testing.T) {
+	mesh := newTestPubSubMesh("10.0.0.1", "10.0.0.2")
+	mesh["10.0.0.2"].Subscribe("chat", func(topic string, data []byte, c *Context) {})
+	assert.Equal(t, []string{"chat"}, mesh["10.0.0.1"].PeerTopics("10.0.0.2"))
+
+	mesh["10.0.0.1"].onPeerOffline(&Context{IP: net.ParseIP("10.0.0.2"), command: NodeRemoveHandler})
+	assert.Empty(t, mesh["10.0.0.1"].PeerTopics("10.0.0.2"))
+	assert.Error(t, mesh["10.0.0.1"].Publish("", nil))
+}
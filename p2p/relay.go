@@ -0,0 +1,204 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// relay frame bodies:
+//   relay    target(8) command(2) payload
+//   deliver  origin(8) command(2) payload
+//   refused  target(8) reason(1)
+// relay and deliver keep the head msgId of the relayed message
+
+const (
+	relayRefusedUnknown byte = 1
+	relayRefusedQuota   byte = 2
+)
+
+// RelayQuota limit of messages and bytes a server node relays for one
+// source node within Window
+type RelayQuota struct {
+	Messages int
+	Bytes    int
+	Window   time.Duration
+}
+
+var DefaultRelayQuota = RelayQuota{Messages: 200, Bytes: 256 * 1024, Window: 10 * time.Second}
+
+type relayService struct {
+	quota RelayQuota
+	usage map[NodeID]*relayUsage
+	now   func() time.Time
+	sync.Mutex
+}
+
+type relayUsage struct {
+	start    time.Time
+	messages int
+	bytes    int
+}
+
+func newRelayService(quota RelayQuota) *relayService {
+	return &relayService{quota: quota, usage: map[NodeID]*relayUsage{}, now: time.Now}
+}
+
+func SetRelayQuota(quota RelayQuota) {
+	if tcpServer == nil {
+		return
+	}
+	tcpServer.relay.Lock()
+	tcpServer.relay.quota = quota
+	tcpServer.relay.Unlock()
+}
+
+// allow account size bytes for source, false if the quota is exhausted
+func (r *relayService) allow(source NodeID, size int) bool {
+	r.Lock()
+	defer r.Unlock()
+	now := r.now()
+	usage := r.usage[source]
+	if usage == nil || now.Sub(usage.start) > r.quota.Window {
+		usage = &relayUsage{start: now}
+		r.usage[source] = usage
+	}
+	if usage.messages+1 > r.quota.Messages || usage.bytes+size > r.quota.Bytes {
+		return false
+	}
+	usage.messages++
+	usage.bytes += size
+	return true
+}
+
+// handle relay frames, return false if message is not a relay frame
+func (s *TcpServer) handleRelay(node *TcpNode, message Message) bool {
+	body := message.GetBody()
+	switch message.GetCommand() {
+	case CommandRelay:
+		if LocalRole() != Server || len(body) < NodeIDLen+2 {
+			return true
+		}
+		node.Lock()
+		source := node.id
+		node.Unlock()
+		target := BytesToNodeID(body)
+		dst := s.NodeByID(target)
+		if dst == nil || source.IsEmpty() {
+			logger.Warn("TCP relay target not connected", "addr", node.addr.IP, "target", target)
+			node.WriteTo(newRawMsg(CommandRelayRefused, append(target[:], relayRefusedUnknown)))
+			return true
+		}
+		if !s.relay.allow(source, len(body)) {
+			logger.Warn("TCP relay quota exceeded", "addr", node.addr.IP, "source", source)
+			node.WriteTo(newRawMsg(CommandRelayRefused, append(target[:], relayRefusedQuota)))
+			return true
+		}
+		deliver := newRawMsg(CommandRelayDeliver, append(source[:], body[NodeIDLen:]...))
+		deliver.Head.MsgId = msgIDOf(message)
+		dst.WriteTo(deliver)
+	case CommandRelayDeliver:
+		if len(body) < NodeIDLen+2 {
+			return true
+		}
+		// only server nodes relay, the origin is their word for it
+		node.Lock()
+		fromServer := node.hello != nil && node.hello.Role == Server
+		node.Unlock()
+		if !fromServer {
+			logger.Warn("TCP drop relay deliver from non-server peer", "addr", node.addr.IP)
+			return true
+		}
+		command := Command(binary.BigEndian.Uint16(body[NodeIDLen:]))
+		if !isAppFrame(command) {
+			return true
+		}
+		origin := BytesToNodeID(body)
+		if !s.peerSupports(nil, origin, innerCommand(newRawMsg(command, body[NodeIDLen+2:]))) {
+			logger.Debug("TCP drop relayed msg of unsupported protocol", "relay", node.addr.IP, "origin", origin, "command", command)
+			return true
+		}
+		c := node.newContext()
+		node.Lock()
+		c.NodeName = node.name
+		node.Unlock()
+		c.Tag = NodeServer
+		c.Body = body[NodeIDLen+2:]
+		c.command = command
+		c.Origin = origin
+		c.MsgID = msgIDOf(message)
+		c.Relay = node.addr.IP
+		c.PeerID = NodeID{}
+		c.reply = func(reply Message) error { return s.sendRelay(origin, reply) }
+		s.handler.DoSomething(c)
+	case CommandRelayRefused:
+		if len(body) > NodeIDLen {
+			logger.Warn("TCP relay refused", "relay", node.addr.IP, "target", BytesToNodeID(body), "reason", body[NodeIDLen])
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// relayNodes connected server nodes in order of preference
+func (s *TcpServer) relayNodes() (nodes []*TcpNode) {
+	s.Lock()
+	defer s.Unlock()
+	var serverIPs []string
+	if udpServer != nil {
+		for _, ip := range udpServer.ServerIP {
+			serverIPs = append(serverIPs, ip.String())
+		}
+	}
+	added := map[string]bool{}
+	for _, ip := range serverIPs {
+		if node := s.nodes[ip]; node != nil && node.isRelay() {
+			nodes = append(nodes, node)
+			added[ip] = true
+		}
+	}
+	for ip, node := range s.nodes {
+		if !added[ip] && node.isRelay() {
+			nodes = append(nodes, node)
+		}
+	}
+	if s.preferNearby {
+		sortNearby(s.position(), nodes)
+	}
+	return nodes
+}
+
+func (node *TcpNode) isRelay() bool {
+	node.Lock()
+	defer node.Unlock()
+	return node.isOnline && node.isStart && node.tag == NodeServer
+}
+
+// SendMsgRelay send to node id, directly if connected otherwise through a
+// connected server node
+func (c *Context) SendMsgRelay(command Command, target NodeID, msgInfo interface{}) (err error) {
+	msg, err := getSendMsg(command, msgInfo)
+	if err != nil {
+		return err
+	}
+	if tcpServer == nil {
+		return errors.New("TCP server not start")
+	}
+	return tcpServer.sendRelay(target, msg)
+}
+
+func (s *TcpServer) sendRelay(target NodeID, msg Message) (err error) {
+	if node := s.NodeByID(target); node != nil {
+		return node.WriteTo(msg)
+	}
+	relay := newRawMsg(CommandRelay, encodeFrame(target[:], msg.GetCommand(), msg.GetBody()))
+	relay.Head.MsgId = msgIDOf(msg)
+	for _, node := range s.relayNodes() {
+		if err = node.WriteTo(relay); err == nil {
+			return nil
+		}
+	}
+	return errors.New("relay node not exist")
+}
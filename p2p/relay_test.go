@@ -0,0 +1,125 @@
+package p2p
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// connected TCP node, the returned conn is the remote end
+func newTestTcpNode(t *testing.T, s *TcpServer, id NodeID, tag int16) (*TcpNode, *net.TCPConn) {
+	listen, err := net.ListenTCP(tcp, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.NoError(t, err)
+	defer listen.Close()
+	remote, err := net.DialTCP(tcp, nil, listen.Addr().(*net.TCPAddr))
+	assert.NoError(t, err)
+	conn, err := listen.AcceptTCP()
+	assert.NoError(t, err)
+	node := newNode(conn.RemoteAddr().(*net.TCPAddr), true)
+	node.server = s
+	node.conn = conn
+	node.isStart = true
+	node.id = id
+	node.tag = tag
+	return node, remote
+}
+
+func readTestMsg(t *testing.T, conn *net.TCPConn) *Msg {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	head := make([]byte, HeadLen)
+	_, err := io.ReadFull(conn, head)
+	assert.NoError(t, err)
+	msg := &Msg{}
+	length, err := msg.UnmarshalBinary(head)
+	assert.NoError(t, err)
+	msg.Body = make([]byte, length)
+	_, err = io.ReadFull(conn, msg.Body)
+	assert.NoError(t, err)
+	return msg
+}
+
+func TestRelayService_Allow(t *testing.T) {
+	now := time.Now()
+	relay := newRelayService(RelayQuota{Messages: 2, Bytes: 10, Window: time.Second})
+	relay.now = func() time.Time { return now }
+
+	assert.True(t, relay.allow(NodeID{1}, 4))
+	assert.True(t, relay.allow(NodeID{1}, 4))
+	assert.False(t, relay.allow(NodeID{1}, 1))
+	assert.True(t, relay.allow(NodeID{2}, 10))
+	assert.False(t, relay.allow(NodeID{3}, 11))
+
+	now = now.Add(2 * time.Second)
+	assert.True(t, relay.allow(NodeID{1}, 4))
+}
+
+func TestTcpServer_HandleRelay(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	s := NewTCPServer(8891, NewEventHandler(nil))
+	SetRelayQuota(RelayQuota{Messages: 1, Bytes: 1024, Window: time.Minute})
+
+	source, sourceRemote := newTestTcpNode(t, s, NodeID{1}, NodeClient)
+	target, targetRemote := newTestTcpNode(t, s, NodeID{2}, NodeClient)
+	s.nodes["10.0.0.1"] = source
+	s.nodes["10.0.0.2"] = target
+
+	frame := encodeFrame([]byte{2}, 1000, []byte("hello"))
+	relay := newRawMsg(CommandRelay, frame)
+	assert.True(t, s.handleRelay(source, relay))
+	msg := readTestMsg(t, targetRemote)
+	assert.Equal(t, CommandRelayDeliver, msg.Head.Command)
+	assert.Equal(t, relay.Head.MsgId, msg.Head.MsgId)
+	assert.Equal(t, NodeID{1}, BytesToNodeID(msg.Body))
+	assert.Equal(t, "hello", string(msg.Body[NodeIDLen+2:]))
+
+	// quota exceeded
+	assert.True(t, s.handleRelay(source, newRawMsg(CommandRelay, frame)))
+	msg = readTestMsg(t, sourceRemote)
+	assert.Equal(t, CommandRelayRefused, msg.Head.Command)
+	assert.Equal(t, relayRefusedQuota, msg.Body[NodeIDLen])
+
+	// unknown target
+	assert.True(t, s.handleRelay(source, newRawMsg(CommandRelay, encodeFrame([]byte{3}, 1000, nil))))
+	msg = readTestMsg(t, sourceRemote)
+	assert.Equal(t, relayRefusedUnknown, msg.Body[NodeIDLen])
+
+	assert.False(t, s.handleRelay(source, NewMsg(1000, nil)))
+}
+
+func TestTcpServer_RelayDeliver(t *testing.T) {
+	s := NewTCPServer(8892, NewEventHandler(nil))
+	relay, _ := newTestTcpNode(t, s, NodeID{9}, NodeServer)
+	s.nodes["10.0.0.9"] = relay
+
+	received := make(chan *Context, 1)
+	s.handler.RegisterEventHandler(1000, func(c *Context) {
+		received <- c
+	})
+	deliver := newRawMsg(CommandRelayDeliver, encodeFrame([]byte{1}, 1000, []byte("hi")))
+	// a client cannot claim to relay
+	relay.hello = &Hello{Role: Client}
+	assert.True(t, s.handleRelay(relay, deliver))
+	assert.Empty(t, received)
+
+	relay.hello = &Hello{Role: Server}
+	assert.True(t, s.handleRelay(relay, deliver))
+	c := <-received
+	assert.Equal(t, "hi", string(c.Body))
+	assert.Equal(t, deliver.Head.MsgId, c.MsgID)
+	assert.Equal(t, NodeID{1}, c.Origin)
+	assert.Equal(t, relay.addr.IP, c.Relay)
+	assert.Equal(t, []*TcpNode{relay}, s.relayNodes())
+
+	// the origin sent no hello, commands of a protocol are dropped
+	s.handler.RegisterProtocol("chat", 1, 1001)
+	s.handler.RegisterEventHandler(1001, func(c *Context) {
+		received <- c
+	})
+	assert.True(t, s.handleRelay(relay, newRawMsg(CommandRelayDeliver, encodeFrame([]byte{1}, 1001, []byte("hi")))))
+	assert.Empty(t, received)
+}
@@ -0,0 +1,320 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// reliable UDP frame bodies, big endian:
+//   data  session(4) seq(4) index(2) count(2) command(2) payload
+//   ack   session(4) seq(4) index(2)
+
+const (
+	reliableDataLen = 14
+	reliableAckLen  = 10
+)
+
+var errReliableClosed = errors.New("reliable UDP closed")
+
+// ReliableUDP acknowledged UDP datagrams, payloads larger than one fragment
+// are split and reassembled, unacked fragments are retransmitted with a
+// doubling timeout and duplicates are suppressed by session and sequence
+type ReliableUDP struct {
+	conn    udpWriter
+	deliver func(addr *net.UDPAddr, command Command, msgID int16, data []byte)
+	now     func() time.Time
+	session uint32
+	seq     uint32
+	pending map[uint32]*reliableOutgoing
+	inbound map[string]*reliableInbound
+	// reassemblies in flight per peer ip
+	inflight map[string]int
+	received map[string]time.Time
+	closed   bool
+	done     chan struct{}
+	sync.Mutex
+}
+
+type reliableOutgoing struct {
+	addr      *net.UDPAddr
+	msgID     int16
+	fragments [][]byte
+	acked     []bool
+	remaining int
+	retries   int
+	next      time.Time
+	done      chan error
+}
+
+type reliableInbound struct {
+	peer      string
+	command   Command
+	msgID     int16
+	fragments [][]byte
+	remaining int
+	started   time.Time
+}
+
+func NewReliableUDP(conn udpWriter, deliver func(addr *net.UDPAddr, command Command, msgID int16, data []byte)) *ReliableUDP {
+	return &ReliableUDP{
+		conn:     conn,
+		deliver:  deliver,
+		now:      time.Now,
+		session:  rand.Uint32(),
+		pending:  map[uint32]*reliableOutgoing{},
+		inbound:  map[string]*reliableInbound{},
+		inflight: map[string]int{},
+		received: map[string]time.Time{},
+		done:     make(chan struct{}),
+	}
+}
+
+// Close fail every send waiting for acknowledgements, later sends fail
+// right away
+func (r *ReliableUDP) Close() {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.done)
+	for seq, out := range r.pending {
+		delete(r.pending, seq)
+		out.done <- errReliableClosed
+	}
+}
+
+// Send data to addr, return after every fragment is acknowledged or the
+// retransmissions are exhausted
+func (r *ReliableUDP) Send(addr *net.UDPAddr, command Command, data []byte) error {
+	return r.send(addr, command, 0, data)
+}
+
+// send every fragment carries msgID in its head
+func (r *ReliableUDP) send(addr *net.UDPAddr, command Command, msgID int16, data []byte) error {
+	count := (len(data) + reliableFragmentSize - 1) / reliableFragmentSize
+	if count == 0 {
+		count = 1
+	}
+	if count > reliableMaxFragments {
+		return fmt.Errorf("reliable UDP payload too large len:%d", len(data))
+	}
+	r.Lock()
+	if r.closed {
+		r.Unlock()
+		return errReliableClosed
+	}
+	r.seq++
+	seq := r.seq
+	out := &reliableOutgoing{
+		addr:      addr,
+		msgID:     msgID,
+		fragments: make([][]byte, count),
+		acked:     make([]bool, count),
+		remaining: count,
+		next:      r.now().Add(reliableRetryTime * time.Millisecond),
+		done:      make(chan error, 1),
+	}
+	for i := range out.fragments {
+		start, end := i*reliableFragmentSize, (i+1)*reliableFragmentSize
+		if end > len(data) {
+			end = len(data)
+		}
+		frame := make([]byte, reliableDataLen, reliableDataLen+end-start)
+		binary.BigEndian.PutUint32(frame, r.session)
+		binary.BigEndian.PutUint32(frame[4:], seq)
+		binary.BigEndian.PutUint16(frame[8:], uint16(i))
+		binary.BigEndian.PutUint16(frame[10:], uint16(count))
+		binary.BigEndian.PutUint16(frame[12:], uint16(command))
+		out.fragments[i] = append(frame, data[start:end]...)
+	}
+	r.pending[seq] = out
+	r.Unlock()
+	for _, fragment := range out.fragments {
+		if err := r.conn.WriteToUDP(out.frame(fragment), addr); err != nil {
+			r.Lock()
+			delete(r.pending, seq)
+			r.Unlock()
+			return err
+		}
+	}
+	select {
+	case err := <-out.done:
+		return err
+	case <-r.done:
+		return errReliableClosed
+	}
+}
+
+// Tick retransmit unacked fragments and expire reassembly state
+func (r *ReliableUDP) Tick() {
+	type resend struct {
+		addr  *net.UDPAddr
+		frame *Msg
+	}
+	var resends []resend
+	r.Lock()
+	now := r.now()
+	for seq, out := range r.pending {
+		if now.Before(out.next) {
+			continue
+		}
+		if out.retries >= reliableMaxRetries {
+			delete(r.pending, seq)
+			out.done <- errors.New("reliable UDP not acknowledged")
+			continue
+		}
+		out.retries++
+		out.next = now.Add(reliableRetryTime * time.Millisecond << uint(out.retries))
+		for i, fragment := range out.fragments {
+			if !out.acked[i] {
+				resends = append(resends, resend{out.addr, out.frame(fragment)})
+			}
+		}
+	}
+	for key, in := range r.inbound {
+		if now.Sub(in.started) > reliableSeenTime*time.Second {
+			r.remove(key, in)
+		}
+	}
+	for key, t := range r.received {
+		if now.Sub(t) > reliableSeenTime*time.Second {
+			delete(r.received, key)
+		}
+	}
+	r.Unlock()
+	for _, re := range resends {
+		r.conn.WriteToUDP(re.frame, re.addr)
+	}
+}
+
+func (r *ReliableUDP) run(clock Clock, done <-chan struct{}) {
+	for sleep(clock, reliableTickTime*time.Millisecond, done) {
+		r.Tick()
+	}
+}
+
+// handle reliable frames, return false if message is not a reliable frame
+func (r *ReliableUDP) handle(message Message, addr *net.UDPAddr) bool {
+	body := message.GetBody()
+	switch message.GetCommand() {
+	case CommandReliableData:
+		if len(body) < reliableDataLen {
+			return true
+		}
+		r.onData(body, msgIDOf(message), addr)
+	case CommandReliableAck:
+		if len(body) < reliableAckLen {
+			return true
+		}
+		r.onAck(body, addr)
+	default:
+		return false
+	}
+	return true
+}
+
+func (r *ReliableUDP) onData(body []byte, msgID int16, addr *net.UDPAddr) {
+	index := binary.BigEndian.Uint16(body[8:])
+	count := binary.BigEndian.Uint16(body[10:])
+	if count == 0 || count > reliableMaxFragments || index >= count {
+		return
+	}
+	key := fmt.Sprintf("%s/%x", addr, body[:8])
+	peer := addr.IP.String()
+	r.Lock()
+	_, done := r.received[key]
+	full := !done && r.inbound[key] == nil && r.inflight[peer] >= reliableMaxInbound
+	r.Unlock()
+	if full {
+		// not acknowledged, the sender retransmits
+		logger.Warn("Reliable UDP too many reassemblies", "addr", addr, "max", reliableMaxInbound)
+		return
+	}
+	// acknowledge duplicates too, the previous ack may have been lost
+	r.conn.WriteToUDP(newRawMsg(CommandReliableAck, append([]byte{}, body[:reliableAckLen]...)), addr)
+
+	r.Lock()
+	if _, ok := r.received[key]; ok {
+		r.Unlock()
+		return
+	}
+	in := r.inbound[key]
+	if in == nil {
+		if r.inflight[peer] >= reliableMaxInbound {
+			r.Unlock()
+			return
+		}
+		in = &reliableInbound{
+			peer:      peer,
+			msgID:     msgID,
+			command:   Command(binary.BigEndian.Uint16(body[12:])),
+			fragments: make([][]byte, count),
+			remaining: int(count),
+			started:   r.now(),
+		}
+		r.inbound[key] = in
+		r.inflight[peer]++
+	}
+	if int(count) != len(in.fragments) || in.fragments[index] != nil {
+		r.Unlock()
+		return
+	}
+	in.fragments[index] = append([]byte{}, body[reliableDataLen:]...)
+	in.remaining--
+	if in.remaining > 0 {
+		r.Unlock()
+		return
+	}
+	r.remove(key, in)
+	r.received[key] = r.now()
+	r.Unlock()
+
+	var data []byte
+	for _, fragment := range in.fragments {
+		data = append(data, fragment...)
+	}
+	r.deliver(addr, in.command, in.msgID, data)
+}
+
+// frame a data frame of the fragment
+func (out *reliableOutgoing) frame(fragment []byte) *Msg {
+	frame := newRawMsg(CommandReliableData, fragment)
+	frame.Head.MsgId = out.msgID
+	return frame
+}
+
+// remove a reassembly, called with the lock held
+func (r *ReliableUDP) remove(key string, in *reliableInbound) {
+	delete(r.inbound, key)
+	if r.inflight[in.peer]--; r.inflight[in.peer] <= 0 {
+		delete(r.inflight, in.peer)
+	}
+}
+
+// onAck complete a fragment acknowledged by the address it was sent to
+func (r *ReliableUDP) onAck(body []byte, addr *net.UDPAddr) {
+	r.Lock()
+	defer r.Unlock()
+	if binary.BigEndian.Uint32(body) != r.session {
+		return
+	}
+	seq := binary.BigEndian.Uint32(body[4:])
+	index := binary.BigEndian.Uint16(body[8:])
+	out := r.pending[seq]
+	if out == nil || out.addr.String() != addr.String() || int(index) >= len(out.acked) || out.acked[index] {
+		return
+	}
+	out.acked[index] = true
+	out.remaining--
+	if out.remaining == 0 {
+		delete(r.pending, seq)
+		out.done <- nil
+	}
+}
@@ -0,0 +1,223 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lossyLink delivers frames straight to the peer, drop decides per frame
+type lossyLink struct {
+	from *net.UDPAddr
+	peer *ReliableUDP
+	sent int
+	drop func(n int, message Message) bool
+	sync.Mutex
+}
+
+func (l *lossyLink) WriteToUDP(message Message, addr *net.UDPAddr) error {
+	l.Lock()
+	l.sent++
+	drop := l.drop != nil && l.drop(l.sent, message)
+	l.Unlock()
+	if drop {
+		return nil
+	}
+	l.peer.handle(message, l.from)
+	return nil
+}
+
+func newReliablePair(clock *VirtualClock) (a, b *ReliableUDP, ab, ba *lossyLink, delivered chan []byte) {
+	delivered = make(chan []byte, 8)
+	ab = &lossyLink{from: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 10000}}
+	ba = &lossyLink{from: &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 10000}}
+	a = NewReliableUDP(ab, func(addr *net.UDPAddr, command Command, msgID int16, data []byte) {})
+	b = NewReliableUDP(ba, func(addr *net.UDPAddr, command Command, msgID int16, data []byte) {
+		delivered <- data
+	})
+	ab.peer, ba.peer = b, a
+	a.now = clock.Now
+	b.now = clock.Now
+	return
+}
+
+func sendAsync(r *ReliableUDP, data []byte) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Send(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 10000}, 100, data)
+	}()
+	return done
+}
+
+func tickUntil(clock *VirtualClock, r *ReliableUDP, done chan error) error {
+	for i := 0; i < 300; i++ {
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Millisecond):
+		}
+		clock.Advance(reliableTickTime * time.Millisecond)
+		r.Tick()
+	}
+	return <-done
+}
+
+func TestReliableUDP_Fragments(t *testing.T) {
+	clock := NewVirtualClock(time.Now())
+	a, b, ab, ba, delivered := newReliablePair(clock)
+	data := bytes.Repeat([]byte("0123456789"), 500)
+
+	// lose the first copy of the third fragment and every second ack
+	ab.drop = func(n int, message Message) bool { return n == 3 }
+	ba.drop = func(n int, message Message) bool { return n%2 == 0 }
+	assert.NoError(t, tickUntil(clock, a, sendAsync(a, data)))
+	assert.Equal(t, data, <-delivered)
+	assert.Empty(t, a.pending)
+	assert.Empty(t, b.inbound)
+	assert.Equal(t, 1, len(b.received))
+
+	// retransmitted duplicates are acknowledged but not delivered again
+	assert.True(t, ab.sent > 5)
+	select {
+	case <-delivered:
+		t.Fatal("duplicate delivered")
+	default:
+	}
+
+	assert.NoError(t, tickUntil(clock, a, sendAsync(a, nil)))
+	assert.Empty(t, <-delivered)
+
+	clock.Advance(reliableSeenTime*time.Second + time.Second)
+	b.Tick()
+	assert.Empty(t, b.received)
+}
+
+func TestReliableUDP_Timeout(t *testing.T) {
+	clock := NewVirtualClock(time.Now())
+	a, _, ab, _, _ := newReliablePair(clock)
+	ab.drop = func(n int, message Message) bool { return true }
+	assert.Error(t, tickUntil(clock, a, sendAsync(a, []byte("lost"))))
+	assert.Equal(t, 1+reliableMaxRetries, ab.sent)
+	assert.Empty(t, a.pending)
+
+	err := a.Send(&net.UDPAddr{}, 100, make([]byte, reliableFragmentSize*reliableMaxFragments+1))
+	assert.Error(t, err)
+}
+
+func TestReliableUDP_MaxInbound(t *testing.T) {
+	clock := NewVirtualClock(time.Now())
+	a, b, ab, _, _ := newReliablePair(clock)
+	// first fragments only, every reassembly stays open
+	ab.drop = func(n int, message Message) bool { return binary.BigEndian.Uint16(message.GetBody()[8:]) > 0 }
+	data := make([]byte, 2*reliableFragmentSize)
+	for i := 0; i < reliableMaxInbound+2; i++ {
+		sendAsync(a, data)
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		ab.Lock()
+		sent := ab.sent
+		ab.Unlock()
+		if sent == 2*(reliableMaxInbound+2) {
+			break
+		}
+	}
+	b.Lock()
+	assert.Equal(t, reliableMaxInbound, len(b.inbound))
+	assert.Equal(t, reliableMaxInbound, b.inflight["10.0.0.1"])
+	b.Unlock()
+
+	clock.Advance(reliableSeenTime*time.Second + time.Second)
+	b.Tick()
+	b.Lock()
+	assert.Empty(t, b.inbound)
+	assert.Empty(t, b.inflight)
+	b.Unlock()
+}
+
+func TestUdpServer_Reliable(t *testing.T) {
+	network := NewMemNetwork(1)
+	defer network.Close()
+	network.SetLoss(0.2)
+	received := make(chan *Context, 1)
+	handler := NewEventHandler(nil)
+	handler.RegisterEventHandler(100, func(c *Context) {
+		received <- c
+	})
+	servers := []*UdpServer{}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		server := NewUDPServer(10000, handler)
+		server.SetTransport(network.Host(net.ParseIP(ip)))
+		go server.Start()
+		servers = append(servers, server)
+	}
+	network.Clock().Advance(time.Millisecond)
+
+	data := bytes.Repeat([]byte("x"), 10*reliableFragmentSize+7)
+	done := make(chan error, 1)
+	go func() {
+		done <- servers[0].SendReliable(NewMsg(100, data), &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 10000})
+	}()
+	var err error
+	assert.True(t, advanceUntil(network.Clock(), reliableTickTime*time.Millisecond, 200, func() bool {
+		select {
+		case err = <-done:
+			return true
+		default:
+			return false
+		}
+	}))
+	assert.NoError(t, err)
+	c := <-received
+	assert.Equal(t, "10.0.0.1", c.IP.String())
+	assert.Equal(t, data, c.Body)
+}
+
+func TestReliableUDP_Close(t *testing.T) {
+	clock := NewVirtualClock(time.Now())
+	a, _, ab, _, _ := newReliablePair(clock)
+	ab.drop = func(n int, message Message) bool { return true }
+	done := sendAsync(a, []byte("pending"))
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		ab.Lock()
+		sent := ab.sent
+		ab.Unlock()
+		if sent == 1 {
+			break
+		}
+	}
+	a.Close()
+	assert.Equal(t, errReliableClosed, <-done)
+	assert.Empty(t, a.pending)
+	assert.Equal(t, errReliableClosed, <-sendAsync(a, []byte("late")))
+}
+
+func TestReliableUDP_ForgedAck(t *testing.T) {
+	clock := NewVirtualClock(time.Now())
+	a, _, ab, _, _ := newReliablePair(clock)
+	ab.drop = func(n int, message Message) bool { return true }
+	done := sendAsync(a, []byte("data"))
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		ab.Lock()
+		sent := ab.sent
+		ab.Unlock()
+		if sent == 1 {
+			break
+		}
+	}
+	ack := make([]byte, reliableAckLen)
+	binary.BigEndian.PutUint32(ack, a.session)
+	binary.BigEndian.PutUint32(ack[4:], 1)
+
+	// only the address the data went to completes the send
+	a.handle(newRawMsg(CommandReliableAck, ack), &net.UDPAddr{IP: net.ParseIP("10.6.6.6"), Port: 10000})
+	a.Lock()
+	assert.Equal(t, 1, len(a.pending))
+	a.Unlock()
+	a.handle(newRawMsg(CommandReliableAck, ack), &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 10000})
+	assert.NoError(t, <-done)
+}
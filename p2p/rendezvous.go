@@ -0,0 +1,446 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP rendezvous frame bodies, big endian:
+//   register      id(8)
+//   observed      ip(4) port(2)
+//   punch request target(8)
+//   punch notify  peer(8) ip(4) port(2) token(8)
+//   probe, ack    id(8) token(8)
+//   data          from(8) command(2) payload
+//   relay         target or from(8) command(2) payload
+// data and relay keep the head msgId of the carried message
+
+const (
+	PunchPending = "punching"
+	PunchDirect  = "direct"
+	PunchRelay   = "relay"
+)
+
+type udpWriter interface {
+	WriteToUDP(message Message, addr *net.UDPAddr) error
+}
+
+// Rendezvous server nodes record the public endpoints of clients and
+// coordinate UDP hole punching between two clients, clients fall back to
+// relaying through the server when punching fails
+type Rendezvous struct {
+	conn     udpWriter
+	handler  *EventHandler
+	id       func() NodeID
+	isServer func() bool
+	// supports false if command belongs to a protocol peer did not advertise
+	supports func(peer NodeID, command Command) bool
+	now      func() time.Time
+	// nearby orders servers for punching, nearest first, nil keeps the order
+	nearby   func(servers []*net.UDPAddr)
+	servers  []*net.UDPAddr
+	public   *net.UDPAddr
+	clients  map[NodeID]*rendezvousClient
+	sessions map[NodeID]*punchSession
+	sync.Mutex
+}
+
+type rendezvousClient struct {
+	addr     *net.UDPAddr
+	lastTime time.Time
+}
+
+// punchSession token is issued by the server with the notify, probes are
+// only accepted with it and from the notified endpoint
+type punchSession struct {
+	peer    NodeID
+	addr    *net.UDPAddr
+	server  *net.UDPAddr
+	token   uint64
+	state   string
+	started time.Time
+}
+
+func NewRendezvous(conn udpWriter, handler *EventHandler) *Rendezvous {
+	return &Rendezvous{
+		conn:     conn,
+		handler:  handler,
+		id:       LocalNodeID,
+		isServer: func() bool { return LocalRole() == Server },
+		supports: func(peer NodeID, command Command) bool {
+			_, _, ok := handler.protocolOf(command)
+			return !ok
+		},
+		now:      time.Now,
+		clients:  map[NodeID]*rendezvousClient{},
+		sessions: map[NodeID]*punchSession{},
+	}
+}
+
+// AddServer add a server node used for registration, punching and relaying
+func (r *Rendezvous) AddServer(addr *net.UDPAddr) {
+	r.Lock()
+	defer r.Unlock()
+	for _, server := range r.servers {
+		if server.String() == addr.String() {
+			return
+		}
+	}
+	r.servers = append(r.servers, addr)
+}
+
+// PublicAddr endpoint observed by the server, nil before registration
+func (r *Rendezvous) PublicAddr() *net.UDPAddr {
+	r.Lock()
+	defer r.Unlock()
+	return r.public
+}
+
+// Connect ask a server node to coordinate hole punching with peer
+func (r *Rendezvous) Connect(peer NodeID) error {
+	r.Lock()
+	servers := append([]*net.UDPAddr{}, r.servers...)
+	r.Unlock()
+	if len(servers) == 0 {
+		return errors.New("rendezvous server not exist")
+	}
+	if r.nearby != nil {
+		r.nearby(servers)
+	}
+	server := servers[0]
+	r.Lock()
+	if session := r.sessions[peer]; session != nil && session.state != PunchRelay {
+		r.Unlock()
+		return nil
+	}
+	r.sessions[peer] = &punchSession{peer: peer, server: server, state: PunchPending, started: r.now()}
+	r.Unlock()
+	return r.conn.WriteToUDP(newRawMsg(CommandPunchRequest, peer[:]), server)
+}
+
+// State punch state of peer, empty if no session
+func (r *Rendezvous) State(peer NodeID) string {
+	r.Lock()
+	defer r.Unlock()
+	if session := r.sessions[peer]; session != nil {
+		return session.state
+	}
+	return ""
+}
+
+// Send data to peer directly if punched, otherwise relay through the server
+func (r *Rendezvous) Send(peer NodeID, command Command, data []byte) error {
+	return r.sendMsg(peer, newRawMsg(command, data))
+}
+
+// sendMsg the rendezvous frame carries the message id of msg
+func (r *Rendezvous) sendMsg(peer NodeID, msg Message) error {
+	command, data := msg.GetCommand(), msg.GetBody()
+	if !isAppFrame(command) {
+		return errors.New("command must be above 50")
+	}
+	r.Lock()
+	session := r.sessions[peer]
+	if session == nil {
+		r.Unlock()
+		return errors.New("peer session not exist")
+	}
+	state, addr, server := session.state, session.addr, session.server
+	r.Unlock()
+	if state == PunchDirect {
+		id := r.id()
+		frame := newRawMsg(CommandPeerData, encodeFrame(id[:], command, data))
+		frame.Head.MsgId = msgIDOf(msg)
+		return r.conn.WriteToUDP(frame, addr)
+	}
+	frame := newRawMsg(CommandRelayUDP, encodeFrame(peer[:], command, data))
+	frame.Head.MsgId = msgIDOf(msg)
+	return r.conn.WriteToUDP(frame, server)
+}
+
+// Tick keep registrations alive, retransmit probes and expire state
+func (r *Rendezvous) Tick() {
+	now := r.now()
+	id := r.id()
+	r.Lock()
+	servers := append([]*net.UDPAddr{}, r.servers...)
+	var probes []punchSession
+	var requests []*punchSession
+	for _, session := range r.sessions {
+		if session.state != PunchPending {
+			continue
+		}
+		if now.Sub(session.started) > punchTimeout*time.Second {
+			logger.Warn("Rendezvous punch timeout, use relay", "peer", session.peer, "server", session.server)
+			session.state = PunchRelay
+			continue
+		}
+		if session.addr != nil {
+			probes = append(probes, *session)
+		} else if session.server != nil {
+			requests = append(requests, session)
+		}
+	}
+	for peer, client := range r.clients {
+		if now.Sub(client.lastTime) > rendezvousExpireTime*time.Second {
+			delete(r.clients, peer)
+		}
+	}
+	r.Unlock()
+
+	if !r.isServer() {
+		for _, server := range servers {
+			r.conn.WriteToUDP(newRawMsg(CommandRendezvousRegister, id[:]), server)
+		}
+	}
+	for _, session := range requests {
+		r.conn.WriteToUDP(newRawMsg(CommandPunchRequest, session.peer[:]), session.server)
+	}
+	for _, session := range probes {
+		r.conn.WriteToUDP(newRawMsg(CommandPunchProbe, encodeProbe(id, session.token)), session.addr)
+	}
+}
+
+func (r *Rendezvous) run(clock Clock, done <-chan struct{}) {
+	for sleep(clock, udpTimer*time.Second, done) {
+		r.Tick()
+	}
+}
+
+// handle rendezvous frames, return false if message is not a rendezvous frame
+func (r *Rendezvous) handle(message Message, addr *net.UDPAddr) bool {
+	msg, ok := message.(*Msg)
+	if !ok {
+		return false
+	}
+	body := msg.Body
+	switch msg.Head.Command {
+	case CommandRendezvousRegister:
+		if len(body) < NodeIDLen || !r.isServer() {
+			return true
+		}
+		if !r.register(BytesToNodeID(body), addr) {
+			return true
+		}
+		r.conn.WriteToUDP(newRawMsg(CommandRendezvousObserved, encodeEndpoint(addr)), addr)
+	case CommandRendezvousObserved:
+		if public := decodeEndpoint(body); public != nil {
+			r.Lock()
+			r.public = public
+			r.Unlock()
+		}
+	case CommandPunchRequest:
+		if len(body) < NodeIDLen || !r.isServer() {
+			return true
+		}
+		r.onPunchRequest(BytesToNodeID(body), addr)
+	case CommandPunchNotify:
+		if len(body) < NodeIDLen+6+8 || !r.isKnownServer(addr) {
+			return true
+		}
+		r.onPunchNotify(BytesToNodeID(body), decodeEndpoint(body[NodeIDLen:]), addr, binary.BigEndian.Uint64(body[NodeIDLen+6:]))
+	case CommandPunchProbe, CommandPunchAck:
+		if len(body) < NodeIDLen+8 {
+			return true
+		}
+		peer := BytesToNodeID(body)
+		token := binary.BigEndian.Uint64(body[NodeIDLen:])
+		r.Lock()
+		session := r.sessions[peer]
+		valid := session != nil && session.token != 0 && session.token == token &&
+			session.addr != nil && session.addr.String() == addr.String()
+		if valid {
+			session.state = PunchDirect
+		}
+		r.Unlock()
+		if !valid {
+			logger.Debug("Rendezvous drop probe not matching a session", "addr", addr, "peer", peer)
+			return true
+		}
+		if msg.Head.Command == CommandPunchProbe {
+			r.conn.WriteToUDP(newRawMsg(CommandPunchAck, encodeProbe(r.id(), token)), addr)
+		}
+	case CommandPeerData:
+		r.deliver(msg, addr, false)
+	case CommandRelayUDP:
+		if r.isServer() {
+			r.relay(msg, addr)
+		} else if r.isKnownServer(addr) {
+			r.deliver(msg, addr, true)
+		} else {
+			logger.Debug("Rendezvous drop relayed msg not from a server", "addr", addr)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// register bind peer to addr, a live binding from another address is kept
+// until it expires since the register frame carries no proof of identity
+func (r *Rendezvous) register(peer NodeID, addr *net.UDPAddr) bool {
+	now := r.now()
+	r.Lock()
+	defer r.Unlock()
+	if client := r.clients[peer]; client != nil && client.addr.String() != addr.String() &&
+		now.Sub(client.lastTime) <= rendezvousExpireTime*time.Second {
+		logger.Warn("Rendezvous refuse register of bound peer", "addr", addr, "peer", peer, "bound", client.addr)
+		return false
+	}
+	r.clients[peer] = &rendezvousClient{addr: addr, lastTime: now}
+	return true
+}
+
+func (r *Rendezvous) onPunchRequest(target NodeID, addr *net.UDPAddr) {
+	r.Lock()
+	source, sourceID := r.clientByAddr(addr)
+	client := r.clients[target]
+	r.Unlock()
+	if source == nil {
+		logger.Warn("Rendezvous punch request from unregistered client", "addr", addr)
+		return
+	}
+	if client == nil {
+		logger.Warn("Rendezvous punch target not registered", "addr", addr, "target", target)
+		return
+	}
+	token := make([]byte, 8)
+	binary.BigEndian.PutUint64(token, randomNonce())
+	notify := append(append(target[:], encodeEndpoint(client.addr)...), token...)
+	r.conn.WriteToUDP(newRawMsg(CommandPunchNotify, notify), addr)
+	notify = append(append(sourceID[:], encodeEndpoint(addr)...), token...)
+	r.conn.WriteToUDP(newRawMsg(CommandPunchNotify, notify), client.addr)
+}
+
+// isKnownServer true if addr is one of the added servers, only they issue
+// punch sessions
+func (r *Rendezvous) isKnownServer(addr *net.UDPAddr) bool {
+	r.Lock()
+	defer r.Unlock()
+	for _, server := range r.servers {
+		if server.String() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rendezvous) onPunchNotify(peer NodeID, peerAddr, server *net.UDPAddr, token uint64) {
+	if peerAddr == nil {
+		return
+	}
+	r.Lock()
+	session := r.sessions[peer]
+	if session == nil {
+		session = &punchSession{peer: peer, state: PunchPending, started: r.now()}
+		r.sessions[peer] = session
+	}
+	if session.state == PunchDirect {
+		r.Unlock()
+		return
+	}
+	session.addr = peerAddr
+	session.server = server
+	session.token = token
+	r.Unlock()
+	r.conn.WriteToUDP(newRawMsg(CommandPunchProbe, encodeProbe(r.id(), token)), peerAddr)
+}
+
+func (r *Rendezvous) relay(msg *Msg, addr *net.UDPAddr) {
+	body := msg.Body
+	if len(body) < NodeIDLen+2 {
+		return
+	}
+	target := BytesToNodeID(body)
+	r.Lock()
+	source, sourceID := r.clientByAddr(addr)
+	client := r.clients[target]
+	r.Unlock()
+	if source == nil || client == nil {
+		logger.Warn("Rendezvous relay peer not registered", "addr", addr, "target", target)
+		return
+	}
+	frame := newRawMsg(CommandRelayUDP, append(sourceID[:], body[NodeIDLen:]...))
+	frame.Head.MsgId = msg.Head.MsgId
+	r.conn.WriteToUDP(frame, client.addr)
+}
+
+// deliver app frame to the handler, the sender id in the body is only trusted
+// when the frame came from a rendezvous server or from the punched address of
+// that peer
+func (r *Rendezvous) deliver(msg *Msg, addr *net.UDPAddr, relayed bool) {
+	body := msg.Body
+	if len(body) < NodeIDLen+2 {
+		return
+	}
+	command := Command(binary.BigEndian.Uint16(body[NodeIDLen:]))
+	if !isAppFrame(command) {
+		return
+	}
+	from := BytesToNodeID(body)
+	if !relayed {
+		r.Lock()
+		session := r.sessions[from]
+		valid := session != nil && session.state == PunchDirect &&
+			session.addr != nil && session.addr.String() == addr.String()
+		r.Unlock()
+		if !valid {
+			logger.Debug("Rendezvous drop msg not from peer session", "addr", addr, "peer", from)
+			return
+		}
+	}
+	if !r.supports(from, innerCommand(newRawMsg(command, body[NodeIDLen+2:]))) {
+		logger.Debug("Rendezvous drop msg of unsupported protocol", "addr", addr, "peer", from, "command", command)
+		return
+	}
+	r.handler.DoSomething(&Context{
+		IP:         addr.IP,
+		command:    command,
+		Body:       body[NodeIDLen+2:],
+		PeerID:     from,
+		MsgID:      msg.Head.MsgId,
+		ReceivedAt: r.now(),
+		Transport:  TransportUDP,
+		reply:      func(reply Message) error { return r.sendMsg(from, reply) },
+	})
+}
+
+func (r *Rendezvous) clientByAddr(addr *net.UDPAddr) (*rendezvousClient, NodeID) {
+	for id, client := range r.clients {
+		if client.addr.String() == addr.String() {
+			return client, id
+		}
+	}
+	return nil, NodeID{}
+}
+
+func encodeFrame(id []byte, command Command, data []byte) []byte {
+	frame := make([]byte, NodeIDLen+2, NodeIDLen+2+len(data))
+	copy(frame, id)
+	binary.BigEndian.PutUint16(frame[NodeIDLen:], uint16(command))
+	return append(frame, data...)
+}
+
+func encodeProbe(id NodeID, token uint64) []byte {
+	bt := make([]byte, NodeIDLen+8)
+	copy(bt, id[:])
+	binary.BigEndian.PutUint64(bt[NodeIDLen:], token)
+	return bt
+}
+
+func encodeEndpoint(addr *net.UDPAddr) []byte {
+	bt := make([]byte, 6)
+	copy(bt, addr.IP.To4())
+	binary.BigEndian.PutUint16(bt[4:], uint16(addr.Port))
+	return bt
+}
+
+func decodeEndpoint(bt []byte) *net.UDPAddr {
+	if len(bt) < 6 {
+		return nil
+	}
+	return &net.UDPAddr{IP: net.IPv4(bt[0], bt[1], bt[2], bt[3]).To4(), Port: int(binary.BigEndian.Uint16(bt[4:]))}
+}
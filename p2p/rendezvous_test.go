@@ -0,0 +1,262 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// simulated network of hosts, some of them behind a NAT
+type natNet struct {
+	hosts map[string]*natHost
+	nats  map[string]*natBox
+}
+
+type natHost struct {
+	addr *net.UDPAddr
+	nat  *natBox
+	r    *Rendezvous
+	net  *natNet
+}
+
+// natBox restricted cone NAT, a symmetric NAT allocates a port per destination
+type natBox struct {
+	ip        net.IP
+	symmetric bool
+	nextPort  int
+	mappings  map[string]*net.UDPAddr
+	inbound   map[string]*natHost
+	allowed   map[string]bool
+}
+
+func newNatNet() *natNet {
+	return &natNet{hosts: map[string]*natHost{}, nats: map[string]*natBox{}}
+}
+
+func (n *natNet) addNat(ip string, symmetric bool) *natBox {
+	nat := &natBox{ip: net.ParseIP(ip).To4(), symmetric: symmetric, nextPort: 40000,
+		mappings: map[string]*net.UDPAddr{}, inbound: map[string]*natHost{}, allowed: map[string]bool{}}
+	n.nats[ip] = nat
+	return nat
+}
+
+func (n *natNet) addHost(addr string, nat *natBox, isServer bool, id byte) *natHost {
+	udpAddr, _ := net.ResolveUDPAddr(udp, addr)
+	host := &natHost{addr: udpAddr, nat: nat, net: n}
+	host.r = NewRendezvous(host, NewEventHandler(nil))
+	host.r.id = func() NodeID { return NodeID{id} }
+	host.r.isServer = func() bool { return isServer }
+	n.hosts[udpAddr.String()] = host
+	return host
+}
+
+func (h *natHost) WriteToUDP(message Message, addr *net.UDPAddr) error {
+	src := h.addr
+	if h.nat != nil {
+		key := src.String()
+		if h.nat.symmetric {
+			key += ">" + addr.String()
+		}
+		public := h.nat.mappings[key]
+		if public == nil {
+			h.nat.nextPort++
+			public = &net.UDPAddr{IP: h.nat.ip, Port: h.nat.nextPort}
+			h.nat.mappings[key] = public
+			h.nat.inbound[public.String()] = h
+		}
+		h.nat.allowed[public.String()+"<"+addr.IP.String()] = true
+		src = public
+	}
+	data, err := message.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	var dst *natHost
+	if nat := h.net.nats[addr.IP.String()]; nat != nil {
+		if !nat.allowed[addr.String()+"<"+src.IP.String()] {
+			return nil // filtered by NAT
+		}
+		dst = nat.inbound[addr.String()]
+	} else {
+		dst = h.net.hosts[addr.String()]
+	}
+	if dst == nil {
+		return fmt.Errorf("host %s unreachable", addr)
+	}
+	msg := &Msg{}
+	if _, err := msg.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	msg.SetBody(data[HeadLen:])
+	dst.r.handle(msg, src)
+	return nil
+}
+
+func TestRendezvous_Register(t *testing.T) {
+	n := newNatNet()
+	server := n.addHost("8.8.8.8:10000", nil, true, 0xff)
+	client := n.addHost("192.168.1.2:10000", n.addNat("1.1.1.1", false), false, 1)
+	client.r.AddServer(server.addr)
+	client.r.AddServer(server.addr)
+	assert.Nil(t, client.r.PublicAddr())
+
+	client.r.Tick()
+	assert.Equal(t, "1.1.1.1:40001", client.r.PublicAddr().String())
+	assert.Equal(t, 1, len(server.r.clients))
+	assert.Equal(t, 1, len(client.r.servers))
+}
+
+func TestRendezvous_Punch(t *testing.T) {
+	n := newNatNet()
+	server := n.addHost("8.8.8.8:10000", nil, true, 0xff)
+	a := n.addHost("192.168.1.2:10000", n.addNat("1.1.1.1", false), false, 1)
+	b := n.addHost("192.168.0.9:10000", n.addNat("2.2.2.2", false), false, 2)
+	a.r.AddServer(server.addr)
+	b.r.AddServer(server.addr)
+	a.r.Tick()
+	b.r.Tick()
+
+	received := make(chan string, 1)
+	b.r.handler.RegisterEventHandler(1000, func(c *Context) {
+		received <- string(c.Body)
+	})
+	assert.NoError(t, a.r.Connect(NodeID{2}))
+	assert.Equal(t, PunchDirect, a.r.State(NodeID{2}))
+	assert.Equal(t, PunchDirect, b.r.State(NodeID{1}))
+	assert.Equal(t, "2.2.2.2:40001", a.r.sessions[NodeID{2}].addr.String())
+
+	assert.NoError(t, a.r.Send(NodeID{2}, 1000, []byte("hello")))
+	assert.Equal(t, "hello", <-received)
+	// commands of a protocol need a TCP hello of the peer
+	b.r.handler.RegisterProtocol("chat", 1, 1001)
+	b.r.handler.RegisterEventHandler(1001, func(c *Context) {
+		received <- string(c.Body)
+	})
+	assert.NoError(t, a.r.Send(NodeID{2}, 1001, []byte("chat")))
+	assert.Empty(t, received)
+	b.r.supports = func(peer NodeID, command Command) bool { return peer == NodeID{1} }
+	assert.NoError(t, a.r.Send(NodeID{2}, 1001, []byte("chat")))
+	assert.Equal(t, "chat", <-received)
+	assert.Error(t, a.r.Send(NodeID{3}, 1000, nil))
+	assert.Error(t, a.r.Send(NodeID{2}, CommandHeartbeat, nil))
+}
+
+func TestRendezvous_NearbyServer(t *testing.T) {
+	n := newNatNet()
+	far := n.addHost("8.8.8.8:10000", nil, true, 0xfe)
+	near := n.addHost("9.9.9.9:10000", nil, true, 0xff)
+	a := n.addHost("192.168.1.2:10000", n.addNat("1.1.1.1", false), false, 1)
+	a.r.AddServer(far.addr)
+	a.r.AddServer(near.addr)
+	a.r.nearby = func(servers []*net.UDPAddr) {
+		servers[0], servers[1] = servers[1], servers[0]
+	}
+	assert.NoError(t, a.r.Connect(NodeID{2}))
+	assert.Equal(t, near.addr, a.r.sessions[NodeID{2}].server)
+}
+
+func TestRendezvous_ForgedProbe(t *testing.T) {
+	n := newNatNet()
+	server := n.addHost("8.8.8.8:10000", nil, true, 0xff)
+	a := n.addHost("192.168.1.2:10000", n.addNat("1.1.1.1", false), false, 1)
+	a.r.AddServer(server.addr)
+	peer := &net.UDPAddr{IP: net.ParseIP("2.2.2.2").To4(), Port: 40001}
+	a.r.sessions[NodeID{2}] = &punchSession{peer: NodeID{2}, addr: peer, server: server.addr, token: 7, state: PunchPending}
+
+	// wrong token, wrong address
+	a.r.handle(newRawMsg(CommandPunchAck, encodeProbe(NodeID{2}, 8)), peer)
+	assert.Equal(t, PunchPending, a.r.State(NodeID{2}))
+	attacker := &net.UDPAddr{IP: net.ParseIP("6.6.6.6").To4(), Port: 40001}
+	a.r.handle(newRawMsg(CommandPunchAck, encodeProbe(NodeID{2}, 7)), attacker)
+	assert.Equal(t, PunchPending, a.r.State(NodeID{2}))
+	assert.Equal(t, peer, a.r.sessions[NodeID{2}].addr)
+
+	// notify only from a known server
+	id := NodeID{3}
+	notify := append(append(id[:], encodeEndpoint(attacker)...), 0, 0, 0, 0, 0, 0, 0, 1)
+	a.r.handle(newRawMsg(CommandPunchNotify, notify), attacker)
+	assert.Equal(t, "", a.r.State(NodeID{3}))
+
+	a.r.handle(newRawMsg(CommandPunchAck, encodeProbe(NodeID{2}, 7)), peer)
+	assert.Equal(t, PunchDirect, a.r.State(NodeID{2}))
+}
+
+func TestRendezvous_ForgedSender(t *testing.T) {
+	n := newNatNet()
+	server := n.addHost("8.8.8.8:10000", nil, true, 0xff)
+	a := n.addHost("192.168.1.2:10000", n.addNat("1.1.1.1", false), false, 1)
+	a.r.AddServer(server.addr)
+	received := make(chan NodeID, 3)
+	a.r.handler.RegisterEventHandler(1000, func(c *Context) {
+		received <- c.PeerID
+	})
+	peer := &net.UDPAddr{IP: net.ParseIP("2.2.2.2").To4(), Port: 40001}
+	attacker := &net.UDPAddr{IP: net.ParseIP("6.6.6.6").To4(), Port: 40001}
+	a.r.sessions[NodeID{2}] = &punchSession{peer: NodeID{2}, addr: peer, server: server.addr, token: 7, state: PunchDirect}
+	id, other := NodeID{2}, NodeID{3}
+
+	// direct frames only from the punched address, relayed only from a server
+	a.r.handle(newRawMsg(CommandPeerData, encodeFrame(id[:], 1000, nil)), attacker)
+	a.r.handle(newRawMsg(CommandRelayUDP, encodeFrame(id[:], 1000, nil)), attacker)
+	a.r.handle(newRawMsg(CommandPeerData, encodeFrame(other[:], 1000, nil)), peer)
+	a.r.handle(newRawMsg(CommandPeerData, encodeFrame(id[:], 1000, nil)), peer)
+	a.r.handle(newRawMsg(CommandRelayUDP, encodeFrame(id[:], 1000, nil)), server.addr)
+	assert.Equal(t, id, <-received)
+	assert.Equal(t, id, <-received)
+	assert.Empty(t, received)
+
+	// a live binding is not taken over from another address
+	assert.True(t, server.r.register(id, peer))
+	assert.False(t, server.r.register(id, attacker))
+	assert.Equal(t, peer, server.r.clients[id].addr)
+	server.r.clients[id].lastTime = server.r.now().Add(-(rendezvousExpireTime + 1) * time.Second)
+	assert.True(t, server.r.register(id, attacker))
+}
+
+func TestRendezvous_RelayFallback(t *testing.T) {
+	n := newNatNet()
+	server := n.addHost("8.8.8.8:10000", nil, true, 0xff)
+	a := n.addHost("192.168.1.2:10000", n.addNat("1.1.1.1", true), false, 1)
+	b := n.addHost("192.168.0.9:10000", n.addNat("2.2.2.2", true), false, 2)
+	a.r.AddServer(server.addr)
+	b.r.AddServer(server.addr)
+	a.r.Tick()
+	b.r.Tick()
+
+	received := make(chan *Context, 1)
+	b.r.handler.RegisterEventHandler(1000, func(c *Context) {
+		received <- c
+	})
+	assert.NoError(t, a.r.Connect(NodeID{2}))
+	assert.Equal(t, PunchPending, a.r.State(NodeID{2}))
+
+	// expire punching
+	a.r.sessions[NodeID{2}].started = a.r.sessions[NodeID{2}].started.Add(-(punchTimeout + 1) * time.Second)
+	a.r.Tick()
+	assert.Equal(t, PunchRelay, a.r.State(NodeID{2}))
+
+	assert.NoError(t, a.r.Send(NodeID{2}, 1000, []byte("relayed")))
+	c := <-received
+	assert.Equal(t, "relayed", string(c.Body))
+	assert.Equal(t, "8.8.8.8", c.IP.String())
+
+	// replies keep the message id through the server
+	replies := make(chan *Context, 1)
+	a.r.handler.RegisterEventHandler(1001, func(c *Context) {
+		replies <- c
+	})
+	assert.NoError(t, c.Reply(1001, "pong"))
+	reply := <-replies
+	assert.Equal(t, c.MsgID, reply.MsgID)
+	assert.NotEqual(t, int16(0), reply.MsgID)
+}
+
+func TestEndpointEncode(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 10000}
+	assert.Equal(t, []byte{10, 1, 2, 3, 0x27, 0x10}, encodeEndpoint(addr))
+	assert.Equal(t, addr.String(), decodeEndpoint(encodeEndpoint(addr)).String())
+	assert.Nil(t, decodeEndpoint([]byte{1, 2}))
+}
@@ -0,0 +1,236 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ReplayStale     = "stale"
+	ReplayFuture    = "future"
+	ReplayDuplicate = "duplicate"
+)
+
+// ReplayStats counters of stamped messages checked by a ReplayGuard
+type ReplayStats struct {
+	Accepted  uint64 `json:"accepted"`
+	Stale     uint64 `json:"stale"`
+	Future    uint64 `json:"future"`
+	Duplicate uint64 `json:"duplicate"`
+}
+
+// ReplayGuard reject stamped messages that are older or newer than the
+// clock skew allows or whose nonce was already seen from the same peer
+// within the window, the skew is measured against the network time
+type ReplayGuard struct {
+	skew time.Duration
+	now  func() time.Time
+	// skewHeartbeats apply the skew to unsigned heartbeat stamps too
+	skewHeartbeats bool
+	peers          map[string]*replayWindow
+	pruned         time.Time
+	stats          ReplayStats
+	onReject       func(peer string, ip net.IP, reason string)
+	score          func(ip net.IP)
+	sync.Mutex
+}
+
+// replayWindow nonces of one peer, stamps at or before floor are rejected
+// once the window overflowed
+type replayWindow struct {
+	nonces map[uint64]time.Time
+	floor  time.Time
+}
+
+func newReplayGuard(skew time.Duration) *ReplayGuard {
+	return &ReplayGuard{skew: skew, peers: map[string]*replayWindow{}}
+}
+
+// SetSkew clock skew tolerated between peers
+func (g *ReplayGuard) SetSkew(skew time.Duration) {
+	if skew <= 0 {
+		panic("replay skew must be positive")
+	}
+	g.Lock()
+	g.skew = skew
+	g.Unlock()
+}
+
+// OnReject called for every rejected message, peer is the address or ip the
+// window is kept for
+func (g *ReplayGuard) OnReject(onReject func(peer string, ip net.IP, reason string)) {
+	g.Lock()
+	g.onReject = onReject
+	g.Unlock()
+}
+
+// SkewHeartbeats reject heartbeats whose stamp is off by more than the
+// skew, off by default, their stamps are unsigned and drifting devices
+// would be dropped
+func (g *ReplayGuard) SkewHeartbeats(on bool) {
+	g.Lock()
+	g.skewHeartbeats = on
+	g.Unlock()
+}
+
+// clock the network time when bound to a TCP server, the local time otherwise
+func (g *ReplayGuard) clock() time.Time {
+	g.Lock()
+	now := g.now
+	g.Unlock()
+	if now == nil {
+		return time.Now()
+	}
+	return now()
+}
+
+func (g *ReplayGuard) Stats() ReplayStats {
+	g.Lock()
+	defer g.Unlock()
+	return g.stats
+}
+
+// check the stamp of a message from peer received at now
+func (g *ReplayGuard) check(peer string, ip net.IP, stamp time.Time, nonce uint64, now time.Time) bool {
+	return g.checkSkew(peer, ip, stamp, nonce, now, true)
+}
+
+// checkHeartbeat duplicate nonces only unless heartbeats are skewed
+func (g *ReplayGuard) checkHeartbeat(peer string, ip net.IP, stamp time.Time, nonce uint64, now time.Time) bool {
+	g.Lock()
+	skew := g.skewHeartbeats
+	g.Unlock()
+	return g.checkSkew(peer, ip, stamp, nonce, now, skew)
+}
+
+func (g *ReplayGuard) checkSkew(peer string, ip net.IP, stamp time.Time, nonce uint64, now time.Time, skew bool) bool {
+	g.Lock()
+	reason := g.reject(peer, stamp, nonce, now, skew)
+	onReject, score := g.onReject, g.score
+	g.Unlock()
+	if reason == "" {
+		return true
+	}
+	logger.Warn("Replay rejected", "peer", peer, "addr", ip, "reason", reason, "stamp", stamp)
+	if score != nil && ip != nil {
+		score(ip)
+	}
+	if onReject != nil {
+		onReject(peer, ip, reason)
+	}
+	return false
+}
+
+// reject the reason stamp is rejected, without skew the nonce is kept for
+// the window from now and only duplicates are rejected
+func (g *ReplayGuard) reject(peer string, stamp time.Time, nonce uint64, now time.Time, skew bool) string {
+	if now.Sub(g.pruned) > g.skew {
+		g.prune(now)
+	}
+	window := g.peers[peer]
+	if window == nil {
+		window = &replayWindow{nonces: map[uint64]time.Time{}}
+		g.peers[peer] = window
+	}
+	if !skew {
+		if _, ok := window.nonces[nonce]; ok {
+			g.stats.Duplicate++
+			return ReplayDuplicate
+		}
+		window.nonces[nonce] = now
+		if len(window.nonces) > replayMaxNonces {
+			window.shrink()
+		}
+		g.stats.Accepted++
+		return ""
+	}
+	switch {
+	case stamp.Before(now.Add(-g.skew)) || !stamp.After(window.floor):
+		g.stats.Stale++
+		return ReplayStale
+	case stamp.After(now.Add(g.skew)):
+		g.stats.Future++
+		return ReplayFuture
+	}
+	if _, ok := window.nonces[nonce]; ok {
+		g.stats.Duplicate++
+		return ReplayDuplicate
+	}
+	window.nonces[nonce] = stamp
+	if len(window.nonces) > replayMaxNonces {
+		window.shrink()
+	}
+	g.stats.Accepted++
+	return ""
+}
+
+// prune nonces that are stale anyway
+func (g *ReplayGuard) prune(now time.Time) {
+	g.pruned = now
+	oldest := now.Add(-g.skew)
+	for peer, window := range g.peers {
+		for nonce, stamp := range window.nonces {
+			if stamp.Before(oldest) {
+				delete(window.nonces, nonce)
+			}
+		}
+		if len(window.nonces) == 0 && window.floor.Before(oldest) {
+			delete(g.peers, peer)
+		}
+	}
+}
+
+// shrink drop the older half of the nonces and raise the floor above them
+func (w *replayWindow) shrink() {
+	stamps := make([]time.Time, 0, len(w.nonces))
+	for _, stamp := range w.nonces {
+		stamps = append(stamps, stamp)
+	}
+	sort.Slice(stamps, func(i, j int) bool { return stamps[i].Before(stamps[j]) })
+	w.floor = stamps[len(stamps)/2]
+	for nonce, stamp := range w.nonces {
+		if !stamp.After(w.floor) {
+			delete(w.nonces, nonce)
+		}
+	}
+}
+
+func randomNonce() uint64 {
+	var bt [8]byte
+	rand.Read(bt[:])
+	return binary.BigEndian.Uint64(bt[:])
+}
+
+// heartbeatStamp freshness fields of heartbeat bodies
+type heartbeatStamp struct {
+	Timestamp int64  `json:"ts,omitempty"`
+	Nonce     uint64 `json:"nonce,omitempty"`
+}
+
+func newHeartbeatStamp(now time.Time) heartbeatStamp {
+	return heartbeatStamp{Timestamp: now.UnixNano() / int64(time.Millisecond), Nonce: randomNonce()}
+}
+
+// checkStamp reject replayed heartbeats, heartbeats of peers that do not
+// stamp them are accepted
+func (node *TcpNode) checkStamp(message Message) bool {
+	var stamp heartbeatStamp
+	if err := json.Unmarshal(message.GetBody(), &stamp); err != nil || stamp.Timestamp == 0 {
+		return true
+	}
+	server := node.server
+	ts := time.Unix(0, stamp.Timestamp*int64(time.Millisecond))
+	return server.handler.replay.checkHeartbeat(node.addr.IP.String(), node.addr.IP, ts, stamp.Nonce, server.netTime.Now())
+}
+
+// replayRejected lower the score of a peer sending replayed messages
+func (s *TcpServer) replayRejected(ip net.IP) {
+	if s.peerStore != nil {
+		s.peerStore.Penalize(ip.String())
+	}
+}
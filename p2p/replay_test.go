@@ -0,0 +1,101 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayGuard_Check(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	guard := newReplayGuard(10 * time.Second)
+	var rejected []string
+	guard.OnReject(func(peer string, ip net.IP, reason string) {
+		rejected = append(rejected, peer+" "+reason)
+	})
+
+	assert.True(t, guard.check("a", nil, now, 1, now))
+	assert.True(t, guard.check("b", nil, now, 1, now))
+	assert.False(t, guard.check("a", nil, now.Add(time.Second), 1, now))
+	assert.True(t, guard.check("a", nil, now.Add(-9*time.Second), 2, now))
+	assert.False(t, guard.check("a", nil, now.Add(-11*time.Second), 3, now))
+	assert.False(t, guard.check("a", nil, now.Add(11*time.Second), 4, now))
+	assert.Equal(t, []string{"a duplicate", "a stale", "a future"}, rejected)
+	assert.Equal(t, ReplayStats{Accepted: 3, Stale: 1, Future: 1, Duplicate: 1}, guard.Stats())
+
+	// a looser skew accepts the delayed message
+	guard.SetSkew(time.Minute)
+	assert.True(t, guard.check("a", nil, now.Add(-11*time.Second), 3, now))
+	assert.Panics(t, func() { guard.SetSkew(0) })
+
+	// expired nonces are pruned, their stamps are stale anyway
+	now = now.Add(2 * time.Minute)
+	assert.True(t, guard.check("c", nil, now, 1, now))
+	assert.Nil(t, guard.peers["a"])
+	assert.Nil(t, guard.peers["b"])
+}
+
+func TestReplayGuard_Window(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	guard := newReplayGuard(time.Hour)
+	for i := 0; i <= replayMaxNonces; i++ {
+		assert.True(t, guard.check("a", nil, now.Add(time.Duration(i)*time.Millisecond), uint64(i), now))
+	}
+	window := guard.peers["a"]
+	assert.True(t, len(window.nonces) <= replayMaxNonces/2+1)
+	// nonces dropped from the window are rejected by the floor
+	assert.False(t, guard.check("a", nil, now, 1<<40, now))
+	assert.True(t, guard.check("a", nil, now.Add(time.Minute), 1<<40, now))
+}
+
+func TestTcpNode_CheckStamp(t *testing.T) {
+	s := NewTCPServer(10001, NewEventHandler(nil))
+	store, _ := OpenPeerStore(filepath.Join(os.TempDir(), "not-exist", "peers.json"))
+	s.SetPeerStore(store)
+	node, remote := newTestTcpNode(t, s, NodeID{1}, NodeServer)
+	defer remote.Close()
+
+	heartbeat := NewMsg(CommandHeartbeat, s.getBroadcastMsg(newHeartbeatStamp(time.Now()), timeReply{}))
+	assert.True(t, node.checkStamp(heartbeat))
+	assert.False(t, node.checkStamp(heartbeat))
+	assert.True(t, node.checkStamp(NewMsg(CommandHeartbeat, s.getBroadcastMsg(newHeartbeatStamp(time.Now()), timeReply{}))))
+	// nameless clients answer with an empty body
+	assert.Nil(t, s.getClientResponseMsg(timeReply{}))
+	s.broadcastData.NodeName = "phone"
+	assert.True(t, node.checkStamp(NewMsg(CommandHeartbeat, s.getClientResponseMsg(timeReply{}))))
+	assert.True(t, node.checkStamp(NewMsg(CommandHeartbeat, []byte(`{"nodeName":"old"}`))))
+
+	// unsigned stamps of a drifting device pass unless heartbeats are skewed
+	stale := fmt.Sprintf(`{"ts":%d,"nonce":1}`, time.Now().Add(-time.Hour).UnixNano()/int64(time.Millisecond))
+	assert.True(t, node.checkStamp(NewMsg(CommandHeartbeat, []byte(stale))))
+	s.handler.replay.SkewHeartbeats(true)
+	defer s.handler.replay.SkewHeartbeats(false)
+	stale = fmt.Sprintf(`{"ts":%d,"nonce":2}`, time.Now().Add(-time.Hour).UnixNano()/int64(time.Millisecond))
+	assert.False(t, node.checkStamp(NewMsg(CommandHeartbeat, []byte(stale))))
+	peer, ok := store.Get(node.addr.IP.String())
+	assert.True(t, ok)
+	assert.Equal(t, -2*peerFailureScore, peer.Score)
+	assert.Equal(t, 0, peer.Failures)
+
+	// the skew is measured against the network time
+	for i := 0; i < netTimeMinPeers; i++ {
+		s.netTime.peers[fmt.Sprintf("10.0.0.%d", i)] = &peerClock{samples: []clockSample{{offset: -time.Hour}}, updated: time.Now()}
+	}
+	assert.True(t, node.checkStamp(NewMsg(CommandHeartbeat, []byte(stale))))
+}
+
+func TestReplayGuard_Heartbeat(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	guard := newReplayGuard(10 * time.Second)
+	assert.True(t, guard.checkHeartbeat("a", nil, now.Add(-time.Hour), 1, now))
+	assert.False(t, guard.checkHeartbeat("a", nil, now.Add(-time.Hour), 1, now))
+	assert.True(t, guard.checkHeartbeat("a", nil, now.Add(time.Hour), 2, now))
+	// kept from the receive time, not the stamp
+	assert.False(t, guard.checkHeartbeat("a", nil, now.Add(-time.Hour), 1, now.Add(5*time.Second)))
+	assert.Equal(t, ReplayStats{Accepted: 2, Duplicate: 2}, guard.Stats())
+}
@@ -1,10 +1,121 @@
 package p2p
 
 import (
-	"os"
+	"fmt"
+	"path/filepath"
 	"runtime"
+	"sync"
 )
 
+var dataDir string
+var dataDirMu = sync.Mutex{}
+
+// SetDataDir directory StartP2PServer keeps the peer store in, peers are not
+// persisted while no directory is set
+func SetDataDir(dir string) {
+	dataDirMu.Lock()
+	dataDir = dir
+	dataDirMu.Unlock()
+}
+
+// DataDir the directory set by SetDataDir
+func DataDir() string {
+	dataDirMu.Lock()
+	defer dataDirMu.Unlock()
+	return dataDir
+}
+
+// P2PServer the UDP server on a port and the TCP server on the next one,
+// sharing a handler and the peer store of the data directory
+type P2PServer struct {
+	UDP     *UdpServer
+	TCP     *TcpServer
+	started bool
+	done    chan struct{}
+	once    sync.Once
+	sync.Mutex
+}
+
+// NewP2PServer servers on udpPort and udpPort+1, the peer store is opened
+// when a data directory is set
+func NewP2PServer(udpPort int, handler *EventHandler) (*P2PServer, error) {
+	p := &P2PServer{
+		UDP:  NewUDPServer(udpPort, handler),
+		TCP:  NewTCPServer(udpPort+1, handler),
+		done: make(chan struct{}),
+	}
+	p.UDP.BindTCP(p.TCP)
+	if dir := DataDir(); dir != "" {
+		path := filepath.Join(dir, peerStoreName)
+		store, err := OpenPeerStore(path)
+		if err != nil {
+			return nil, fmt.Errorf("open peer store %s err:%s", path, err.Error())
+		}
+		p.TCP.SetPeerStore(store)
+	}
+	return p, nil
+}
+
+// Listen bind both ports, none stays bound on error
+func (p *P2PServer) Listen() error {
+	if err := p.UDP.Listen(); err != nil {
+		return err
+	}
+	if err := p.TCP.Listen(); err != nil {
+		p.UDP.Close()
+		return err
+	}
+	return nil
+}
+
+// Start serve both servers in the background, Done is closed once both
+// stopped
+func (p *P2PServer) Start() {
+	p.Lock()
+	p.started = true
+	p.Unlock()
+	var servers sync.WaitGroup
+	servers.Add(2)
+	go func() {
+		defer servers.Done()
+		if err := p.UDP.Start(); err != nil {
+			logger.Error("p2p UDP server stopped", "err", err.Error())
+		}
+	}()
+	go func() {
+		defer servers.Done()
+		if err := p.TCP.Start(); err != nil {
+			logger.Error("p2p TCP server stopped", "err", err.Error())
+		}
+	}()
+	go func() {
+		servers.Wait()
+		p.once.Do(func() { close(p.done) })
+	}()
+}
+
+// Close stop both servers and save the peer store
+func (p *P2PServer) Close() error {
+	tcpErr := p.TCP.Close()
+	udpErr := p.UDP.Close()
+	p.Lock()
+	started := p.started
+	p.Unlock()
+	if !started {
+		p.once.Do(func() { close(p.done) })
+	}
+	if tcpErr != nil {
+		return tcpErr
+	}
+	return udpErr
+}
+
+// Done closed once the servers stopped
+func (p *P2PServer) Done() <-chan struct{} {
+	return p.done
+}
+
+// StartP2PServer run a server node on ReleasePort until its servers stop
 func StartP2PServer(handler *EventHandler) {
 	udpPort := ReleasePort
 	//udpPort := DebugPort
@@ -12,11 +123,17 @@ func StartP2PServer(handler *EventHandler) {
 	if runtime.GOOS == "android" {
 		udpPort = ReleasePort
 	}
-	if err := os.Setenv(NodeType, Server); err != nil {
-		panic(err.Error())
-	}
+	SetRole(Server)
 	logger.Info("p2p run ......", "port", udpPort, "os", runtime.GOOS, "ip", GetLocalIp())
-	go NewUDPServer(udpPort, handler).Start()
-
-	NewTCPServer(udpPort+1, handler).Start()
+	server, err := NewP2PServer(udpPort, handler)
+	if err != nil {
+		logger.Error("p2p start", "err", err.Error())
+		return
+	}
+	if err := server.Listen(); err != nil {
+		logger.Error("p2p start", "err", err.Error())
+		return
+	}
+	server.Start()
+	<-server.Done()
 }
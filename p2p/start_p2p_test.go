@@ -1,8 +1,14 @@
 package p2p
 
 import (
+	"io/ioutil"
+	"net"
+	"os"
 	"runtime"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestStartP2P(t *testing.T) {
@@ -15,3 +21,37 @@ func TestStartP2P(t *testing.T) {
 func TestOS(t *testing.T) {
 	t.Log(runtime.GOOS)
 }
+
+func TestP2PServer_Listen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	SetDataDir(dir)
+	defer SetDataDir("")
+	network := NewMemNetwork(1)
+	defer network.Close()
+	host := network.Host(net.ParseIP("10.0.0.1"))
+	newServer := func() *P2PServer {
+		server, err := NewP2PServer(10000, NewEventHandler(nil))
+		assert.NoError(t, err)
+		server.UDP.SetTransport(host)
+		server.TCP.Transport = host
+		return server
+	}
+
+	// a port in use is an error and leaves nothing bound
+	busy, _ := host.Listen(10001)
+	server := newServer()
+	assert.Error(t, server.Listen())
+	assert.NoError(t, server.Close())
+	<-server.Done()
+	busy.Close()
+
+	server = newServer()
+	assert.NotNil(t, server.TCP.peerStore)
+	assert.NoError(t, server.Listen())
+	server.Start()
+	network.Clock().Advance(time.Second)
+	assert.NoError(t, server.Close())
+	<-server.Done()
+}
@@ -0,0 +1,426 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// ErrStreamReset the stream was aborted by either side
+var ErrStreamReset = errors.New("stream reset")
+
+// StreamHandler serve a stream opened by a peer, it runs in its own goroutine
+type StreamHandler func(stream *Stream)
+
+// Stream bidirectional byte stream multiplexed with others over one peer
+// connection, each direction has its own flow-control window and can be
+// closed on its own
+type Stream struct {
+	id          uint32
+	command     Command
+	mux         *streamMux
+	readBuf     []byte
+	readEOF     bool
+	readClosed  bool
+	writeClosed bool
+	err         error
+	sendWindow  int
+	unacked     int
+	cond        *sync.Cond
+	sync.Mutex
+}
+
+// streamMux streams of one connection, ids opened by the dialing side are
+// odd and by the accepting side even
+type streamMux struct {
+	node    *TcpNode
+	conn    net.Conn
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+	sync.Mutex
+}
+
+func newStreamMux(node *TcpNode, conn net.Conn) *streamMux {
+	mux := &streamMux{node: node, conn: conn, streams: map[uint32]*Stream{}, nextID: 2}
+	if !node.isServer {
+		mux.nextID = 1
+	}
+	return mux
+}
+
+func (mux *streamMux) newStream(id uint32, command Command) *Stream {
+	stream := &Stream{id: id, command: command, mux: mux, sendWindow: streamWindow}
+	stream.cond = sync.NewCond(&stream.Mutex)
+	mux.streams[id] = stream
+	return stream
+}
+
+// streams of the current connection, nil without one
+func (node *TcpNode) getMux() *streamMux {
+	node.Lock()
+	defer node.Unlock()
+	if node.conn == nil || !node.isOnline {
+		return nil
+	}
+	if node.mux == nil || node.mux.conn != node.conn {
+		node.mux = newStreamMux(node, node.conn)
+	}
+	return node.mux
+}
+
+// HandleStream accept streams opened on command with fn, streams on
+// commands without a handler are reset
+func (e *EventHandler) HandleStream(command Command, fn StreamHandler) {
+	e.Lock()
+	e.streamHandlers[command] = fn
+	e.Unlock()
+}
+
+func (e *EventHandler) streamHandler(command Command) StreamHandler {
+	e.Lock()
+	defer e.Unlock()
+	return e.streamHandlers[command]
+}
+
+// OpenStream open a stream to the peer at ip, command names the
+// application protocol the peer serves it with
+func (s *TcpServer) OpenStream(ip string, command Command) (*Stream, error) {
+	if !isAppCommand(command) {
+		return nil, errors.New("stream command must be an application command")
+	}
+	s.Lock()
+	node := s.nodes[ip]
+	s.Unlock()
+	if node == nil {
+		return nil, errors.New("node not exist")
+	}
+	if !node.supports(command) {
+		return nil, errors.New("peer does not support the stream protocol")
+	}
+	mux := node.getMux()
+	if mux == nil {
+		return nil, errors.New("node not online")
+	}
+	mux.Lock()
+	if mux.err != nil {
+		mux.Unlock()
+		return nil, mux.err
+	}
+	if len(mux.streams) >= streamMaxPerConn {
+		mux.Unlock()
+		return nil, errors.New("too many streams")
+	}
+	stream := mux.newStream(mux.nextID, command)
+	mux.nextID += 2
+	mux.Unlock()
+	body := make([]byte, 6)
+	binary.BigEndian.PutUint32(body, stream.id)
+	binary.BigEndian.PutUint16(body[4:], uint16(command))
+	if err := stream.send(CommandStreamOpen, body); err != nil {
+		mux.remove(stream)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (stream *Stream) ID() uint32 {
+	return stream.id
+}
+
+// Command the application protocol of the stream
+func (stream *Stream) Command() Command {
+	return stream.command
+}
+
+func (stream *Stream) RemoteIP() net.IP {
+	return stream.mux.node.addr.IP
+}
+
+// Read buffered data, io.EOF once the peer closed its side and the buffer
+// is drained
+func (stream *Stream) Read(p []byte) (int, error) {
+	stream.Lock()
+	for len(stream.readBuf) == 0 && !stream.readEOF && !stream.readClosed && stream.err == nil {
+		stream.cond.Wait()
+	}
+	if len(stream.readBuf) > 0 {
+		n := copy(p, stream.readBuf)
+		stream.readBuf = stream.readBuf[n:]
+		stream.unacked += n
+		increment := 0
+		if stream.unacked >= streamWindow/2 && !stream.readEOF {
+			increment, stream.unacked = stream.unacked, 0
+		}
+		stream.Unlock()
+		if increment > 0 {
+			stream.sendWindowUpdate(increment)
+		}
+		return n, nil
+	}
+	defer stream.Unlock()
+	if stream.err != nil {
+		return 0, stream.err
+	}
+	if stream.readClosed {
+		return 0, errors.New("stream closed")
+	}
+	return 0, io.EOF
+}
+
+// Write blocks while the peer's window or the write queue of the connection
+// is full
+func (stream *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		stream.Lock()
+		for stream.sendWindow == 0 && !stream.writeClosed && stream.err == nil {
+			stream.cond.Wait()
+		}
+		if stream.err != nil {
+			stream.Unlock()
+			return written, stream.err
+		}
+		if stream.writeClosed {
+			stream.Unlock()
+			return written, errors.New("stream closed for writing")
+		}
+		n := len(p) - written
+		if n > stream.sendWindow {
+			n = stream.sendWindow
+		}
+		if n > streamFrameSize {
+			n = streamFrameSize
+		}
+		stream.sendWindow -= n
+		stream.Unlock()
+		body := make([]byte, 4+n)
+		binary.BigEndian.PutUint32(body, stream.id)
+		copy(body[4:], p[written:written+n])
+		if err := stream.send(CommandStreamData, body); err != nil {
+			stream.Reset()
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite half-close, the peer reads io.EOF after the data sent so far
+func (stream *Stream) CloseWrite() error {
+	stream.Lock()
+	if stream.writeClosed || stream.err != nil {
+		stream.Unlock()
+		return stream.err
+	}
+	stream.writeClosed = true
+	stream.cond.Broadcast()
+	stream.Unlock()
+	err := stream.send(CommandStreamClose, stream.idBytes())
+	stream.mux.removeIfDone(stream)
+	return err
+}
+
+// Close both directions, data still arriving from the peer is dropped
+func (stream *Stream) Close() error {
+	err := stream.CloseWrite()
+	stream.Lock()
+	stream.readClosed = true
+	stream.readBuf = nil
+	stream.cond.Broadcast()
+	stream.Unlock()
+	stream.mux.removeIfDone(stream)
+	return err
+}
+
+// Reset abort the stream in both directions
+func (stream *Stream) Reset() {
+	if stream.fail(ErrStreamReset) {
+		stream.sendControl(CommandStreamReset, stream.idBytes())
+	}
+}
+
+// fail the stream with err, false if it already failed
+func (stream *Stream) fail(err error) bool {
+	stream.Lock()
+	if stream.err != nil {
+		stream.Unlock()
+		return false
+	}
+	stream.err = err
+	stream.readBuf = nil
+	stream.cond.Broadcast()
+	stream.Unlock()
+	stream.mux.remove(stream)
+	return true
+}
+
+func (stream *Stream) idBytes() []byte {
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, stream.id)
+	return body
+}
+
+// send open, data and close frames in the class of the stream command so
+// they keep their order, a full write queue blocks the sender
+func (stream *Stream) send(command Command, body []byte) error {
+	node := stream.mux.node
+	return node.write(newRawMsg(command, body), node.server.handler.priorityOf(stream.command), true)
+}
+
+// sendControl window updates and resets, they may be sent from the read
+// loop of the connection so they never block
+func (stream *Stream) sendControl(command Command, body []byte) error {
+	return stream.mux.node.WriteToPriority(newRawMsg(command, body), PriorityHigh)
+}
+
+func (stream *Stream) sendWindowUpdate(increment int) {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint32(body, stream.id)
+	binary.BigEndian.PutUint32(body[4:], uint32(increment))
+	stream.sendControl(CommandStreamWindow, body)
+}
+
+// onData buffer data from the peer, a peer overrunning the window is reset
+func (stream *Stream) onData(data []byte) {
+	stream.Lock()
+	if stream.readEOF || stream.err != nil {
+		stream.Unlock()
+		return
+	}
+	if stream.readClosed {
+		// nobody reads any more, keep the peer's window open
+		stream.Unlock()
+		stream.sendWindowUpdate(len(data))
+		return
+	}
+	if len(stream.readBuf)+len(data) > streamWindow {
+		stream.Unlock()
+		logger.Warn("TCP stream window exceeded", "addr", stream.RemoteIP(), "stream", stream.id)
+		stream.Reset()
+		return
+	}
+	stream.readBuf = append(stream.readBuf, data...)
+	stream.cond.Broadcast()
+	stream.Unlock()
+}
+
+func (stream *Stream) onWindow(increment int) {
+	stream.Lock()
+	stream.sendWindow += increment
+	if stream.sendWindow > streamWindow {
+		stream.sendWindow = streamWindow
+	}
+	stream.cond.Broadcast()
+	stream.Unlock()
+}
+
+func (stream *Stream) onClose() {
+	stream.Lock()
+	stream.readEOF = true
+	stream.cond.Broadcast()
+	stream.Unlock()
+	stream.mux.removeIfDone(stream)
+}
+
+func (mux *streamMux) get(id uint32) *Stream {
+	mux.Lock()
+	defer mux.Unlock()
+	return mux.streams[id]
+}
+
+func (mux *streamMux) remove(stream *Stream) {
+	mux.Lock()
+	if mux.streams[stream.id] == stream {
+		delete(mux.streams, stream.id)
+	}
+	mux.Unlock()
+}
+
+// removeIfDone forget a stream closed in both directions
+func (mux *streamMux) removeIfDone(stream *Stream) {
+	stream.Lock()
+	done := stream.writeClosed && (stream.readEOF || stream.readClosed)
+	stream.Unlock()
+	if done {
+		mux.remove(stream)
+	}
+}
+
+// close fail every stream, the connection is gone
+func (mux *streamMux) close(err error) {
+	mux.Lock()
+	mux.err = err
+	streams := make([]*Stream, 0, len(mux.streams))
+	for _, stream := range mux.streams {
+		streams = append(streams, stream)
+	}
+	mux.Unlock()
+	for _, stream := range streams {
+		stream.fail(err)
+	}
+}
+
+// handleStream stream frames from node, true when message was one
+func (node *TcpNode) handleStream(message Message) bool {
+	command := message.GetCommand()
+	if command < CommandStreamOpen || command > CommandStreamReset {
+		return false
+	}
+	body := message.GetBody()
+	mux := node.getMux()
+	if len(body) < 4 || mux == nil {
+		return true
+	}
+	id := binary.BigEndian.Uint32(body)
+	if command == CommandStreamOpen {
+		node.onStreamOpen(mux, id, body)
+		return true
+	}
+	stream := mux.get(id)
+	if stream == nil {
+		return true
+	}
+	switch command {
+	case CommandStreamData:
+		stream.onData(body[4:])
+	case CommandStreamWindow:
+		if len(body) >= 8 {
+			stream.onWindow(int(binary.BigEndian.Uint32(body[4:])))
+		}
+	case CommandStreamClose:
+		stream.onClose()
+	case CommandStreamReset:
+		stream.fail(ErrStreamReset)
+	}
+	return true
+}
+
+func (node *TcpNode) onStreamOpen(mux *streamMux, id uint32, body []byte) {
+	reset := func() {
+		node.WriteToPriority(newRawMsg(CommandStreamReset, body[:4]), PriorityHigh)
+	}
+	if len(body) < 6 {
+		reset()
+		return
+	}
+	command := Command(binary.BigEndian.Uint16(body[4:]))
+	handler := node.server.handler.streamHandler(command)
+	if handler == nil || !node.supports(command) {
+		logger.Debug("TCP reset stream without handler", "addr", node.addr.IP, "command", command)
+		reset()
+		return
+	}
+	mux.Lock()
+	// the peer opens ids of the other parity
+	if id%2 == mux.nextID%2 || mux.streams[id] != nil || len(mux.streams) >= streamMaxPerConn || mux.err != nil {
+		mux.Unlock()
+		reset()
+		return
+	}
+	stream := mux.newStream(id, command)
+	mux.Unlock()
+	go handler(stream)
+}
@@ -0,0 +1,103 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startStreamPair two connected mem nodes, the TCP servers of 10.0.0.1 and
+// of 10.0.0.2
+func startStreamPair(t *testing.T) (*TcpServer, *TcpServer) {
+	network := NewMemNetwork(1)
+	tcp := startMemNode(network, "10.0.0.1", 10000)
+	remote := startMemNode(network, "10.0.0.2", 10000)
+	assert.True(t, advanceUntil(network.Clock(), time.Second, 10, func() bool { return len(tcp.OnlineIPs()) == 1 }))
+	return tcp, remote
+}
+
+func TestStream_Echo(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	tcp, remote := startStreamPair(t)
+	defer tcp.Close()
+	defer remote.Close()
+	remote.handler.HandleStream(70, func(stream *Stream) {
+		io.Copy(stream, stream)
+		stream.CloseWrite()
+	})
+
+	// larger than the window, the writers wait for window updates
+	payloads := [][]byte{bytes.Repeat([]byte("a"), 3*streamWindow), bytes.Repeat([]byte("b"), 1000)}
+	results := make(chan []byte, len(payloads))
+	for _, payload := range payloads {
+		stream, err := tcp.OpenStream("10.0.0.2", 70)
+		assert.NoError(t, err)
+		go func(payload []byte) {
+			stream.Write(payload)
+			stream.CloseWrite()
+		}(payload)
+		go func() {
+			data, err := ioutil.ReadAll(stream)
+			assert.NoError(t, err)
+			results <- data
+		}()
+	}
+	// the short stream is not held up by the long one
+	for _, want := range []int{1000, 3 * streamWindow} {
+		select {
+		case data := <-results:
+			assert.Equal(t, want, len(data))
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream did not finish")
+		}
+	}
+}
+
+func TestStream_Reset(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	tcp, remote := startStreamPair(t)
+	defer tcp.Close()
+	defer remote.Close()
+
+	_, err := tcp.OpenStream("10.0.0.2", CommandHello)
+	assert.Error(t, err)
+	_, err = tcp.OpenStream("10.0.0.9", 70)
+	assert.Error(t, err)
+
+	// no handler on the peer
+	stream, err := tcp.OpenStream("10.0.0.2", 71)
+	assert.NoError(t, err)
+	_, err = stream.Read(make([]byte, 1))
+	assert.Equal(t, ErrStreamReset, err)
+
+	accepted := make(chan *Stream, 1)
+	remote.handler.HandleStream(72, func(stream *Stream) { accepted <- stream })
+	stream, err = tcp.OpenStream("10.0.0.2", 72)
+	assert.NoError(t, err)
+	_, err = stream.Write([]byte("hi"))
+	assert.NoError(t, err)
+	peer := <-accepted
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(peer, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", string(buf))
+	peer.Reset()
+	_, err = stream.Read(buf)
+	assert.Equal(t, ErrStreamReset, err)
+	_, err = stream.Write([]byte("x"))
+	assert.Equal(t, ErrStreamReset, err)
+
+	// the connection going away fails open streams
+	stream, err = tcp.OpenStream("10.0.0.2", 72)
+	assert.NoError(t, err)
+	tcp.RemoveNode(tcp.nodes["10.0.0.2"])
+	_, err = stream.Read(buf)
+	assert.Error(t, err)
+}
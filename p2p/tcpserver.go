@@ -1,34 +1,66 @@
 package p2p
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
-	"os"
 	"sync"
 	"time"
 )
 
 type TcpServer struct {
 	Port          int
+	Transport     Transport
 	handler       *EventHandler
 	nodeCh        chan *TcpNode
 	nodes         map[string]*TcpNode
 	broadcastData BroadcastData
+	relay         *relayService
+	peerStore     *PeerStore
+	membership    *Membership
+	netTime       *NetTime
+	Dialer        *Dialer
+	preferNearby  bool
+	udpPort       int
+	listener      net.Listener
+	closed        bool
+	done          chan struct{}
+	loops         sync.WaitGroup
+	bans          map[string]time.Time
+	// unixNext last address given to a Unix socket node this server joined
+	unixNext uint16
 	sync.Mutex
 }
 
 type TcpNode struct {
+	server   *TcpServer
 	addr     *net.TCPAddr
-	conn     *net.TCPConn
+	conn     net.Conn
 	msgId    int16
 	isServer bool
 	sync.Mutex
 	isReturn bool
 	lastTime time.Time
+	offline  bool
 	isOnline bool
 	isStart  bool
+	id       NodeID
+	tag      int16
+	name     string
+	position *Position
+	hello    *Hello
+	writer   *nodeWriter
+	mux      *streamMux
+	// transport TransportTCP, TransportWebSocket or TransportUnix
+	transport string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	// remote address of a peer keyed by a given address, empty otherwise
+	remote string
 }
 
 var tcpServer *TcpServer
@@ -42,19 +74,30 @@ func NewTCPServer(port int, handler *EventHandler) *TcpServer {
 	}
 	tcpServer = &TcpServer{}
 	tcpServer.Port = port
+	tcpServer.Transport = DefaultTransport
 	tcpServer.handler = handler
 	tcpServer.nodeCh = make(chan *TcpNode)
 	tcpServer.broadcastData = BroadcastData{}
 	tcpServer.nodes = map[string]*TcpNode{}
+	tcpServer.bans = map[string]time.Time{}
+	tcpServer.done = make(chan struct{})
+	tcpServer.relay = newRelayService(DefaultRelayQuota)
+	s := tcpServer
+	tcpServer.Dialer = newDialer(func() time.Time { return s.Transport.Now() })
+	tcpServer.netTime = newNetTime(func() time.Time { return s.Transport.Now() })
+	handler.replay.Lock()
+	handler.replay.score = s.replayRejected
+	handler.replay.now = s.netTime.Now
+	handler.replay.Unlock()
 	return tcpServer
 }
 
 func newNode(addr *net.TCPAddr, isServer bool) *TcpNode {
-	return &TcpNode{addr: addr, isServer: isServer, isOnline: true}
+	return &TcpNode{addr: addr, isServer: isServer, isOnline: true, transport: TransportTCP}
 }
 
 func AddBroadcastDataTcp(broadcastData BroadcastData) {
-	if tcpServer == nil || os.Getenv(NodeType) == Client {
+	if tcpServer == nil || LocalRole() == Client {
 		return
 	}
 	tcpServer.Lock()
@@ -71,101 +114,288 @@ func SetClientName(name string) {
 	tcpServer.Unlock()
 }
 
-// listen TCP request connect
-func (s *TcpServer) Start() {
-	addr, err := net.ResolveTCPAddr(tcp, fmt.Sprintf(":%d", s.Port))
+// SetPeerStore persist peers, stored peers are dialed on start
+func (s *TcpServer) SetPeerStore(store *PeerStore) {
+	store.now = s.Transport.Now
+	s.peerStore = store
+}
+
+// Listen bind the TCP port, Start binds it when Listen was not called
+func (s *TcpServer) Listen() error {
+	tcpListen, err := s.Transport.Listen(s.Port)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("TCP listen port %d err:%s", s.Port, err.Error())
 	}
-	tcpListen, err := net.ListenTCP(tcp, addr)
-	if err != nil {
-		panic(err)
+	s.Lock()
+	closed := s.closed
+	if !closed {
+		s.listener = tcpListen
+	}
+	s.Unlock()
+	if closed {
+		tcpListen.Close()
+	}
+	return nil
+}
+
+// Start accept TCP connections until Close, an error if the port can not
+// be bound
+func (s *TcpServer) Start() error {
+	s.Lock()
+	tcpListen := s.listener
+	s.Unlock()
+	if tcpListen == nil {
+		if err := s.Listen(); err != nil {
+			return err
+		}
+		s.Lock()
+		tcpListen = s.listener
+		s.Unlock()
+	}
+	if tcpListen == nil || s.isClosed() {
+		return nil
+	}
+	s.goLoop(s.onTcpNode)
+	s.goLoop(s.broadcast)
+	s.goLoop(s.redial)
+	if s.peerStore != nil {
+		s.goLoop(s.savePeers)
+		s.dialStoredPeers()
 	}
-	go s.onTcpNode()
-	go s.broadcast()
 
 	for {
-		conn, err := tcpListen.AcceptTCP()
+		conn, err := tcpListen.Accept()
 		if err != nil {
+			if s.isClosed() {
+				logger.Info("TCP server closed", "port", s.Port)
+				return nil
+			}
 			logger.Error("TCP AcceptTCP err", "err", err.Error())
 			continue
 		}
-		isExist, tcpNode := s.AddNode(newNode(conn.RemoteAddr().(*net.TCPAddr), true))
-		if isExist {
-			logger.Debug("TCP node connected 1", "addr", tcpNode.addr.IP)
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			logger.Error("TCP accept addr not TCP", "addr", conn.RemoteAddr().String())
 			conn.Close()
 			continue
 		}
-		tcpNode.conn = conn
-		logger.Info("TCP created connect", "addr", tcpNode.addr.IP, "note", "local node client")
-		s.nodeCh <- tcpNode
+		s.accept(conn, addr, TransportTCP)
+	}
+}
+
+// accept an inbound connection, peers of every transport share the peer
+// table and the read loop
+func (s *TcpServer) accept(conn net.Conn, addr *net.TCPAddr, transport string) {
+	if s.isBanned(addr.IP.String()) {
+		logger.Debug("TCP refuse banned node", "addr", addr.IP)
+		conn.Close()
+		return
 	}
+	node := newNode(addr, true)
+	node.transport = transport
+	if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !remote.IP.Equal(addr.IP) {
+		node.remote = remote.String()
+	}
+	isExist, tcpNode := s.AddNode(node)
+	if isExist {
+		logger.Debug("TCP node connected 1", "addr", tcpNode.addr.IP)
+		conn.Close()
+		return
+	}
+	tcpNode.conn = conn
+	logger.Info("TCP created connect", "addr", tcpNode.addr.IP, "transport", transport, "note", "local node client")
+	s.startNode(tcpNode)
+}
+
+// startNode hand a connected node to the connection manager, dropped once
+// the server is closed
+func (s *TcpServer) startNode(node *TcpNode) {
+	select {
+	case s.nodeCh <- node:
+	case <-s.done:
+		s.RemoveNode(node)
+	}
+}
+
+// goLoop run a background loop of the server, Close waits for it,
+// none is started once closed
+func (s *TcpServer) goLoop(loop func()) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return
+	}
+	s.loops.Add(1)
+	go func() {
+		defer s.loops.Done()
+		loop()
+	}()
+}
+
+// sleep wait d on the server clock, false once the server is closed
+func (s *TcpServer) sleep(d time.Duration) bool {
+	return sleep(s.Transport, d, s.done)
+}
+
+// Close stop accepting and dialing, drop every connection, stop the
+// background loops and save the peer store, Start returns
+func (s *TcpServer) Close() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	listener := s.listener
+	nodes := make([]*TcpNode, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	s.Unlock()
+	var err error
+	if listener != nil {
+		err = listener.Close()
+	}
+	for _, node := range nodes {
+		node.Lock()
+		conn := node.conn
+		node.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	s.loops.Wait()
+	if s.peerStore != nil {
+		if saveErr := s.peerStore.Save(); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// dropTransport disconnect the online peers of transport
+func (s *TcpServer) dropTransport(transport string) {
+	s.Lock()
+	nodes := make([]*TcpNode, 0)
+	for _, node := range s.nodes {
+		if node.transport == transport {
+			nodes = append(nodes, node)
+		}
+	}
+	s.Unlock()
+	for _, node := range nodes {
+		node.Lock()
+		online := node.isOnline
+		node.Unlock()
+		if online {
+			s.RemoveNode(node)
+		}
+	}
+}
+
+func (s *TcpServer) isClosed() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.closed
 }
 
 // create TCP request connect
 func (s *TcpServer) NewTCPConn(IP net.IP) {
+	if s.isClosed() {
+		s.Dialer.skipped(IP.String(), "server closed")
+		return
+	}
+	if s.isBanned(IP.String()) {
+		s.Dialer.skipped(IP.String(), "peer banned")
+		return
+	}
 	tcpAddr, err := net.ResolveTCPAddr(tcp, fmt.Sprintf("%s:%d", IP, s.Port))
 	if err != nil {
 		logger.Error("TCP NewTCPConn", "ResolveTCPAddr", err.Error())
+		s.Dialer.failed(IP.String(), err)
 		return
 	}
 	isExist, tcpNode := s.AddNode(newNode(tcpAddr, false))
 	if isExist {
 		logger.Debug("TCP node connected 2", "addr", IP)
+		s.Dialer.alreadyConnected(IP.String())
 		return
 	}
-	conn, err := net.DialTimeout(tcp, tcpAddr.String(), tcpCreateConnTime*time.Second)
+	conn, err := s.Transport.Dial(tcpAddr, tcpCreateConnTime*time.Second)
 	if err != nil {
 		logger.Error("TCP NewTCPConn", "DialTimeout", err.Error())
+		if s.peerStore != nil {
+			s.peerStore.Failed(IP.String())
+		}
+		s.Dialer.failed(IP.String(), err)
 		s.RemoveNode(tcpNode)
 		return
 	}
-	tcpNode.conn = conn.(*net.TCPConn)
+	tcpNode.conn = conn
+	s.Dialer.connected(IP.String())
 	logger.Info("TCP created connect", "addr", IP, "note", "local node server")
-	s.nodeCh <- tcpNode
+	s.startNode(tcpNode)
 }
 
 func (s *TcpServer) onTcpNode() {
 	defer func() {
-		panic("TCP Connection management protocol exception stop")
+		if !s.isClosed() {
+			panic("TCP Connection management protocol exception stop")
+		}
 	}()
 	for {
-		node := <-s.nodeCh
-		node.conn.SetNoDelay(true)
-		node.conn.SetKeepAlive(true)
-		node.conn.SetKeepAlivePeriod((tcpHeartbeatTime + 2) * time.Second)
-		logger.Info("TCP node", "addr", node.addr.IP, "node is server", node.isServer, "nodes", len(s.nodes))
+		var node *TcpNode
+		select {
+		case node = <-s.nodeCh:
+		case <-s.done:
+			return
+		}
+		if conn, ok := node.conn.(*net.TCPConn); ok {
+			conn.SetNoDelay(true)
+			conn.SetKeepAlive(true)
+			conn.SetKeepAlivePeriod((tcpHeartbeatTime + 2) * time.Second)
+		}
+		s.Lock()
+		count := len(s.nodes)
+		s.Unlock()
+		logger.Info("TCP node", "addr", node.addr.IP, "node is server", node.isServer, "nodes", count)
 		go node.start()
 	}
 }
 
 // node manager
 func (node *TcpNode) start() {
+	server := node.server
 	defer func() {
-		tcpServer.RemoveNode(node)
+		server.RemoveNode(node)
 		logger.Info("TCP node close XX", "addr", node.addr.IP)
 	}()
 
 	node.Lock()
 	node.isStart = true
+	node.offline = false
+	node.hello = nil
+	node.ctx, node.cancel = context.WithCancel(context.Background())
 	node.Unlock()
+	node.WriteTo(newRawMsg(CommandHello, server.helloMsg()))
 	if node.isServer == false {
-		tcpServer.Lock()
-		dataInfo := tcpServer.getBroadcastMsg()
-		tcpServer.Unlock()
-		node.WriteTo(NewMsg(CommandHeartbeat, dataInfo)) // heart
+		server.Lock()
+		heartbeat := server.heartbeatMsg(node.addr.IP.String())
+		server.Unlock()
+		node.WriteTo(heartbeat) // heart
 	}
 	for {
-		if err := node.conn.SetReadDeadline(time.Now().Add(tcpHeartbeatTime * time.Second)); err != nil {
+		if err := node.conn.SetReadDeadline(server.Transport.Now().Add(tcpHeartbeatTime * time.Second)); err != nil {
 			logger.Warn("TCP set read deadline", "addr", node.addr.IP, "err", err.Error())
 			return
 		}
 		headBt := make([]byte, HeadLen)
-		if _, err := node.conn.Read(headBt); err != nil {
+		if _, err := io.ReadFull(node.conn, headBt); err != nil {
 			logger.Warn("TCP receive head info", "addr", node.addr.IP, "err", err.Error())
 			return
 		}
-		message := tcpServer.handler.GetMessage(headBt[:2])
+		message := server.handler.GetMessage(headBt[:2])
 		if message == nil {
 			logger.Error("TCP messages is nil", "addr", node.addr.IP, "head", headBt)
 			return
@@ -177,91 +407,271 @@ func (node *TcpNode) start() {
 		}
 		if length > 0 {
 			body := make([]byte, length)
-			if _, err := node.conn.Read(body); err != nil {
+			if _, err := io.ReadFull(node.conn, body); err != nil {
 				logger.Error("TCP receive body info", "addr", node.addr.IP, "err", err.Error())
 				return
 			}
 			message.SetBody(body)
 		}
+		received := server.Transport.Now()
+		captureFrame(CaptureInbound, node.transport, node.addr.IP, node.addr.Port, append(headBt, message.GetBody()...), received)
+		countFrame(CaptureInbound, node.transport, len(headBt)+len(message.GetBody()))
 		message.Log(node.addr.IP, "TCP receive msg <<<<<")
+		if message.GetCommand() == CommandHello {
+			if !node.setHello(message) {
+				return
+			}
+			continue
+		}
+		if message.GetCommand() == CommandHeartbeat || message.GetCommand() == CommandHeartbeatResponse {
+			// before any response or state change
+			if !node.checkStamp(message) {
+				continue
+			}
+		}
 		if message.GetCommand() == CommandHeartbeat {
-			if os.Getenv(NodeType) == Client {
-				tcpServer.Lock()
-				dataInfoMsg := tcpServer.getClientResponseMsg()
-				tcpServer.Unlock()
+			reply := newTimeReply(message, received)
+			if LocalRole() == Client {
+				server.Lock()
+				dataInfoMsg := server.getClientResponseMsg(reply)
+				server.Unlock()
 				node.WriteTo(message.ResponseMessage(CommandHeartbeatResponse, dataInfoMsg))
 			} else {
-				tcpServer.Lock()
-				dataInfoMsg := tcpServer.getBroadcastMsg()
-				tcpServer.Unlock()
+				server.Lock()
+				dataInfoMsg := server.getBroadcastMsg(newHeartbeatStamp(server.Transport.Now()), reply)
+				server.Unlock()
 				node.WriteTo(message.ResponseMessage(CommandHeartbeatResponse, dataInfoMsg))
 			}
 		}
 		if message.GetCommand() == CommandHeartbeatResponse {
 			node.Lock()
 			node.isReturn = true
+			outbound := !node.isServer
 			node.Unlock()
+			if outbound {
+				server.Dialer.proven(node.addr.IP.String())
+			}
+			server.netTime.sample(node.addr.IP.String(), message.GetBody(), received)
+		}
+		if message.GetCommand() == CommandHeartbeat || message.GetCommand() == CommandHeartbeatResponse {
+			node.setIdentity(message)
+		}
+		if message.GetCommand() == CommandLongitude {
+			node.setPosition(parsePosition(message.GetBody()))
+		}
+		if server.handleRelay(node, message) {
+			continue
 		}
-		message.Handler(node.addr.IP)
+		if node.handleStream(message) {
+			continue
+		}
+		if !node.supports(innerCommand(message)) {
+			logger.Debug("TCP drop msg of unsupported protocol", "addr", node.addr.IP, "command", message.GetCommand())
+			continue
+		}
+		message.Handler(server.handler, node.newContext())
+	}
+}
+
+// context of a message received from node, replies go back to node
+func (node *TcpNode) newContext() *Context {
+	node.Lock()
+	defer node.Unlock()
+	return &Context{
+		IP:         node.addr.IP,
+		PeerID:     node.id,
+		ReceivedAt: node.server.Transport.Now(),
+		Transport:  node.transport,
+		ctx:        node.ctx,
+		reply:      node.WriteTo,
+	}
+}
+
+// record peer id, role and name from heartbeat
+func (node *TcpNode) setIdentity(message Message) {
+	var data struct {
+		NodeName string    `json:"nodeName"`
+		NodeID   string    `json:"nodeId"`
+		Position *Position `json:"position"`
+	}
+	if body := message.GetBody(); len(body) > 0 {
+		if err := json.Unmarshal(body, &data); err != nil {
+			return
+		}
+	}
+	node.Lock()
+	if msg, ok := message.(*Msg); ok && node.hello == nil {
+		// peers without hello, role inferred from the head tag
+		node.tag = msg.Head.Tag
+	}
+	if data.NodeName != "" {
+		node.name = data.NodeName
+	}
+	if id, err := ParseNodeID(data.NodeID); err == nil {
+		node.id = id
+	}
+	id, name, tag := node.id, node.name, node.tag
+	node.Unlock()
+	// WebSocket peers cannot be dialed back
+	if store := node.server.peerStore; store != nil && node.transport == TransportTCP {
+		store.Seen(node.addr.IP.String(), id, name, tag)
+	}
+	if !data.Position.IsEmpty() {
+		node.setPosition(data.Position)
 	}
 }
 
-// TCP Write node
+// record peer position from heartbeat or longitude message
+func (node *TcpNode) setPosition(position *Position) {
+	if position == nil {
+		return
+	}
+	node.Lock()
+	node.position = position
+	node.Unlock()
+	if store := node.server.peerStore; store != nil {
+		store.SetPosition(node.addr.IP.String(), position)
+	}
+}
+
+// seed dialing from the peer store
+func (s *TcpServer) dialStoredPeers() {
+	s.Lock()
+	prefer, local := s.preferNearby, s.position()
+	s.Unlock()
+	peers := s.peerStore.Best(math.MaxInt32)
+	if prefer {
+		// nearby servers first, the rest keep the store order
+		sortNearbyRecords(local, peers)
+	}
+	if len(peers) > peerSeedCount {
+		peers = peers[:peerSeedCount]
+	}
+	for _, peer := range peers {
+		if ip := net.ParseIP(peer.IP); ip != nil {
+			logger.Info("TCP dial stored peer", "addr", ip, "lastSeen", peer.LastSeen, "score", peer.Score)
+			go s.NewTCPConn(ip)
+		}
+	}
+}
+
+func (s *TcpServer) savePeers() {
+	for s.sleep(peerStoreSaveTime * time.Second) {
+		if err := s.peerStore.Save(); err != nil {
+			logger.Error("TCP save peer store", "err", err.Error())
+		}
+	}
+}
+
+// TCP Write node, the frame is queued for the connection writer in the
+// class of its command
 func (node *TcpNode) WriteTo(message Message) (err error) {
+	return node.WriteToPriority(message, node.server.handler.priorityOf(innerCommand(message)))
+}
+
+// WriteToPriority queue the frame in class priority
+func (node *TcpNode) WriteToPriority(message Message, priority Priority) (err error) {
+	return node.write(message, priority, false)
+}
+
+// write queue message in class priority, with wait the sender blocks while
+// the queue is full instead of getting ErrWriteQueueFull
+func (node *TcpNode) write(message Message, priority Priority, wait bool) (err error) {
+	if !priority.valid() {
+		return errors.New("priority class invalid")
+	}
 	data, err := message.MarshalBinary()
 	if err != nil {
 		logger.Error("TCP write marshal msg", "err", err.Error())
 		return err
 	}
-	if node.conn == nil {
+	if priority == PriorityBulk && len(data) > priorityBulkMaxFrame {
+		logger.Warn("TCP bulk frame too large", "addr", node.addr.IP, "len", len(data))
+		return ErrBulkFrameTooLarge
+	}
+	writer := node.getWriter()
+	if writer == nil {
 		logger.Error("TCP node conn is nil", "node", node)
-		tcpServer.RemoveNode(node)
+		node.server.RemoveNode(node)
 		return errors.New("node conn is nil")
 	}
-	if err = node.conn.SetWriteDeadline(time.Now().Add(3 * time.Second)); err != nil {
-		logger.Error("TCP set write deadline", "err", err.Error())
-		return err
-	}
-	if _, err := node.conn.Write(data); err != nil {
-		logger.Error("TCP write to data", "err", err.Error())
-		tcpServer.RemoveNode(node)
-		return err
+	frame := outFrame{data: data, message: message, priority: priority}
+	if wait {
+		return writer.enqueueWait(frame)
 	}
-	message.Log(node.addr.IP, "TCP send msg ===============>")
-	return nil
+	return writer.enqueue(frame)
 }
 
 // TCP Write by IP
 func (s *TcpServer) WriteToTCP(message Message, ip string) (err error) {
-	s.Lock()
-	defer s.Unlock()
+	return s.WriteToTCPPriority(message, ip, s.handler.priorityOf(innerCommand(message)))
+}
 
-	if node := s.nodes[ip]; node == nil {
+// WriteToTCPPriority write by IP in class priority
+func (s *TcpServer) WriteToTCPPriority(message Message, ip string, priority Priority) (err error) {
+	s.Lock()
+	node := s.nodes[ip]
+	s.Unlock()
+	if node == nil {
 		logger.Warn("TCP WriteToTCP node not exist", "addr", ip)
 		return errors.New("node not exist, send msg error")
-	} else {
-		return node.WriteTo(message)
 	}
+	return node.WriteToPriority(message, priority)
 }
 
 // TCP ticker broadcast
 func (s *TcpServer) broadcast() {
 	defer func() {
-		panic("TCP The scheduled task stops abnormally")
+		if !s.isClosed() {
+			panic("TCP The scheduled task stops abnormally")
+		}
 	}()
-	ticker := time.NewTicker(tcpTimer * time.Second)
-	for range ticker.C {
+	for s.sleep(tcpTimer * time.Second) {
+		// writes only queue, no goroutine per node is needed
 		s.Lock()
+		heartbeats := map[*TcpNode]Message{}
 		for _, node := range s.nodes {
 			node.Lock()
 			is := node.isReturn && node.isOnline && node.isStart
 			node.Unlock()
 			if is {
-				go node.WriteTo(NewMsg(CommandHeartbeat, s.getBroadcastMsg()))
+				heartbeats[node] = s.heartbeatMsg(node.addr.IP.String())
 			}
 		}
 		s.Unlock()
+		for node, heartbeat := range heartbeats {
+			node.WriteTo(heartbeat)
+		}
+	}
+}
+
+// online node ip list
+func (s *TcpServer) OnlineIPs() (ips []string) {
+	s.Lock()
+	defer s.Unlock()
+	for ip, node := range s.nodes {
+		node.Lock()
+		if node.isOnline && node.isStart {
+			ips = append(ips, ip)
+		}
+		node.Unlock()
 	}
+	return ips
+}
+
+// online node by node id
+func (s *TcpServer) NodeByID(id NodeID) *TcpNode {
+	s.Lock()
+	defer s.Unlock()
+	for _, node := range s.nodes {
+		node.Lock()
+		match := node.id == id && node.isOnline && node.isStart
+		node.Unlock()
+		if match {
+			return node
+		}
+	}
+	return nil
 }
 
 func (s *TcpServer) AddNode(node *TcpNode) (bool, *TcpNode) {
@@ -270,6 +680,7 @@ func (s *TcpServer) AddNode(node *TcpNode) (bool, *TcpNode) {
 	nd := s.nodes[node.addr.IP.String()]
 	if nd == nil {
 		logger.Info("TCP  ###", "addr", node.addr.IP)
+		node.server = s
 		s.nodes[node.addr.IP.String()] = node
 		return false, node
 	}
@@ -278,10 +689,11 @@ func (s *TcpServer) AddNode(node *TcpNode) (bool, *TcpNode) {
 		nd.Unlock()
 		return true, nd
 	} else {
-		nd.addr = node.addr
+		// addr keeps the same IP, the old connection goroutine may still read it
 		//nd.conn = node.conn
 		nd.isServer = node.isServer
-		nd.lastTime = time.Now()
+		nd.transport = node.transport
+		nd.remote = node.remote
 		nd.isOnline = true
 		nd.isReturn = false
 		nd.msgId = 0
@@ -297,32 +709,74 @@ func (s *TcpServer) RemoveNode(node *TcpNode) {
 	} else {
 		logger.Error("TCP RemoveNode node conn is nil")
 	}
+	started := node.isStart
+	// an outbound connection that drops counts against the peer like a failed dial
+	dropped := started && !node.isServer && node.transport == TransportTCP
+	if node.cancel != nil {
+		node.cancel()
+	}
+	if node.writer != nil {
+		node.writer.close()
+	}
+	mux := node.mux
+	node.mux = nil
 	node.isOnline = false
 	node.isStart = false
-	node.lastTime = time.Now()
+	if started {
+		// failed redials do not postpone the offline event
+		node.lastTime = s.Transport.Now()
+	}
 	logger.Info("TCP", "addr", node.addr.IP, "lastTime", node.lastTime)
 	node.Unlock()
+	if mux != nil {
+		mux.close(errors.New("node conn closed"))
+	}
+	if started {
+		s.Dialer.lost(node.addr.IP.String())
+	}
+	if dropped && s.peerStore != nil && !s.isClosed() {
+		s.peerStore.Failed(node.addr.IP.String())
+	}
+	s.netTime.forget(node.addr.IP.String())
 
 	go node.SendOffLineEvent()
 	//s.handler.DoSomething(&Context{IP: node.addr.IP, command: NodeRemoveHandler})
 }
 
 func (node *TcpNode) SendOffLineEvent() {
-	time.Sleep(reconnectWaitTime * time.Second)
+	clock := node.server.Transport
+	if !node.server.sleep(reconnectWaitTime * time.Second) {
+		return
+	}
 	node.Lock()
 	lastTime := node.lastTime
+	offline := !node.isStart && !node.offline && clock.Now().Sub(lastTime) >= reconnectWaitTime*time.Second
+	if offline {
+		node.offline = true
+	}
 	node.Unlock()
-	if time.Now().Sub(lastTime) > reconnectWaitTime*time.Second {
-		logger.Error("123 ", "addr", node.addr, "t1", time.Now(), "t2", lastTime)
-		tcpServer.handler.DoSomething(&Context{IP: node.addr.IP, command: NodeRemoveHandler})
+	if offline {
+		logger.Error("123 ", "addr", node.addr, "t1", clock.Now(), "t2", lastTime)
+		node.server.handler.DoSomething(&Context{IP: node.addr.IP, command: NodeRemoveHandler})
 		return
 	}
 	logger.Info("123", "addr", node.addr)
 	return
 }
 
-func (s *TcpServer) getBroadcastMsg() []byte {
+// heartbeatMsg a heartbeat to ip, its timestamp is kept to sample the
+// clock of ip from the response
+func (s *TcpServer) heartbeatMsg(ip string) Message {
+	stamp := newHeartbeatStamp(s.Transport.Now())
+	s.netTime.record(ip, stamp.Timestamp)
+	return NewMsg(CommandHeartbeat, s.getBroadcastMsg(stamp, timeReply{}))
+}
+
+func (s *TcpServer) getBroadcastMsg(stamp heartbeatStamp, reply timeReply) []byte {
 	data := s.broadcastData
+	data.NodeID = LocalNodeID().String()
+	data.heartbeatStamp = stamp
+	data.timeReply = reply
 	if len(data.PositionByte) > 0 {
 		ps := Position{}
 		err := json.Unmarshal(data.PositionByte, &ps)
@@ -345,6 +799,9 @@ type BroadcastData struct {
 	Position     *Position `json:"position,omitempty"`
 	Credit       int64     `json:"credit"`
 	NodeName     string    `json:"nodeName,omitempty"`
+	NodeID       string    `json:"nodeId,omitempty"`
+	heartbeatStamp
+	timeReply
 }
 
 type Position struct {
@@ -352,9 +809,17 @@ type Position struct {
 	Latitude  float64 `json:"latitude,omitempty"`
 }
 
-func (s *TcpServer) getClientResponseMsg() []byte {
-	if name := s.broadcastData.NodeName; name != "" {
-		return []byte(fmt.Sprintf(`{"nodeName":"%v"}`, name))
+// getClientResponseMsg empty for a nameless client, as before, so its
+// responses fire no online event, it then gives no clock sample either
+func (s *TcpServer) getClientResponseMsg(reply timeReply) []byte {
+	name := s.broadcastData.NodeName
+	if name == "" {
+		return nil
 	}
-	return nil
+	stamp := newHeartbeatStamp(s.Transport.Now())
+	times := ""
+	if reply.Originate != 0 {
+		times = fmt.Sprintf(`,"orig":%d,"recv":%d`, reply.Originate, reply.Receive)
+	}
+	return []byte(fmt.Sprintf(`{"nodeName":"%v","nodeId":"%v","ts":%d,"nonce":%d%s}`, name, LocalNodeID(), stamp.Timestamp, stamp.Nonce, times))
 }
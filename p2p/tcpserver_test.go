@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"net"
+	"os"
 	"testing"
 	"time"
 )
@@ -89,3 +90,58 @@ func TestParseJson(t *testing.T) {
 	json.Unmarshal([]byte(data), &res)
 	t.Log(res.NodeName)
 }
+
+func TestTcpServer_Close(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	network := NewMemNetwork(1)
+	defer network.Close()
+	clock := network.Clock()
+	host := network.Host(net.ParseIP("10.0.0.1"))
+	handler := NewEventHandler(nil)
+	udp := NewUDPServer(10000, handler)
+	udp.SetTransport(host)
+	tcp := NewTCPServer(10001, handler)
+	tcp.Transport = host
+	udp.BindTCP(tcp)
+	tcpDone, udpDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		tcp.Start()
+		close(tcpDone)
+	}()
+	go func() {
+		udp.Start()
+		close(udpDone)
+	}()
+	remote := startMemNode(network, "10.0.0.2", 10000)
+	defer remote.Close()
+	assert.True(t, advanceUntil(clock, time.Second, 10, func() bool { return len(tcp.OnlineIPs()) == 1 }))
+
+	assert.NoError(t, tcp.Close())
+	assert.NoError(t, udp.Close())
+	for _, done := range []chan struct{}{tcpDone, udpDone} {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("server did not stop")
+		}
+	}
+	assert.True(t, advanceUntil(clock, time.Second, 10, func() bool { return len(tcp.OnlineIPs()) == 0 }))
+	assert.NoError(t, tcp.Close())
+
+	// the broadcast loops stopped with the servers
+	listener, err := network.Host(net.ParseIP("10.0.0.3")).ListenPacket(10000)
+	assert.NoError(t, err)
+	defer listener.Close()
+	clock.Advance(3 * udpTimer * time.Second)
+	buf := make([]byte, udpReceiveLen)
+	for {
+		listener.SetReadDeadline(clock.Now())
+		_, from, err := listener.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		assert.NotEqual(t, "10.0.0.1", from.(*net.UDPAddr).IP.String())
+	}
+	assert.Error(t, udp.WriteToUDP(NewMsg(CommandNodeDiscovery, nil), listener.LocalAddr().(*net.UDPAddr)))
+}
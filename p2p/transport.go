@@ -0,0 +1,83 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Clock source of time for servers, the in-memory network uses a virtual one
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// timerStopper a clock that releases timers whose reader went away
+type timerStopper interface {
+	stop(ch <-chan time.Time)
+}
+
+// sleep wait d on clock, false if done is closed first
+func sleep(clock Clock, d time.Duration, done <-chan struct{}) bool {
+	timer := clock.After(d)
+	select {
+	case <-timer:
+		return true
+	case <-done:
+		if stopper, ok := clock.(timerStopper); ok {
+			stopper.stop(timer)
+		}
+		return false
+	}
+}
+
+// Transport the network used by TcpServer and UdpServer
+type Transport interface {
+	Clock
+	Listen(port int) (net.Listener, error)
+	Dial(addr *net.TCPAddr, timeout time.Duration) (net.Conn, error)
+	ListenPacket(port int) (net.PacketConn, error)
+	LocalIP() net.IP
+	BroadcastIPs() ([]net.IP, error)
+}
+
+// DefaultTransport real TCP and UDP sockets
+var DefaultTransport Transport = netTransport{}
+
+type netTransport struct{}
+
+func (netTransport) Now() time.Time {
+	return time.Now()
+}
+
+func (netTransport) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (netTransport) Listen(port int) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr(tcp, fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP(tcp, addr)
+}
+
+func (netTransport) Dial(addr *net.TCPAddr, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(tcp, addr.String(), timeout)
+}
+
+func (netTransport) ListenPacket(port int) (net.PacketConn, error) {
+	addr, err := net.ResolveUDPAddr(udp, fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP(udp, addr)
+}
+
+func (netTransport) LocalIP() net.IP {
+	return GetLocalIp()
+}
+
+func (netTransport) BroadcastIPs() ([]net.IP, error) {
+	return GetBroadcastIPs()
+}
@@ -1,18 +1,27 @@
 package p2p
 
 import (
+	"errors"
 	"fmt"
 	"net"
-	"os"
+	"sync"
 	"time"
 )
 
 type UdpServer struct {
 	Port          int
-	udpConn       *net.UDPConn
+	Transport     Transport
+	udpConn       net.PacketConn
+	tcp           *TcpServer
 	handler       *EventHandler
 	BroadcastAddr []*net.UDPAddr
 	ServerIP      []net.IP
+	Rendezvous    *Rendezvous
+	Reliable      *ReliableUDP
+	closed        bool
+	done          chan struct{}
+	loops         sync.WaitGroup
+	sync.Mutex
 }
 
 var udpServer *UdpServer
@@ -26,34 +35,97 @@ func NewUDPServer(port int, handler *EventHandler) *UdpServer {
 	}
 	udpServer = &UdpServer{}
 	udpServer.Port = port
+	udpServer.Transport = DefaultTransport
 	udpServer.setBroadcastAdders()
 	udpServer.handler = handler
+	udpServer.done = make(chan struct{})
+	udpServer.Rendezvous = NewRendezvous(udpServer, handler)
+	server := udpServer
+	udpServer.Rendezvous.supports = func(peer NodeID, command Command) bool {
+		return server.supports(nil, peer, command)
+	}
+	udpServer.Reliable = NewReliableUDP(udpServer, udpServer.deliver)
 	return udpServer
 }
 
-func (s *UdpServer) Start() {
-	addr, err := net.ResolveUDPAddr(udp, fmt.Sprintf(":%d", s.Port))
-	if err != nil {
-		panic(err.Error())
+// SetTransport replace the network, broadcast addresses are taken from it
+func (s *UdpServer) SetTransport(transport Transport) {
+	s.Transport = transport
+	s.Rendezvous.now = transport.Now
+	s.Reliable.now = transport.Now
+	s.setBroadcastAdders()
+}
+
+// BindTCP TCP server dialing discovered nodes, default the last one created
+func (s *UdpServer) BindTCP(tcp *TcpServer) {
+	s.tcp = tcp
+	tcp.udpPort = s.Port
+	s.Rendezvous.nearby = tcp.sortNearbyAddrs
+}
+
+func (s *UdpServer) tcpServer() *TcpServer {
+	if s.tcp != nil {
+		return s.tcp
 	}
-	udpConn, err := net.ListenUDP(udp, addr)
+	return tcpServer
+}
+
+// Listen bind the UDP port, Start binds it when Listen was not called
+func (s *UdpServer) Listen() error {
+	udpConn, err := s.Transport.ListenPacket(s.Port)
 	if err != nil {
-		panic(err.Error())
+		return fmt.Errorf("UDP listen port %d err:%s", s.Port, err.Error())
+	}
+	s.Lock()
+	closed := s.closed
+	if !closed {
+		s.udpConn = udpConn
 	}
-	s.udpConn = udpConn
-	go s.broadcast()
+	s.Unlock()
+	if closed {
+		udpConn.Close()
+	}
+	return nil
+}
+
+// Start read UDP frames until Close, an error if the port can not be bound
+func (s *UdpServer) Start() error {
+	s.Lock()
+	udpConn := s.udpConn
+	s.Unlock()
+	if udpConn == nil {
+		if err := s.Listen(); err != nil {
+			return err
+		}
+		s.Lock()
+		udpConn = s.udpConn
+		s.Unlock()
+	}
+	if udpConn == nil || s.isClosed() {
+		return nil
+	}
+	s.goLoop(s.broadcast)
+	s.goLoop(func() { s.Rendezvous.run(s.Transport, s.done) })
+	s.goLoop(func() { s.Reliable.run(s.Transport, s.done) })
 
+	buffer := make([]byte, udpReceiveLen)
 	for {
-		buffer := make([]byte, udpReceiveLen)
-		length, addr, err := s.udpConn.ReadFromUDP(buffer)
+		length, from, err := udpConn.ReadFrom(buffer)
 		if err != nil {
+			if s.isClosed() {
+				logger.Info("======== UDP server closed", "port", s.Port)
+				return nil
+			}
 			logger.Error("======== UDP start read data", "err", err.Error())
 			continue
 		}
-		if CheckLocalIP(addr.IP.String()) {
+		addr, ok := from.(*net.UDPAddr)
+		if !ok || s.isLocalIP(addr.IP) {
 			//logger.Debug("======== UDP IP is local", "addr", addr.IP)
 			continue
 		}
+		captureFrame(CaptureInbound, TransportUDP, addr.IP, addr.Port, buffer[:length], s.Transport.Now())
+		countFrame(CaptureInbound, TransportUDP, length)
 		message := s.handler.GetMessage(buffer[:2])
 		if message == nil {
 			logger.Error("======== UDP magic not exist", "addr", addr.IP, "magic", string(buffer[:2]))
@@ -68,28 +140,103 @@ func (s *UdpServer) Start() {
 			logger.Error("======== UDP unmarshal message", "addr", addr.IP, "len", length)
 			continue
 		}
-		if bodyLen > 0 && uint32(length) > uint32(message.GetHeadLen())+bodyLen {
-			message.SetBody(buffer[message.GetHeadLen():bodyLen])
+		if bodyLen > 0 && uint32(length) >= uint32(message.GetHeadLen())+bodyLen {
+			message.SetBody(append([]byte{}, buffer[message.GetHeadLen():uint32(message.GetHeadLen())+bodyLen]...))
 		}
 		message.Log(addr.IP, "UDP receive msg <<<<<")
-		if message.GetCommand() == CommandNodeDiscovery && os.Getenv(NodeType) == Server {
-			go tcpServer.NewTCPConn(addr.IP)
+		if s.Rendezvous.handle(message, addr) || s.Reliable.handle(message, addr) {
+			continue
+		}
+		if message.GetCommand() == CommandNodeDiscovery && LocalRole() == Server {
+			go s.tcpServer().NewTCPConn(addr.IP)
 			continue
 		}
 		if message.GetCommand() == CommandServer {
 			s.SetServerIP(addr.IP)
+			s.Rendezvous.AddServer(addr)
 		}
 		//message.Handler(addr.IP)
 	}
 }
 
+// Close stop reading and the background loops, Start returns
+func (s *UdpServer) Close() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	udpConn := s.udpConn
+	s.Unlock()
+	s.Reliable.Close()
+	var err error
+	if udpConn != nil {
+		err = udpConn.Close()
+	}
+	s.loops.Wait()
+	return err
+}
+
+// goLoop run a background loop of the server, Close waits for it,
+// none is started once closed
+func (s *UdpServer) goLoop(loop func()) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return
+	}
+	s.loops.Add(1)
+	go func() {
+		defer s.loops.Done()
+		loop()
+	}()
+}
+
+func (s *UdpServer) isClosed() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.closed
+}
+
+// deliver a reassembled reliable message to the handlers
+func (s *UdpServer) deliver(addr *net.UDPAddr, command Command, msgID int16, data []byte) {
+	if !isAppFrame(command) || !s.supports(addr.IP, NodeID{}, innerCommand(newRawMsg(command, data))) {
+		return
+	}
+	msg := &Msg{Head: Head{Magic: MsgMagic, Command: command, MsgId: msgID, Len: uint32(len(data))}, Body: data}
+	msg.Log(addr.IP, "UDP receive reliable msg <<<<<")
+	msg.Handler(s.handler, &Context{
+		IP:         addr.IP,
+		ReceivedAt: s.Transport.Now(),
+		Transport:  TransportUDP,
+		reply:      func(reply Message) error { return s.SendReliable(reply, addr) },
+	})
+}
+
+// supports the sub-protocol filter of the TCP connection to the peer
+func (s *UdpServer) supports(ip net.IP, id NodeID, command Command) bool {
+	if tcp := s.tcpServer(); tcp != nil {
+		return tcp.peerSupports(ip, id, command)
+	}
+	_, _, ok := s.handler.protocolOf(command)
+	return !ok
+}
+
+// SendReliable send to addr and wait for the acknowledgement
+func (s *UdpServer) SendReliable(message Message, addr *net.UDPAddr) error {
+	return s.Reliable.send(addr, message.GetCommand(), msgIDOf(message), message.GetBody())
+}
+
 func (s *UdpServer) broadcast() {
 	logger.Info("======== UDP start broadcast", "broadcastAddr", s.BroadcastAddr)
 	defer func() {
-		panic("======== UDP Broadcast task aborted")
+		if !s.isClosed() {
+			panic("======== UDP Broadcast task aborted")
+		}
 	}()
-	ticker := time.NewTicker(udpTimer * time.Second)
-	for range ticker.C {
+	for sleep(s.Transport, udpTimer*time.Second, s.done) {
 		for _, addr := range s.BroadcastAddr {
 			s.WriteToUDP(NewMsg(CommandNodeDiscovery, nil), addr)
 		}
@@ -102,18 +249,29 @@ func (s *UdpServer) WriteToUDP(message Message, addr *net.UDPAddr) (err error) {
 		logger.Error("======== UDP WriteToUDP MarshalBinary", "err", err.Error())
 		return err
 	}
-	_, err = s.udpConn.WriteToUDP(data, addr)
+	s.Lock()
+	udpConn, closed := s.udpConn, s.closed
+	s.Unlock()
+	if closed {
+		return errors.New("UDP server closed")
+	}
+	if udpConn == nil {
+		return errors.New("UDP server not start")
+	}
+	_, err = udpConn.WriteTo(data, addr)
 	if err != nil {
 		logger.Error("======== UDP WriteToUDP", "err", err.Error())
 		s.setBroadcastAdders()
 		return err
 	}
+	captureFrame(CaptureOutbound, TransportUDP, addr.IP, addr.Port, data, s.Transport.Now())
+	countFrame(CaptureOutbound, TransportUDP, len(data))
 	message.Log(addr.IP, "UDP send msg ===============>")
 	return
 }
 
 func (s *UdpServer) setBroadcastAdders() (adders []*net.UDPAddr) {
-	ips, err := GetBroadcastIPs()
+	ips, err := s.Transport.BroadcastIPs()
 	if err != nil {
 		panic(err.Error())
 	}
@@ -128,6 +286,11 @@ func (s *UdpServer) setBroadcastAdders() (adders []*net.UDPAddr) {
 	return
 }
 
+func (s *UdpServer) isLocalIP(ip net.IP) bool {
+	local := s.Transport.LocalIP()
+	return local == nil || ip.Equal(local) || ip.IsLoopback()
+}
+
 func GetServerIP() []net.IP {
 	return udpServer.ServerIP
 }
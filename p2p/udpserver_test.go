@@ -56,7 +56,7 @@ func TestReadMsg(t *testing.T) {
 	time.Sleep(1 * time.Second)
 
 	buffer := make([]byte, udpReceiveLen)
-	length, addr, err := s.udpConn.ReadFromUDP(buffer)
+	length, from, err := s.udpConn.ReadFrom(buffer)
 	assert.NoError(t, err)
 	assert.Equal(t, true, length > 10)
 
@@ -66,7 +66,7 @@ func TestReadMsg(t *testing.T) {
 	//assert.NoError(t, )
 
 	//message.UdpHandler(addr.IP)
-	t.Log(addr.IP)
+	t.Log(from)
 }
 
 func TestTimer(t *testing.T) {
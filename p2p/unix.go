@@ -0,0 +1,163 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"fx/chain/common/utils"
+)
+
+// unixPeerNet addresses given to Unix socket peers, they have no IP but the
+// peer table and WriteToTCP are keyed by one
+var unixPeerNet = net.IPv4(127, 255, 0, 0).To4()
+
+// UnixServer accept services on the same host over a Unix domain socket,
+// access is controlled by the permissions of the socket file, the peers
+// share the framing, handshake and handlers of the TcpServer
+type UnixServer struct {
+	tcp      *TcpServer
+	listener net.Listener
+	next     uint16
+	sync.Mutex
+}
+
+func NewUnixServer(tcp *TcpServer) *UnixServer {
+	if tcp == nil {
+		panic("Unix TcpServer not empty")
+	}
+	return &UnixServer{tcp: tcp}
+}
+
+// ListenUnix listen on the socket at path with file mode, a socket left by
+// a process that did not stop cleanly is replaced
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if utils.PathExists(path) {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket %s in use", path)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Serve accept local peers on listener until Close
+func (u *UnixServer) Serve(listener net.Listener) error {
+	u.Lock()
+	u.listener = listener
+	u.Unlock()
+	logger.Info("Unix server start", "addr", listener.Addr().String())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if u.tcp.isClosed() || u.isClosed() {
+				return nil
+			}
+			return err
+		}
+		addr := u.tcp.peerAddr(unixPeerNet, &u.next)
+		if addr == nil {
+			logger.Warn("Unix no peer address left", "addr", listener.Addr().String())
+			conn.Close()
+			continue
+		}
+		logger.Info("Unix created connect", "addr", addr.IP)
+		u.tcp.accept(conn, addr, TransportUnix)
+	}
+}
+
+func (u *UnixServer) isClosed() bool {
+	u.Lock()
+	defer u.Unlock()
+	return u.listener == nil
+}
+
+// Close stop accepting and drop the Unix socket peers
+func (u *UnixServer) Close() error {
+	u.Lock()
+	listener := u.listener
+	u.listener = nil
+	u.Unlock()
+	var err error
+	if listener != nil {
+		err = listener.Close()
+	}
+	u.tcp.dropTransport(TransportUnix)
+	return err
+}
+
+// ConnectUnix join the node serving the socket at path, the returned
+// address keys the node in the peer table
+func (s *TcpServer) ConnectUnix(path string) (net.IP, error) {
+	if s.isClosed() {
+		return nil, errors.New("TCP server closed")
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	addr := s.peerAddr(unixPeerNet, &s.unixNext)
+	if addr == nil {
+		conn.Close()
+		return nil, errors.New("no unix peer address left")
+	}
+	node := newNode(addr, false)
+	node.transport = TransportUnix
+	isExist, node := s.AddNode(node)
+	if isExist {
+		conn.Close()
+		return nil, errors.New("unix peer address in use")
+	}
+	node.conn = conn
+	logger.Info("Unix created connect", "addr", addr.IP, "path", path)
+	s.startNode(node)
+	return addr.IP, nil
+}
+
+// peerAddr the next address of the /16 network after *next that is not in
+// the peer table, a peer given the address of an offline node would take
+// over its state. Once every address is taken the first offline node is
+// dropped from the table and its address given again
+func (s *TcpServer) peerAddr(network net.IP, next *uint16) *net.TCPAddr {
+	s.Lock()
+	defer s.Unlock()
+	var offline net.IP
+	for tries := 0; tries < 0xffff; tries++ {
+		*next++
+		if *next == 0 || *next == 0xffff {
+			continue
+		}
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, network)
+		ip[2], ip[3] = byte(*next>>8), byte(*next)
+		node := s.nodes[ip.String()]
+		if node == nil {
+			return &net.TCPAddr{IP: ip}
+		}
+		if offline == nil {
+			node.Lock()
+			if !node.isOnline {
+				offline = ip
+			}
+			node.Unlock()
+		}
+	}
+	if offline == nil {
+		return nil
+	}
+	delete(s.nodes, offline.String())
+	return &net.TCPAddr{IP: offline}
+}
@@ -0,0 +1,113 @@
+package p2p
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnixServer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "p2p")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "node.sock")
+
+	handler := NewEventHandler(nil)
+	node := NewTCPServer(18701, handler)
+	go node.Start()
+	defer node.Close()
+	received := make(chan *Context, 1)
+	handler.RegisterEventHandler(60, func(c *Context) {
+		received <- c
+		c.Reply(61, "pong")
+	})
+	listener, err := ListenUnix(path, 0660)
+	assert.NoError(t, err)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+	_, err = ListenUnix(path, 0660)
+	assert.Error(t, err)
+	unix := NewUnixServer(node)
+	go unix.Serve(listener)
+
+	serviceHandler := NewEventHandler(nil)
+	service := NewTCPServer(18711, serviceHandler)
+	go service.Start()
+	defer service.Close()
+	replies := make(chan *Context, 1)
+	serviceHandler.RegisterEventHandler(61, func(c *Context) { replies <- c })
+	ip, err := service.ConnectUnix(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.255.0.1", ip.String())
+
+	// the probe of the second listen took the first address of the node
+	var accepted string
+	assert.NoError(t, service.WriteToTCP(newRawMsg(60, []byte("ping")), ip.String()))
+	select {
+	case c := <-received:
+		assert.Equal(t, "ping", string(c.Body))
+		assert.Equal(t, TransportUnix, c.Transport)
+		accepted = c.IP.String()
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not received")
+	}
+	select {
+	case c := <-replies:
+		assert.Equal(t, "pong", string(c.Body))
+		assert.Equal(t, TransportUnix, c.Transport)
+	case <-time.After(2 * time.Second):
+		t.Fatal("reply not received")
+	}
+	assert.Equal(t, "127.255.0.2", accepted)
+	peer, ok := node.Peer(accepted)
+	assert.True(t, ok)
+	assert.Equal(t, TransportUnix, peer.Transport)
+
+	assert.NoError(t, unix.Close())
+	peer, _ = node.Peer(accepted)
+	assert.False(t, peer.Online)
+	_, err = service.ConnectUnix(path)
+	assert.Error(t, err)
+}
+
+func TestListenUnix_RemoveError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "p2p")
+	defer os.RemoveAll(dir)
+
+	// a non-empty directory at the path cannot be replaced
+	path := filepath.Join(dir, "node.sock")
+	assert.NoError(t, os.MkdirAll(filepath.Join(path, "keep"), 0700))
+	_, err := ListenUnix(path, 0660)
+	assert.Error(t, err)
+}
+
+func TestTcpServer_PeerAddr(t *testing.T) {
+	server := NewTCPServer(18721, NewEventHandler(nil))
+	offline := newNode(&net.TCPAddr{IP: net.ParseIP("127.255.0.1").To4()}, false)
+	server.AddNode(offline)
+	offline.isOnline = false
+
+	// an offline node keeps its address while others are free
+	var next uint16
+	addr := server.peerAddr(unixPeerNet, &next)
+	assert.Equal(t, "127.255.0.2", addr.IP.String())
+	addr = server.peerAddr(unixPeerNet, &next)
+	assert.Equal(t, "127.255.0.3", addr.IP.String())
+
+	// once every address is taken the offline node gives up its own
+	for i := 2; i < 0xffff; i++ {
+		ip := net.IPv4(127, 255, byte(i>>8), byte(i)).To4()
+		server.nodes[ip.String()] = &TcpNode{addr: &net.TCPAddr{IP: ip}, isOnline: true}
+	}
+	addr = server.peerAddr(unixPeerNet, &next)
+	assert.Equal(t, "127.255.0.1", addr.IP.String())
+	assert.Nil(t, server.nodes["127.255.0.1"])
+	server.nodes["127.255.0.1"] = offline
+	offline.isOnline = true
+	assert.Nil(t, server.peerAddr(unixPeerNet, &next))
+}
@@ -0,0 +1,302 @@
+package p2p
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocketProtocol subprotocol name, the binary messages carry XB frames
+const WebSocketProtocol = "xb"
+
+// WebSocketPath the endpoint peers upgrade on
+const WebSocketPath = "/p2p"
+
+// wsPeerNet addresses given to WebSocket peers, browsers behind one NAT
+// share an IP so each connection gets its own key in the peer table
+var wsPeerNet = net.IPv4(127, 254, 0, 0).To4()
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// WebSocketServer accept peers that cannot open raw TCP sockets, such as
+// browsers, their connections join the peer table of the TcpServer as
+// client-role peers
+type WebSocketServer struct {
+	tcp     *TcpServer
+	origins map[string]bool
+	server  *http.Server
+	next    uint16
+	sync.Mutex
+}
+
+// NewWebSocketServer peers join tcp, origins lists the browser origins
+// allowed, none allows the same origin only
+func NewWebSocketServer(tcp *TcpServer, origins ...string) *WebSocketServer {
+	if tcp == nil {
+		panic("WebSocket TcpServer not empty")
+	}
+	ws := &WebSocketServer{tcp: tcp, origins: map[string]bool{}}
+	for _, origin := range origins {
+		ws.origins[strings.ToLower(origin)] = true
+	}
+	return ws
+}
+
+// Serve accept upgrades on listener until Close
+func (ws *WebSocketServer) Serve(listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle(WebSocketPath, ws)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: tcpCreateConnTime * time.Second}
+	ws.Lock()
+	ws.server = server
+	ws.Unlock()
+	logger.Info("WebSocket server start", "addr", listener.Addr().String())
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Close stop accepting and drop the WebSocket peers
+func (ws *WebSocketServer) Close() error {
+	ws.Lock()
+	server := ws.server
+	ws.Unlock()
+	var err error
+	if server != nil {
+		err = server.Close()
+	}
+	ws.tcp.dropTransport(TransportWebSocket)
+	return err
+}
+
+func (ws *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "websocket version not supported", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "websocket key invalid", http.StatusBadRequest)
+		return
+	}
+	if !ws.allowOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || ws.tcp.isBanned(host) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		logger.Error("WebSocket hijack", "err", err.Error())
+		return
+	}
+	addr := ws.tcp.peerAddr(wsPeerNet, &ws.next)
+	if addr == nil {
+		logger.Warn("WebSocket no peer address left", "addr", r.RemoteAddr)
+		conn.Close()
+		return
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + wsAccept(key) + "\r\n"
+	if headerContains(r.Header, "Sec-WebSocket-Protocol", WebSocketProtocol) {
+		response += "Sec-WebSocket-Protocol: " + WebSocketProtocol + "\r\n"
+	}
+	conn.SetWriteDeadline(ws.tcp.Transport.Now().Add(tcpWriteTimeout * time.Second))
+	if _, err := conn.Write([]byte(response + "\r\n")); err != nil {
+		logger.Warn("WebSocket write handshake", "addr", r.RemoteAddr, "err", err.Error())
+		conn.Close()
+		return
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(true)
+	}
+	logger.Info("WebSocket created connect", "addr", addr.IP, "remote", r.RemoteAddr, "origin", r.Header.Get("Origin"))
+	ws.tcp.accept(&wsConn{Conn: conn, reader: rw.Reader}, addr, TransportWebSocket)
+}
+
+// allowOrigin requests without an Origin come from non-browser peers,
+// browsers need a configured origin or the host they upgrade on
+func (ws *WebSocketServer) allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(ws.origins) > 0 {
+		return ws.origins[strings.ToLower(origin)]
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains true if a comma separated header lists token
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn the server side of a WebSocket as a byte stream, every write is
+// one binary message, reads join the payloads of incoming messages so XB
+// frames may span or share messages
+type wsConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+	writeLock sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame read frame headers, answer control frames and stop at the next
+// data frame
+func (c *wsConn) nextFrame() error {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, head); err != nil {
+		return err
+	}
+	opcode := head[0] & 0x0f
+	if head[1]&0x80 == 0 {
+		return errors.New("websocket client frame not masked")
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskPos = 0
+	if length > wsMaxFrameLen {
+		return fmt.Errorf("websocket frame too large len:%d", length)
+	}
+	switch opcode {
+	case wsOpBinary, wsOpContinuation:
+		c.remaining = length
+		return nil
+	case wsOpText:
+		c.writeFrame(wsOpClose, []byte{0x03, 0xeb}) // 1003 unsupported data
+		return errors.New("websocket text frames not supported")
+	}
+	if opcode < wsOpClose || opcode > wsOpPong || length > 125 {
+		return fmt.Errorf("websocket invalid control frame opcode:%d", opcode)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+	c.unmask(payload)
+	switch opcode {
+	case wsOpPing:
+		return c.writeFrame(wsOpPong, payload)
+	case wsOpClose:
+		c.writeFrame(wsOpClose, payload)
+		return io.EOF
+	}
+	return nil
+}
+
+func (c *wsConn) unmask(data []byte) {
+	for i := range data {
+		data[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
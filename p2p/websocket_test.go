@@ -0,0 +1,231 @@
+package p2p
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// wsDial upgrade a connection to the WebSocket server on addr
+func wsDial(t *testing.T, conn net.Conn, origin string) (*bufio.Reader, *http.Response) {
+	request := "GET " + WebSocketPath + " HTTP/1.1\r\nHost: p2p\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Protocol: xb\r\n"
+	if origin != "" {
+		request += "Origin: " + origin + "\r\n"
+	}
+	_, err := conn.Write([]byte(request + "\r\n"))
+	assert.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	assert.NoError(t, err)
+	return reader, response
+}
+
+// wsWrite send a masked client frame
+func wsWrite(conn net.Conn, opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	if len(payload) < 126 {
+		frame = append(frame, 0x80|byte(len(payload)))
+	} else {
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := conn.Write(frame)
+	return err
+}
+
+// wsRead read a server frame
+func wsRead(t *testing.T, reader *bufio.Reader) (byte, []byte) {
+	head := make([]byte, 2)
+	_, err := io.ReadFull(reader, head)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0), head[1]&0x80)
+	length := int(head[1])
+	if length == 126 {
+		ext := make([]byte, 2)
+		io.ReadFull(reader, ext)
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	assert.NoError(t, err)
+	return head[0] & 0x0f, payload
+}
+
+// wsReadMsg read XB frames until one of command arrives
+func wsReadMsg(t *testing.T, reader *bufio.Reader, command Command) *Msg {
+	var stream []byte
+	for i := 0; i < 20; i++ {
+		opcode, payload := wsRead(t, reader)
+		if opcode != wsOpBinary {
+			continue
+		}
+		stream = append(stream, payload...)
+		for len(stream) >= HeadLen {
+			msg := &Msg{}
+			length, err := msg.UnmarshalBinary(stream[:HeadLen])
+			assert.NoError(t, err)
+			if len(stream) < HeadLen+int(length) {
+				break
+			}
+			msg.SetBody(stream[HeadLen : HeadLen+int(length)])
+			stream = stream[HeadLen+int(length):]
+			if msg.GetCommand() == command {
+				return msg
+			}
+		}
+	}
+	t.Fatal("message not received")
+	return nil
+}
+
+func TestWebSocketServer(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	network := NewMemNetwork(1)
+	defer network.Close()
+	host := network.Host(net.ParseIP("10.0.0.1"))
+	handler := NewEventHandler(nil)
+	tcp := NewTCPServer(10001, handler)
+	tcp.Transport = host
+	go tcp.Start()
+	defer tcp.Close()
+	received := make(chan *Context, 1)
+	handler.RegisterEventHandler(60, func(c *Context) { received <- c })
+
+	listener, err := host.Listen(10002)
+	assert.NoError(t, err)
+	ws := NewWebSocketServer(tcp, "https://dashboard.example")
+	go ws.Serve(listener)
+	defer ws.Close()
+	client := network.Host(net.ParseIP("10.0.0.2"))
+	dial := func() net.Conn {
+		conn, err := client.Dial(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 10002}, time.Second)
+		assert.NoError(t, err)
+		return conn
+	}
+
+	conn := dial()
+	_, response := wsDial(t, conn, "https://evil.example")
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	conn.Close()
+
+	conn = dial()
+	defer conn.Close()
+	reader, response := wsDial(t, conn, "https://dashboard.example")
+	assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", response.Header.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, WebSocketProtocol, response.Header.Get("Sec-WebSocket-Protocol"))
+
+	// the server greets like any TCP peer
+	wsReadMsg(t, reader, CommandHello)
+	hello := newRawMsg(CommandHello, []byte(`{"version":1,"role":"server","nodeId":"0102030405060708"}`))
+	assert.NoError(t, wsWrite(conn, wsOpBinary, mustMarshal(hello)))
+	// one XB frame split over two messages
+	data := mustMarshal(newRawMsg(60, []byte("from browser")))
+	assert.NoError(t, wsWrite(conn, wsOpBinary, data[:5]))
+	assert.NoError(t, wsWrite(conn, wsOpContinuation, data[5:]))
+	var ip string
+	select {
+	case c := <-received:
+		assert.Equal(t, "from browser", string(c.Body))
+		assert.Equal(t, TransportWebSocket, c.Transport)
+		assert.True(t, wsPeerNet.Equal(c.IP.Mask(net.CIDRMask(16, 32))))
+		ip = c.IP.String()
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	peer, ok := tcp.Peer(ip)
+	assert.True(t, ok)
+	assert.Equal(t, Client, peer.Role)
+	assert.Equal(t, TransportWebSocket, peer.Transport)
+	assert.Equal(t, "10.0.0.2:50002", peer.Remote)
+	assert.True(t, peer.Inbound)
+
+	assert.NoError(t, tcp.WriteToTCP(newRawMsg(61, []byte("to browser")), ip))
+	assert.Equal(t, "to browser", string(wsReadMsg(t, reader, 61).Body))
+
+	assert.NoError(t, wsWrite(conn, wsOpPing, []byte("ping")))
+	for {
+		opcode, payload := wsRead(t, reader)
+		if opcode == wsOpPong {
+			assert.Equal(t, "ping", string(payload))
+			break
+		}
+	}
+
+	// text frames are refused with close 1003
+	assert.NoError(t, wsWrite(conn, wsOpText, []byte("hi")))
+	for {
+		opcode, payload := wsRead(t, reader)
+		if opcode == wsOpClose {
+			assert.Equal(t, []byte{0x03, 0xeb}, payload)
+			break
+		}
+	}
+}
+
+func TestWebSocketServer_SameIP(t *testing.T) {
+	defer os.Unsetenv(NodeType)
+	os.Setenv(NodeType, Server)
+	network := NewMemNetwork(1)
+	defer network.Close()
+	host := network.Host(net.ParseIP("10.0.0.1"))
+	tcp := NewTCPServer(10001, NewEventHandler(nil))
+	tcp.Transport = host
+	go tcp.Start()
+	defer tcp.Close()
+	listener, err := host.Listen(10002)
+	assert.NoError(t, err)
+	ws := NewWebSocketServer(tcp)
+	go ws.Serve(listener)
+	defer ws.Close()
+	client := network.Host(net.ParseIP("10.0.0.2"))
+	dial := func(origin string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := client.Dial(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 10002}, time.Second)
+		assert.NoError(t, err)
+		reader, response := wsDial(t, conn, origin)
+		return conn, reader, response
+	}
+
+	// without configured origins only the same origin is allowed
+	conn, _, response := dial("https://evil.example")
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	conn.Close()
+
+	// two peers behind one IP, each has its own entry
+	for _, origin := range []string{"http://p2p", ""} {
+		conn, reader, response := dial(origin)
+		defer conn.Close()
+		assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+		wsReadMsg(t, reader, CommandHello)
+	}
+	var remotes []string
+	for _, peer := range tcp.Peers() {
+		assert.Equal(t, TransportWebSocket, peer.Transport)
+		assert.True(t, peer.Online)
+		remotes = append(remotes, peer.Remote)
+	}
+	assert.Len(t, remotes, 2)
+	assert.NotEqual(t, remotes[0], remotes[1])
+}
+
+func TestHeaderContains(t *testing.T) {
+	header := http.Header{}
+	header.Set("Connection", "keep-alive, Upgrade")
+	assert.True(t, headerContains(header, "connection", "upgrade"))
+	assert.False(t, headerContains(header, "Connection", "close"))
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", wsAccept("dGhlIHNhbXBsZSBub25jZQ=="))
+}
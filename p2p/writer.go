@@ -0,0 +1,196 @@
+package p2p
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrWriteQueueFull the peer does not drain its outbound queue, the frame
+// was dropped
+var ErrWriteQueueFull = errors.New("TCP write queue full")
+
+// ErrBulkFrameTooLarge a bulk frame over priorityBulkMaxFrame, one frame
+// would hold control frames back, send the payload over a stream
+var ErrBulkFrameTooLarge = errors.New("TCP bulk frame too large")
+
+// outFrame a marshaled frame waiting in a write queue
+type outFrame struct {
+	data     []byte
+	message  Message
+	priority Priority
+}
+
+// nodeWriter owns the writes to one connection, frames are queued by
+// priority class without blocking the sender and small frames are
+// coalesced into a single write
+type nodeWriter struct {
+	node      *TcpNode
+	conn      net.Conn
+	queues    [priorityCount]chan outFrame
+	notify    chan struct{}
+	turn      Priority
+	credit    int
+	drained   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	sync.Mutex
+}
+
+func newNodeWriter(node *TcpNode, conn net.Conn) *nodeWriter {
+	w := &nodeWriter{
+		node:    node,
+		conn:    conn,
+		notify:  make(chan struct{}, 1),
+		turn:    PriorityHigh,
+		credit:  priorityWeight[PriorityHigh],
+		drained: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for i := range w.queues {
+		w.queues[i] = make(chan outFrame, tcpWriteQueueLen)
+	}
+	return w
+}
+
+// writer of the current connection, started on first use, nil without a
+// connection
+func (node *TcpNode) getWriter() *nodeWriter {
+	node.Lock()
+	defer node.Unlock()
+	if node.conn == nil {
+		return nil
+	}
+	if node.writer == nil || node.writer.conn != node.conn {
+		if node.writer != nil {
+			node.writer.close()
+		}
+		node.writer = newNodeWriter(node, node.conn)
+		go node.writer.run()
+	}
+	return node.writer
+}
+
+func (w *nodeWriter) enqueue(frame outFrame) error {
+	err := w.offer(frame)
+	if err == ErrWriteQueueFull {
+		logger.Warn("TCP write queue full", "addr", w.node.addr.IP, "priority", frame.priority, "queued", len(w.queues[frame.priority]))
+	}
+	return err
+}
+
+// enqueueWait block while the queue of the frame is full, for senders
+// that must not lose frames
+func (w *nodeWriter) enqueueWait(frame outFrame) error {
+	for {
+		drained := w.drainedCh()
+		err := w.offer(frame)
+		if err != ErrWriteQueueFull {
+			return err
+		}
+		select {
+		case <-drained:
+		case <-w.done:
+			return errors.New("node conn closed")
+		}
+	}
+}
+
+func (w *nodeWriter) offer(frame outFrame) error {
+	select {
+	case <-w.done:
+		return errors.New("node conn closed")
+	default:
+	}
+	select {
+	case w.queues[frame.priority] <- frame:
+	default:
+		return ErrWriteQueueFull
+	}
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// drainedCh closed once the next batch is written
+func (w *nodeWriter) drainedCh() chan struct{} {
+	w.Lock()
+	defer w.Unlock()
+	return w.drained
+}
+
+// close stop the writer, queued frames are dropped
+func (w *nodeWriter) close() {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+}
+
+func (w *nodeWriter) run() {
+	buffer := make([]byte, 0, tcpWriteBatchBytes)
+	batch := make([]outFrame, 0, 16)
+	for {
+		select {
+		case <-w.notify:
+		case <-w.done:
+			return
+		}
+		for {
+			batch, buffer = batch[:0], buffer[:0]
+			for len(buffer) < tcpWriteBatchBytes {
+				frame, ok := w.pick()
+				if !ok {
+					break
+				}
+				batch = append(batch, frame)
+				buffer = append(buffer, frame.data...)
+			}
+			if len(batch) == 0 {
+				break
+			}
+			if err := w.write(buffer, batch); err != nil {
+				w.failed(err)
+				return
+			}
+			w.Lock()
+			close(w.drained)
+			w.drained = make(chan struct{})
+			w.Unlock()
+		}
+	}
+}
+
+func (w *nodeWriter) write(buffer []byte, batch []outFrame) error {
+	node := w.node
+	clock := node.server.Transport
+	if err := w.conn.SetWriteDeadline(clock.Now().Add(tcpWriteTimeout * time.Second)); err != nil {
+		logger.Error("TCP set write deadline", "err", err.Error())
+		return err
+	}
+	if _, err := w.conn.Write(buffer); err != nil {
+		logger.Error("TCP write to data", "err", err.Error())
+		return err
+	}
+	now := clock.Now()
+	for _, frame := range batch {
+		captureFrame(CaptureOutbound, node.transport, node.addr.IP, node.addr.Port, frame.data, now)
+		countFrame(CaptureOutbound, node.transport, len(frame.data))
+		frame.message.Log(node.addr.IP, "TCP send msg ===============>")
+	}
+	return nil
+}
+
+// failed drop the node unless it already moved to a new connection
+func (w *nodeWriter) failed(err error) {
+	w.close()
+	node := w.node
+	node.Lock()
+	current := node.conn == w.conn
+	node.Unlock()
+	if current {
+		node.server.RemoveNode(node)
+	}
+}
@@ -0,0 +1,136 @@
+package p2p
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countConn counts writes, blocks them while stall is open and signals
+// stalled when a write blocks
+type countConn struct {
+	net.Conn
+	writes  int
+	stall   chan struct{}
+	stalled chan struct{}
+	sync.Mutex
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	if c.stall != nil {
+		select {
+		case c.stalled <- struct{}{}:
+		default:
+		}
+		<-c.stall
+	}
+	c.Lock()
+	c.writes++
+	c.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestNodeWriter_Batch(t *testing.T) {
+	s := NewTCPServer(8897, NewEventHandler(nil))
+	node, remote := newTestTcpNode(t, s, NodeID{1}, NodeClient)
+	defer remote.Close()
+	conn := &countConn{Conn: node.conn}
+	writer := newNodeWriter(node, conn)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, writer.enqueue(outFrame{data: mustMarshal(newRawMsg(60, []byte{byte(i)})), message: NewMsg(60, nil)}))
+	}
+	go writer.run()
+	for i := 0; i < 10; i++ {
+		msg := readTestMsg(t, remote)
+		assert.Equal(t, []byte{byte(i)}, msg.Body)
+	}
+	assert.Equal(t, 1, conn.writes)
+	writer.close()
+	assert.Error(t, writer.enqueue(outFrame{}))
+}
+
+func TestNodeWriter_QueueFull(t *testing.T) {
+	s := NewTCPServer(8898, NewEventHandler(nil))
+	node, remote := newTestTcpNode(t, s, NodeID{1}, NodeClient)
+	defer remote.Close()
+	writer := newNodeWriter(node, node.conn)
+	for i := 0; i < tcpWriteQueueLen; i++ {
+		assert.NoError(t, writer.enqueue(outFrame{}))
+	}
+	assert.Equal(t, ErrWriteQueueFull, writer.enqueue(outFrame{}))
+}
+
+func TestNodeWriter_EnqueueWait(t *testing.T) {
+	s := NewTCPServer(8896, NewEventHandler(nil))
+	node, remote := newTestTcpNode(t, s, NodeID{1}, NodeClient)
+	defer remote.Close()
+	conn := &countConn{Conn: node.conn, stall: make(chan struct{}), stalled: make(chan struct{}, 1)}
+	writer := newNodeWriter(node, conn)
+	go writer.run()
+	frame := outFrame{data: mustMarshal(NewMsg(60, nil)), message: NewMsg(60, nil), priority: PriorityNormal}
+	assert.NoError(t, writer.enqueue(frame))
+	<-conn.stalled
+	for i := 0; i < tcpWriteQueueLen; i++ {
+		assert.NoError(t, writer.enqueue(frame))
+	}
+
+	// the waiting sender gets in once a batch is written
+	result := make(chan error, 2)
+	go func() { result <- writer.enqueueWait(frame) }()
+	select {
+	case err := <-result:
+		t.Fatal("enqueueWait returned on a full queue", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(conn.stall)
+	assert.NoError(t, <-result)
+
+	// a closed writer releases waiters
+	writer.close()
+	go func() { result <- writer.enqueueWait(frame) }()
+	assert.Error(t, <-result)
+}
+
+func TestTcpServer_SlowPeer(t *testing.T) {
+	s := NewTCPServer(8899, NewEventHandler(nil))
+	slow, slowRemote := newTestTcpNode(t, s, NodeID{1}, NodeClient)
+	fast, fastRemote := newTestTcpNode(t, s, NodeID{2}, NodeClient)
+	defer slowRemote.Close()
+	defer fastRemote.Close()
+	stalled := &countConn{Conn: slow.conn, stall: make(chan struct{}), stalled: make(chan struct{}, 1)}
+	slow.conn = stalled
+	s.nodes["10.0.0.1"] = slow
+	s.nodes["10.0.0.2"] = fast
+
+	// the slow writer holds one batch, the queue fills behind it
+	assert.NoError(t, s.WriteToTCP(NewMsg(60, []byte("stuck")), "10.0.0.1"))
+	select {
+	case <-stalled.stalled:
+	case <-time.After(time.Second):
+		t.Fatal("writer did not start")
+	}
+	writer := slow.getWriter()
+	for i := 0; i < tcpWriteQueueLen; i++ {
+		assert.NoError(t, writer.enqueue(outFrame{data: mustMarshal(NewMsg(60, nil)), message: NewMsg(60, nil), priority: PriorityNormal}))
+	}
+	assert.Equal(t, ErrWriteQueueFull, s.WriteToTCP(NewMsg(60, nil), "10.0.0.1"))
+
+	start := time.Now()
+	assert.NoError(t, s.WriteToTCP(NewMsg(60, []byte("fast")), "10.0.0.2"))
+	assert.Equal(t, "fast", string(readTestMsg(t, fastRemote).Body))
+	assert.True(t, time.Since(start) < time.Second)
+
+	close(stalled.stall)
+	assert.Equal(t, "stuck", string(readTestMsg(t, slowRemote).Body))
+}
+
+func mustMarshal(message Message) []byte {
+	data, err := message.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return data
+}